@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth 限制管理接口的访问。设定了 token 时须以 Authorization: Bearer <token>
+// 或 ?token= 传入相同的 token，否则只接受直接来自本机 (未经反向代理) 的请求
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token != "" {
+			given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if given == "" {
+				given = c.Query("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				c.AbortWithStatusJSON(401, gin.H{
+					"error": "token 无效",
+				})
+			}
+			return
+		}
+
+		ip := net.ParseIP(c.RemoteIP())
+		proxied := c.GetHeader("X-Forwarded-For") != "" || c.GetHeader("X-Real-Ip") != "" || c.GetHeader("Forwarded") != ""
+		if ip == nil || !ip.IsLoopback() || proxied {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": "未设定 admin_token 时只接受本机的请求",
+			})
+		}
+	}
+}
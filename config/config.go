@@ -0,0 +1,303 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config 程序设定
+//
+// 读取顺序 (后者覆盖前者): 预设值 < 设定文件 < 环境变量 < 运行参数
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Database  Database  `yaml:"database"`
+	Postgres  Postgres  `yaml:"postgres"`
+	Sink      Sink      `yaml:"sink"`
+	Live      Live      `yaml:"live"`
+	Api       Api       `yaml:"api"`
+	WebSocket WebSocket `yaml:"websocket"`
+	Webhook   Webhook   `yaml:"webhook"`
+}
+
+// Server HTTP 服务设定
+type Server struct {
+	Port           int    `yaml:"port" env:"PORT" flag:"port" usage:"set the websocket port"`
+	Release        bool   `yaml:"release" env:"GIN_MODE" flag:"release" usage:"set release mode"`
+	DebugAddr      string `yaml:"debug_addr" env:"DEBUG_ADDR" flag:"debug-addr" usage:"set the pprof listen address, empty to disable"`
+	NoListeningLog bool   `yaml:"no_listening_log" env:"NO_LISTENING_LOG" usage:"hide request logs of /listening"`
+	// AdminToken 管理 /alerts, /notifications 及 /webhooks 所需的 token，为空则只接受本机的请求
+	AdminToken string `yaml:"admin_token" env:"ADMIN_TOKEN" usage:"require this token to manage /alerts, /notifications and /webhooks, empty to only allow local requests"`
+}
+
+// Database 缓存数据库设定
+type Database struct {
+	// Strategy 为 singleton, dynamic 或 mix
+	Strategy string `yaml:"strategy" env:"DB_STRATEGY" flag:"db-strategy" usage:"set the cache database strategy: singleton, dynamic, mix"`
+}
+
+// Postgres PostgreSQL 连接设定
+type Postgres struct {
+	Host     string `yaml:"host" env:"PG_HOST" flag:"host" usage:"set PostgreSQL host"`
+	Port     int    `yaml:"port" env:"PG_PORT" flag:"pg-port" usage:"set PostgreSQL port"`
+	User     string `yaml:"user" env:"PG_USER" flag:"user" usage:"set PostgreSQL user"`
+	Password string `yaml:"password" env:"PG_PASSWORD" flag:"password" usage:"set PostgreSQL password"`
+	DBName   string `yaml:"dbname" env:"PG_DBNAME" flag:"dbname" usage:"set PostgreSQL database name"`
+	SSLMode  string `yaml:"sslmode" env:"PG_SSLMODE" flag:"sslmode" usage:"set PostgreSQL sslmode"`
+	// Options 其他 libpq 连接参数，例如 connect_timeout
+	Options map[string]string `yaml:"options"`
+}
+
+// Sink 弹幕保存设定
+type Sink struct {
+	// Types 为 postgres, sqlite 或 file
+	Types       []string `yaml:"types" env:"DANMAKU_SINK" flag:"sink" usage:"set danmaku sinks, comma separated: postgres, sqlite, file"`
+	SqlitePath  string   `yaml:"sqlite_path" env:"DANMAKU_SQLITE" flag:"sqlite" usage:"set SQLite database path for the sqlite sink"`
+	FileDir     string   `yaml:"file_dir" env:"DANMAKU_DIR" flag:"sink-dir" usage:"set output directory for the file sink"`
+	FileMaxSize int64    `yaml:"file_max_size" env:"DANMAKU_MAX_SIZE" flag:"sink-max-size" usage:"set max size in bytes of each file written by the file sink"`
+	Partition   bool     `yaml:"partition" env:"DANMAKU_PARTITION" flag:"partition" usage:"migrate PostgreSQL danmaku tables into one table partitioned by room"`
+	// FlushInterval 写入间隔
+	FlushInterval time.Duration `yaml:"flush_interval" env:"DANMAKU_FLUSH_INTERVAL" usage:"set interval between danmaku flushes"`
+	// Commands 额外写入 live_event 的指令，例如 GUARD_BUY, INTERACT_WORD，* 为全部
+	Commands []string `yaml:"commands" env:"DANMAKU_COMMANDS" flag:"commands" usage:"set commands stored as raw events, comma separated, * for all"`
+	// QueueSize 等待保存的讯息队列长度
+	QueueSize int `yaml:"queue_size" env:"DANMAKU_QUEUE_SIZE" usage:"set the capacity of the danmaku save queue"`
+	// QueuePolicy 队列已满时 drop 丢弃讯息，block 等待队列空出
+	QueuePolicy string `yaml:"queue_policy" env:"DANMAKU_QUEUE_POLICY" usage:"set what to do when the danmaku save queue is full: drop, block"`
+	// SpoolDir 数据库不可用时暂存弹幕的目录，为空则直接丢弃
+	SpoolDir string `yaml:"spool_dir" env:"DANMAKU_SPOOL_DIR" flag:"spool-dir" usage:"set directory for spooling danmaku while the database is unavailable, empty to disable"`
+	// SpoolMaxSize 暂存文件尚未写入的最大字节数，超过后丢弃新的弹幕，0 为不限制
+	SpoolMaxSize int64 `yaml:"spool_max_size" env:"DANMAKU_SPOOL_MAX_SIZE" flag:"spool-max-size" usage:"set max size in bytes of danmaku waiting in each spool file, 0 for unlimited"`
+}
+
+// Live B站直播连接设定
+type Live struct {
+	// WsHostForce 为 wss:// 开头的地址或 AUTO
+	WsHostForce     string `yaml:"ws_host_force" env:"BILI_WS_HOST_FORCE" usage:"force the bilibili websocket host, or AUTO for the lowest latency host"`
+	ResetLowLatency bool   `yaml:"reset_low_latency" env:"RESET_LOW_LATENCY" usage:"reset all saved low latency hosts on startup"`
+}
+
+// Api B站 API 请求设定
+type Api struct {
+	UserAgent string        `yaml:"user_agent" env:"API_USER_AGENT" usage:"set the user agent of bilibili API requests"`
+	Timeout   time.Duration `yaml:"timeout" env:"API_TIMEOUT" usage:"set the timeout of bilibili API requests"`
+}
+
+// WebSocket 订阅 WebSocket 设定
+type WebSocket struct {
+	// RestrictGlobal 不为空时，连接 /ws/global 需要传入相同的 token
+	RestrictGlobal string `yaml:"restrict_global" env:"RESTRICT_GLOBAL" usage:"require this token to connect /ws/global"`
+	// StatsInterval 推送 STATS 指令的间隔，0 为不推送
+	StatsInterval time.Duration `yaml:"stats_interval" env:"WS_STATS_INTERVAL" usage:"set the interval of STATS messages, 0 to disable"`
+	// ReplaySize 每个房间保留的最近讯息数量，用于 resume_from 重连补发，0 为停用
+	ReplaySize int `yaml:"replay_size" env:"WS_REPLAY_SIZE" usage:"set how many recent messages of each room are kept for resume_from, 0 to disable"`
+	// ReplayPersist 关闭时将讯息缓冲保存到缓存数据库，重启后恢复
+	ReplayPersist bool `yaml:"replay_persist" env:"WS_REPLAY_PERSIST" usage:"save the resume buffers into the cache database on shutdown"`
+	// SendQueueSize 每个连接等待发送的讯息队列长度
+	SendQueueSize int `yaml:"send_queue_size" env:"WS_SEND_QUEUE_SIZE" usage:"set the capacity of the send queue of each websocket connection"`
+	// SlowConsumerPolicy 发送队列已满时 drop_oldest 丢弃最旧的讯息，disconnect 断开连接
+	SlowConsumerPolicy string `yaml:"slow_consumer_policy" env:"WS_SLOW_CONSUMER_POLICY" usage:"set what to do when the send queue of a websocket connection is full: drop_oldest, disconnect"`
+}
+
+// Webhook 推送通知的设定
+type Webhook struct {
+	// Secret 计算 HMAC 签名的预设密钥，规则未指定密钥时使用，为空则不签名
+	Secret     string        `yaml:"secret" env:"WEBHOOK_SECRET" usage:"set the default HMAC secret of webhook deliveries"`
+	Timeout    time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT" usage:"set the timeout of each webhook request"`
+	MaxRetries int           `yaml:"max_retries" env:"WEBHOOK_MAX_RETRIES" usage:"set how many times a failed webhook delivery is retried"`
+	QueueSize  int           `yaml:"queue_size" env:"WEBHOOK_QUEUE_SIZE" usage:"set the capacity of the webhook delivery queue"`
+	Workers    int           `yaml:"workers" env:"WEBHOOK_WORKERS" usage:"set the number of concurrent webhook deliveries"`
+	// AllowPrivate 允许推送到本机及内网地址
+	AllowPrivate bool `yaml:"allow_private" env:"WEBHOOK_ALLOW_PRIVATE" usage:"allow webhook targets on loopback and private addresses"`
+}
+
+// Default 返回预设设定
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:      8080,
+			DebugAddr: "0.0.0.0:8082",
+		},
+		Database: Database{
+			Strategy: "singleton",
+		},
+		Postgres: Postgres{
+			SSLMode: "disable",
+		},
+		Sink: Sink{
+			Types:         []string{"postgres"},
+			SqlitePath:    "./danmaku.db",
+			FileDir:       "./danmaku",
+			FileMaxSize:   64 << 20,
+			FlushInterval: 10 * time.Second,
+			QueueSize:     10000,
+			QueuePolicy:   "drop",
+			SpoolDir:      "./cache/spool",
+			SpoolMaxSize:  1 << 30,
+		},
+		WebSocket: WebSocket{
+			StatsInterval:      10 * time.Second,
+			ReplaySize:         100,
+			SendQueueSize:      256,
+			SlowConsumerPolicy: "drop_oldest",
+		},
+		Webhook: Webhook{
+			Timeout:    10 * time.Second,
+			MaxRetries: 3,
+			QueueSize:  1000,
+			Workers:    4,
+		},
+		Api: Api{
+			UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
+			Timeout:   30 * time.Second,
+		},
+	}
+}
+
+// Validate 检查设定是否有效
+func (c *Config) Validate() error {
+	var errs []string
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("server.port 无效: %v", c.Server.Port))
+	}
+
+	switch strings.ToLower(c.Database.Strategy) {
+	case "singleton", "dynamic", "mix":
+	default:
+		errs = append(errs, fmt.Sprintf("database.strategy 无效: %q", c.Database.Strategy))
+	}
+
+	if c.Postgres.Port < 0 || c.Postgres.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("postgres.port 无效: %v", c.Postgres.Port))
+	}
+
+	switch c.Postgres.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		errs = append(errs, fmt.Sprintf("postgres.sslmode 无效: %q", c.Postgres.SSLMode))
+	}
+
+	for _, t := range c.Sink.Types {
+		switch strings.ToLower(strings.TrimSpace(t)) {
+		case "postgres", "sqlite", "file":
+		default:
+			errs = append(errs, fmt.Sprintf("sink.types 无效: %q", t))
+		}
+	}
+
+	if c.Sink.SpoolMaxSize < 0 {
+		errs = append(errs, fmt.Sprintf("sink.spool_max_size 无效: %v", c.Sink.SpoolMaxSize))
+	}
+
+	if c.Sink.FileMaxSize < 0 {
+		errs = append(errs, fmt.Sprintf("sink.file_max_size 无效: %v", c.Sink.FileMaxSize))
+	}
+
+	if c.Sink.QueueSize <= 0 {
+		errs = append(errs, fmt.Sprintf("sink.queue_size 无效: %v", c.Sink.QueueSize))
+	}
+
+	switch strings.ToLower(c.Sink.QueuePolicy) {
+	case "drop", "block":
+	default:
+		errs = append(errs, fmt.Sprintf("sink.queue_policy 无效: %q", c.Sink.QueuePolicy))
+	}
+
+	if c.Sink.FlushInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("sink.flush_interval 无效: %v", c.Sink.FlushInterval))
+	}
+
+	if host := c.Live.WsHostForce; host != "" && host != "AUTO" && !strings.HasPrefix(host, "wss://") {
+		errs = append(errs, fmt.Sprintf("live.ws_host_force 必须为 wss:// 开头或 AUTO: %q", host))
+	}
+
+	if c.WebSocket.StatsInterval < 0 {
+		errs = append(errs, fmt.Sprintf("websocket.stats_interval 无效: %v", c.WebSocket.StatsInterval))
+	}
+
+	if c.WebSocket.ReplaySize < 0 {
+		errs = append(errs, fmt.Sprintf("websocket.replay_size 无效: %v", c.WebSocket.ReplaySize))
+	}
+
+	if c.WebSocket.SendQueueSize <= 0 {
+		errs = append(errs, fmt.Sprintf("websocket.send_queue_size 无效: %v", c.WebSocket.SendQueueSize))
+	}
+
+	switch strings.ToLower(c.WebSocket.SlowConsumerPolicy) {
+	case "drop_oldest", "disconnect":
+	default:
+		errs = append(errs, fmt.Sprintf("websocket.slow_consumer_policy 无效: %q", c.WebSocket.SlowConsumerPolicy))
+	}
+
+	if c.Webhook.Timeout <= 0 {
+		errs = append(errs, fmt.Sprintf("webhook.timeout 无效: %v", c.Webhook.Timeout))
+	}
+
+	if c.Webhook.MaxRetries < 0 {
+		errs = append(errs, fmt.Sprintf("webhook.max_retries 无效: %v", c.Webhook.MaxRetries))
+	}
+
+	if c.Webhook.QueueSize <= 0 {
+		errs = append(errs, fmt.Sprintf("webhook.queue_size 无效: %v", c.Webhook.QueueSize))
+	}
+
+	if c.Webhook.Workers <= 0 {
+		errs = append(errs, fmt.Sprintf("webhook.workers 无效: %v", c.Webhook.Workers))
+	}
+
+	if c.Api.Timeout < 0 {
+		errs = append(errs, fmt.Sprintf("api.timeout 无效: %v", c.Api.Timeout))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// DSN 返回 libpq 格式的连接字串
+func (p Postgres) DSN() string {
+	params := map[string]string{
+		"host":     p.Host,
+		"user":     p.User,
+		"password": p.Password,
+		"dbname":   p.DBName,
+		"sslmode":  p.SSLMode,
+	}
+	if p.Port > 0 {
+		params["port"] = fmt.Sprint(p.Port)
+	}
+	for k, v := range p.Options {
+		params[k] = v
+	}
+
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%s", k, quoteDSNValue(params[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteDSNValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// fileExists 检查文件是否存在
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+server:
+  port: 9000
+postgres:
+  host: db.local
+  user: file-user
+sink:
+  types: [sqlite, file]
+  flush_interval: 5s
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PG_USER", "env-user")
+	t.Setenv("PG_PASSWORD", "env-password")
+	t.Setenv("GIN_MODE", "release")
+
+	cfg, err := Load("test", []string{"-config", path, "-password", "flag-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 预设值
+	assert.Equal(t, cfg.Database.Strategy, "singleton")
+	// 设定文件
+	assert.Equal(t, cfg.Server.Port, 9000)
+	assert.Equal(t, cfg.Postgres.Host, "db.local")
+	assert.Equal(t, cfg.Sink.Types, []string{"sqlite", "file"})
+	assert.Equal(t, cfg.Sink.FlushInterval, 5*time.Second)
+	// 环境变量覆盖设定文件
+	assert.Equal(t, cfg.Postgres.User, "env-user")
+	assert.Equal(t, cfg.Server.Release, true)
+	// 运行参数覆盖环境变量
+	assert.Equal(t, cfg.Postgres.Password, "flag-password")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Sink.Types = []string{"mysql"}
+	cfg.Live.WsHostForce = "ws://insecure"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected validation error")
+	}
+}
+
+func TestPostgresDSN(t *testing.T) {
+	pg := Postgres{
+		Host:     "localhost",
+		Port:     5432,
+		User:     "user",
+		Password: `it's\secret`,
+		DBName:   "danmaku",
+		SSLMode:  "require",
+		Options:  map[string]string{"connect_timeout": "10"},
+	}
+	assert.Equal(t, pg.DSN(), `connect_timeout='10' dbname='danmaku' host='localhost' password='it\'s\\secret' port='5432' sslmode='require' user='user'`)
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultPath 未指定设定文件时读取的路径，不存在则略过
+const DefaultPath = "config.yaml"
+
+// Load 依序从预设值、设定文件、环境变量和运行参数读取设定，并检查设定是否有效。
+// 设定文件路径由 -config 参数或 BILIGO_CONFIG 环境变量指定。
+func Load(name string, args []string) (*Config, error) {
+	return LoadFlags(flag.NewFlagSet(name, flag.ContinueOnError), args)
+}
+
+// LoadFlags 与 Load 相同，但使用传入的 FlagSet，子命令可以先注册自己的参数，解析后由 fs.Args() 取得其余参数
+func LoadFlags(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+
+	path := fs.String("config", os.Getenv("BILIGO_CONFIG"), "set the config file path")
+	overrides := registerFlags(fs, cfg)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" || fileExists(DefaultPath) {
+		if *path == "" {
+			*path = DefaultPath
+		}
+		if err := loadFile(cfg, *path); err != nil {
+			return nil, fmt.Errorf("读取设定文件 %v 时错误: %w", *path, err)
+		}
+	}
+
+	if err := loadEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	// 只套用有传入的运行参数
+	for _, o := range overrides {
+		if !o.set {
+			continue
+		}
+		if err := setValue(o.field, o.value); err != nil {
+			return nil, fmt.Errorf("运行参数 -%v 无效: %w", o.name, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(b, cfg)
+}
+
+func loadEnv(cfg *Config) error {
+	return walk(reflect.ValueOf(cfg).Elem(), func(field reflect.Value, tag reflect.StructTag) error {
+		key := tag.Get("env")
+		if key == "" {
+			return nil
+		}
+		value, ok := os.LookupEnv(key)
+		if !ok || value == "" {
+			return nil
+		}
+		if err := setValue(field, value); err != nil {
+			return fmt.Errorf("环境变量 %v 无效: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// flagOverride 记录运行参数的数值，待读取设定文件和环境变量后再套用
+type flagOverride struct {
+	name  string
+	field reflect.Value
+	value string
+	set   bool
+	bool  bool
+}
+
+func (o *flagOverride) String() string {
+	return o.value
+}
+
+func (o *flagOverride) Set(value string) error {
+	o.value = value
+	o.set = true
+	return nil
+}
+
+func (o *flagOverride) IsBoolFlag() bool {
+	return o.bool
+}
+
+func registerFlags(fs *flag.FlagSet, cfg *Config) []*flagOverride {
+	var overrides []*flagOverride
+	_ = walk(reflect.ValueOf(cfg).Elem(), func(field reflect.Value, tag reflect.StructTag) error {
+		name := tag.Get("flag")
+		if name == "" {
+			return nil
+		}
+		o := &flagOverride{
+			name:  name,
+			field: field,
+			value: formatValue(field),
+			bool:  field.Kind() == reflect.Bool,
+		}
+		fs.Var(o, name, tag.Get("usage"))
+		overrides = append(overrides, o)
+		return nil
+	})
+	return overrides
+}
+
+func walk(v reflect.Value, fn func(field reflect.Value, tag reflect.StructTag) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := walk(field, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(field, t.Field(i).Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("不支持的类型 %v", field.Type())
+	}
+	return nil
+}
+
+func formatValue(field reflect.Value) string {
+	if field.Type() == durationType {
+		return time.Duration(field.Int()).String()
+	}
+	if field.Kind() == reflect.Slice {
+		return strings.Join(field.Interface().([]string), ",")
+	}
+	return fmt.Sprint(field.Interface())
+}
+
+// parseBool 额外接受 GIN_MODE 的 release
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "release", "yes", "on":
+		return true, nil
+	case "debug", "test", "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
@@ -0,0 +1,126 @@
+package alerts
+
+import (
+	"github.com/eric2788/biligo-live-ws/services/alert"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// maskedSecret 返回规则时以此取代密钥
+const maskedSecret = "******"
+
+var log = logrus.WithField("controller", "alerts")
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("", GetRules)
+	gp.POST("", CreateRule)
+	gp.GET("/:id", GetRule)
+	gp.PUT("/:id", UpdateRule)
+	gp.DELETE("/:id", DeleteRule)
+}
+
+// GetRules 列出所有提醒规则
+func GetRules(c *gin.Context) {
+	list := alert.List()
+	for i, r := range list {
+		list[i] = masked(r)
+	}
+	c.IndentedJSON(200, list)
+}
+
+// GetRule 返回提醒规则
+func GetRule(c *gin.Context) {
+	r, err := alert.Get(c.Param("id"))
+	if err != nil {
+		ruleError(c, err)
+		return
+	}
+	c.IndentedJSON(200, masked(r))
+}
+
+// CreateRule 新增提醒规则，未传入 enabled 时预设启用
+func CreateRule(c *gin.Context) {
+	r := &alert.Rule{Enabled: true}
+	if err := c.ShouldBindJSON(r); err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	r.ID = ""
+
+	if err := alert.Put(r); err != nil {
+		ruleError(c, err)
+		return
+	}
+
+	log.Infof("已新增提醒规则 %v (%v)", r.ID, r.Name)
+	c.IndentedJSON(201, masked(r))
+}
+
+// UpdateRule 以传入的内容取代提醒规则，未传入 webhook.secret 时保留原本的密钥
+func UpdateRule(c *gin.Context) {
+	old, err := alert.Get(c.Param("id"))
+	if err != nil {
+		ruleError(c, err)
+		return
+	}
+
+	r := &alert.Rule{Enabled: true}
+	if err := c.ShouldBindJSON(r); err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	r.ID = old.ID
+	if r.Webhook.Secret == "" || r.Webhook.Secret == maskedSecret {
+		r.Webhook.Secret = old.Webhook.Secret
+	}
+
+	if err := alert.Put(r); err != nil {
+		ruleError(c, err)
+		return
+	}
+
+	log.Infof("已更新提醒规则 %v (%v)", r.ID, r.Name)
+	c.IndentedJSON(200, masked(r))
+}
+
+// DeleteRule 删除提醒规则
+func DeleteRule(c *gin.Context) {
+	if err := alert.Delete(c.Param("id")); err != nil {
+		ruleError(c, err)
+		return
+	}
+	log.Infof("已删除提醒规则 %v", c.Param("id"))
+	c.Status(204)
+}
+
+// masked 返回隐藏密钥后的规则
+func masked(r *alert.Rule) *alert.Rule {
+	copied := *r
+	if copied.Webhook.Secret != "" {
+		copied.Webhook.Secret = maskedSecret
+	}
+	return &copied
+}
+
+func ruleError(c *gin.Context, err error) {
+	if err == alert.ErrNotFound {
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, ok := err.(*alert.ValidationError); ok {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.Warnf("保存提醒规则时出现错误: %v", err)
+	c.IndentedJSON(500, gin.H{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,157 @@
+package history
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+var log = logrus.WithField("controller", "history")
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("/:room_id", GetHistory)
+}
+
+// GetHistory 查询房间的弹幕记录
+//
+// format=ndjson 或 Accept: application/x-ndjson 时逐行串流输出，不限制数量，
+// 下一页的游标在 X-Next-Cursor trailer 中返回
+func GetHistory(c *gin.Context) {
+
+	q, err := parseQuery(c)
+
+	if err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if wantsNDJSON(c) {
+		streamHistory(c, q)
+		return
+	}
+
+	if q.Limit <= 0 || q.Limit > maxLimit {
+		q.Limit = maxLimit
+	}
+
+	records := make([]*blive.Record, 0)
+	next, err := blive.QueryHistory(c.Request.Context(), q, func(r *blive.Record) error {
+		records = append(records, r)
+		return nil
+	})
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"data":        records,
+		"next_cursor": next,
+	})
+}
+
+func streamHistory(c *gin.Context, q *blive.HistoryQuery) {
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Trailer", "X-Next-Cursor")
+
+	encoder := json.NewEncoder(c.Writer)
+	written := false
+
+	next, err := blive.QueryHistory(c.Request.Context(), q, func(r *blive.Record) error {
+		written = true
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+
+	if err != nil {
+		if !written {
+			queryError(c, err)
+			return
+		}
+		// 已经开始输出，只能中断串流
+		log.Warnf("串流弹幕记录时出现错误: %v", err)
+		return
+	}
+
+	c.Status(200)
+	c.Writer.Header().Set("X-Next-Cursor", next)
+}
+
+func queryError(c *gin.Context, err error) {
+	if err == blive.ErrNoQuerier {
+		c.IndentedJSON(503, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.Warnf("查询弹幕记录时出现错误: %v", err)
+	c.IndentedJSON(400, gin.H{
+		"error": err.Error(),
+	})
+}
+
+func parseQuery(c *gin.Context) (*blive.HistoryQuery, error) {
+
+	id, err := strconv.ParseInt(c.Param("room_id"), 10, 64)
+
+	if err != nil {
+		return nil, err
+	}
+
+	q := &blive.HistoryQuery{
+		RoomId:  id,
+		Types:   splitList(c.Query("type")),
+		Cmds:    splitList(c.Query("cmd")),
+		Keyword: c.Query("keyword"),
+		Cursor:  c.Query("cursor"),
+		Limit:   defaultLimit,
+	}
+
+	for key, dst := range map[string]*int64{"from": &q.From, "to": &q.To, "uid": &q.UID} {
+		if v := c.Query(key); v != "" {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	} else if wantsNDJSON(c) {
+		q.Limit = 0
+	}
+
+	return q, nil
+}
+
+func wantsNDJSON(c *gin.Context) bool {
+	return c.Query("format") == "ndjson" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,120 @@
+package leaderboards
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLimit = 10
+	maxLimit     = 100
+)
+
+var log = logrus.WithField("controller", "leaderboards")
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("/rooms/:room_id", GetRoomLeaderboard)
+	gp.GET("/sessions/:id", GetSessionLeaderboard)
+}
+
+// GetRoomLeaderboard 返回房间今天、最近七天、三十天或全部的排行榜
+func GetRoomLeaderboard(c *gin.Context) {
+
+	room, err := strconv.ParseInt(c.Param("room_id"), 10, 64)
+
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	limit, err := parseLimit(c)
+
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	by := c.DefaultQuery("by", blive.BySpend)
+	window := c.DefaultQuery("window", blive.WindowWeek)
+
+	board, err := blive.RoomLeaderboard(c.Request.Context(), room, by, window, limit)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	c.IndentedJSON(200, board)
+}
+
+// GetSessionLeaderboard 返回直播场次期间的排行榜
+func GetSessionLeaderboard(c *gin.Context) {
+
+	id := c.Param("id")
+
+	if _, _, err := blive.ParseSessionID(id); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	limit, err := parseLimit(c)
+
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	board, err := blive.SessionLeaderboard(c.Request.Context(), id, c.DefaultQuery("by", blive.BySpend), limit)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	c.IndentedJSON(200, board)
+}
+
+func parseLimit(c *gin.Context) (int, error) {
+	limit := defaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, err
+		}
+		limit = n
+	}
+	if limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, nil
+}
+
+func badRequest(c *gin.Context, err error) {
+	c.IndentedJSON(400, gin.H{
+		"error": err.Error(),
+	})
+}
+
+func queryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, blive.ErrInvalidLeaderboard):
+		badRequest(c, err)
+	case err == blive.ErrNoQuerier:
+		c.IndentedJSON(503, gin.H{
+			"error": err.Error(),
+		})
+	case err == blive.ErrSessionNotFound:
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		log.Warnf("查询排行榜时出现错误: %v", err)
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+	}
+}
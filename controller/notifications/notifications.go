@@ -0,0 +1,126 @@
+package notifications
+
+import (
+	"github.com/eric2788/biligo-live-ws/services/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// maskedSecret 返回通知时以此取代密钥
+const maskedSecret = "******"
+
+var log = logrus.WithField("controller", "notifications")
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("", GetHooks)
+	gp.POST("", CreateHook)
+	gp.GET("/:id", GetHook)
+	gp.PUT("/:id", UpdateHook)
+	gp.DELETE("/:id", DeleteHook)
+}
+
+// GetHooks 列出所有开播通知
+func GetHooks(c *gin.Context) {
+	list := notify.List()
+	for i, h := range list {
+		list[i] = masked(h)
+	}
+	c.IndentedJSON(200, list)
+}
+
+// GetHook 返回开播通知
+func GetHook(c *gin.Context) {
+	h, err := notify.Get(c.Param("id"))
+	if err != nil {
+		hookError(c, err)
+		return
+	}
+	c.IndentedJSON(200, masked(h))
+}
+
+// CreateHook 新增开播通知，未传入 enabled 时预设启用，未传入 format 时为 generic
+func CreateHook(c *gin.Context) {
+	h := &notify.Hook{Enabled: true}
+	if err := c.ShouldBindJSON(h); err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	h.ID = ""
+
+	if err := notify.Put(h); err != nil {
+		hookError(c, err)
+		return
+	}
+
+	log.Infof("已新增开播通知 %v (%v)", h.ID, h.Name)
+	c.IndentedJSON(201, masked(h))
+}
+
+// UpdateHook 以传入的内容取代开播通知，未传入 webhook.secret 时保留原本的密钥
+func UpdateHook(c *gin.Context) {
+	old, err := notify.Get(c.Param("id"))
+	if err != nil {
+		hookError(c, err)
+		return
+	}
+
+	h := &notify.Hook{Enabled: true}
+	if err := c.ShouldBindJSON(h); err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	h.ID = old.ID
+	if h.Webhook.Secret == "" || h.Webhook.Secret == maskedSecret {
+		h.Webhook.Secret = old.Webhook.Secret
+	}
+
+	if err := notify.Put(h); err != nil {
+		hookError(c, err)
+		return
+	}
+
+	log.Infof("已更新开播通知 %v (%v)", h.ID, h.Name)
+	c.IndentedJSON(200, masked(h))
+}
+
+// DeleteHook 删除开播通知
+func DeleteHook(c *gin.Context) {
+	if err := notify.Delete(c.Param("id")); err != nil {
+		hookError(c, err)
+		return
+	}
+	log.Infof("已删除开播通知 %v", c.Param("id"))
+	c.Status(204)
+}
+
+// masked 返回隐藏密钥后的通知
+func masked(h *notify.Hook) *notify.Hook {
+	copied := *h
+	if copied.Webhook.Secret != "" {
+		copied.Webhook.Secret = maskedSecret
+	}
+	return &copied
+}
+
+func hookError(c *gin.Context, err error) {
+	if err == notify.ErrNotFound {
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, ok := err.(*notify.ValidationError); ok {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.Warnf("保存开播通知时出现错误: %v", err)
+	c.IndentedJSON(500, gin.H{
+		"error": err.Error(),
+	})
+}
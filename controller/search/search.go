@@ -0,0 +1,96 @@
+package search
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+	maxContext   = 20
+)
+
+var log = logrus.WithField("controller", "search")
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("", Search)
+}
+
+// Search 搜索已保存的弹幕，房间号可选
+func Search(c *gin.Context) {
+
+	q := &blive.SearchQuery{
+		Query:    strings.TrimSpace(c.Query("q")),
+		Username: c.Query("username"),
+		Limit:    defaultLimit,
+	}
+
+	if q.Query == "" {
+		c.IndentedJSON(400, gin.H{
+			"error": "缺少搜索关键字 q",
+		})
+		return
+	}
+
+	for key, dst := range map[string]*int64{"room_id": &q.RoomId, "from": &q.From, "to": &q.To, "uid": &q.UID} {
+		if v := c.Query(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.IndentedJSON(400, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			*dst = n
+		}
+	}
+
+	for key, dst := range map[string]*int{"limit": &q.Limit, "context": &q.Context} {
+		if v := c.Query(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				c.IndentedJSON(400, gin.H{
+					"error": key + " 无效: " + v,
+				})
+				return
+			}
+			*dst = n
+		}
+	}
+
+	if q.Limit <= 0 || q.Limit > maxLimit {
+		q.Limit = maxLimit
+	}
+
+	if q.Context > maxContext {
+		q.Context = maxContext
+	}
+
+	hits, err := blive.Search(c.Request.Context(), q)
+
+	if err != nil {
+		if errors.Is(err, blive.ErrNoSearcher) {
+			c.IndentedJSON(503, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Warnf("搜索弹幕时出现错误: %v", err)
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if hits == nil {
+		hits = make([]*blive.SearchHit, 0)
+	}
+
+	c.IndentedJSON(200, hits)
+}
@@ -0,0 +1,202 @@
+package sessions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/eric2788/biligo-live-ws/services/export"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+	defaultTop   = 10
+	maxTop       = 100
+)
+
+var (
+	log = logrus.WithField("controller", "sessions")
+	// cst 日期参数以北京时间解析
+	cst = time.FixedZone("CST", 8*60*60)
+)
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("", GetSessions)
+	gp.GET("/:id", GetSession)
+	gp.GET("/:id/export", ExportSession)
+}
+
+// GetSessions 列出直播场次，可按房间号及开播日期筛选
+func GetSessions(c *gin.Context) {
+
+	q := &blive.SessionQuery{Limit: defaultLimit}
+
+	var err error
+
+	if v := c.Query("room_id"); v != "" {
+		if q.RoomId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			badRequest(c, err)
+			return
+		}
+	}
+
+	if q.From, err = parseTime(c.Query("from"), false); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	if q.To, err = parseTime(c.Query("to"), true); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			badRequest(c, err)
+			return
+		}
+	}
+
+	if q.Limit <= 0 || q.Limit > maxLimit {
+		q.Limit = maxLimit
+	}
+
+	if v := c.Query("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			badRequest(c, fmt.Errorf("offset 无效: %q", v))
+			return
+		}
+	}
+
+	summaries, err := blive.QuerySessions(c.Request.Context(), q)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	c.IndentedJSON(200, summaries)
+}
+
+// GetSession 返回直播场次的摘要及弹幕、送礼排行
+func GetSession(c *gin.Context) {
+
+	id := c.Param("id")
+
+	if _, _, err := blive.ParseSessionID(id); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	top := defaultTop
+
+	if v := c.Query("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		top = n
+	}
+
+	if top <= 0 || top > maxTop {
+		top = maxTop
+	}
+
+	summary, err := blive.QuerySession(c.Request.Context(), id, top)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	c.IndentedJSON(200, summary)
+}
+
+// ExportSession 以 format 指定的格式下载直播场次的弹幕记录
+func ExportSession(c *gin.Context) {
+
+	id := c.Param("id")
+
+	if _, _, err := blive.ParseSessionID(id); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	format, err := export.Lookup(c.DefaultQuery("format", "csv"))
+
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	live, err := blive.QuerySession(c.Request.Context(), id, 0)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	var types []string
+	for _, t := range strings.Split(c.Query("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+
+	c.Header("Content-Type", format.ContentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, format.Filename(live.Session)))
+	c.Status(200)
+
+	if err := export.Session(c.Request.Context(), c.Writer, format, live.Session, types); err != nil {
+		// 已经开始输出，只能中断下载
+		log.Warnf("导出直播场次 %v 时出现错误: %v", id, err)
+	}
+}
+
+// parseTime 解析秒级时间戳或 2006-01-02 格式的日期，end 为 true 时日期取当天结束
+func parseTime(v string, end bool) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, cst)
+	if err != nil {
+		return 0, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t.Unix(), nil
+}
+
+func badRequest(c *gin.Context, err error) {
+	c.IndentedJSON(400, gin.H{
+		"error": err.Error(),
+	})
+}
+
+func queryError(c *gin.Context, err error) {
+	switch err {
+	case blive.ErrNoQuerier:
+		c.IndentedJSON(503, gin.H{
+			"error": err.Error(),
+		})
+	case blive.ErrSessionNotFound:
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		log.Warnf("查询直播场次时出现错误: %v", err)
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+	}
+}
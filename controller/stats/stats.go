@@ -0,0 +1,48 @@
+package stats
+
+import (
+	"strconv"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/eric2788/biligo-live-ws/services/stats"
+	"github.com/gin-gonic/gin"
+)
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("/:room_id", GetStats)
+}
+
+// GetStats 返回房间最近一分钟的弹幕、用户、收入及人气统计
+func GetStats(c *gin.Context) {
+
+	id, err := strconv.ParseInt(c.Param("room_id"), 10, 64)
+
+	if err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	s, ok := stats.Get(id)
+
+	// 短号则以真正的房间号查找
+	if !ok {
+		blive.ShortRoomMap.Range(func(real, short interface{}) bool {
+			if short.(int64) == id {
+				s, ok = stats.Get(real.(int64))
+				return false
+			}
+			return true
+		})
+	}
+
+	if !ok {
+		c.IndentedJSON(404, gin.H{
+			"error": "房间不在监听中或尚未收到讯息",
+		})
+		return
+	}
+
+	c.IndentedJSON(200, s)
+}
@@ -0,0 +1,51 @@
+package viewers
+
+import (
+	"strconv"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("controller", "viewers")
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("/:uid", GetViewer)
+}
+
+// GetViewer 返回用户在各房间的弹幕数量、消费、出现时间及名称记录
+func GetViewer(c *gin.Context) {
+
+	uid, err := strconv.ParseInt(c.Param("uid"), 10, 64)
+
+	if err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	profile, err := blive.QueryViewer(c.Request.Context(), uid)
+
+	if err != nil {
+		switch err {
+		case blive.ErrNoQuerier:
+			c.IndentedJSON(503, gin.H{
+				"error": err.Error(),
+			})
+		case blive.ErrViewerNotFound:
+			c.IndentedJSON(404, gin.H{
+				"error": err.Error(),
+			})
+		default:
+			log.Warnf("查询用户 %v 时出现错误: %v", uid, err)
+			c.IndentedJSON(500, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	c.IndentedJSON(200, profile)
+}
@@ -0,0 +1,15 @@
+package webhooks
+
+import (
+	"github.com/eric2788/biligo-live-ws/services/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+func Register(gp *gin.RouterGroup) {
+	gp.GET("/deliveries", GetDeliveries)
+}
+
+// GetDeliveries 返回最近的推送记录，由新到旧
+func GetDeliveries(c *gin.Context) {
+	c.IndentedJSON(200, webhook.Deliveries())
+}
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/services/api"
+	"github.com/eric2788/biligo-live-ws/services/subscriber"
+)
+
+// ResponseCommand 回应客户端控制指令的讯息
+const ResponseCommand = "RESPONSE"
+
+// 客户端可发送的控制指令
+const (
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+	ActionSet         = "set"
+	ActionList        = "list"
+	ActionFilter      = "filter"
+	ActionPing        = "ping"
+)
+
+// controlReadLimit 客户端讯息的最大字节数
+const controlReadLimit = 64 << 10
+
+// Request 客户端经 WebSocket 发送的控制指令
+type Request struct {
+	// ID 由客户端指定，原样附在回应中
+	ID     string  `json:"id"`
+	Action string  `json:"action"`
+	Rooms  []int64 `json:"rooms,omitempty"`
+	// Validate 为 false 时不检查房间是否存在 (与 ?validate=false 相同)
+	Validate *bool   `json:"validate,omitempty"`
+	Filter   *Filter `json:"filter,omitempty"`
+}
+
+// Response 控制指令的回应，作为 RESPONSE 指令的 content 发送
+type Response struct {
+	ID      string      `json:"id"`
+	Action  string      `json:"action"`
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// handleControl 处理客户端发送的控制指令并回应，exec 按连接类型执行指令
+func handleControl(identifier string, socket *WebSocket, message []byte, exec func(string, *WebSocket, *Request) (interface{}, error)) {
+
+	req := &Request{}
+	res := &Response{}
+
+	if err := json.Unmarshal(message, req); err != nil {
+		res.Error = fmt.Sprintf("无法解析指令: %v", err)
+	} else {
+		res.ID, res.Action = req.ID, req.Action
+		res.Data, err = exec(identifier, socket, req)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Success = true
+		}
+	}
+
+	data, err := json.Marshal(BLiveData{Command: ResponseCommand, Content: res})
+
+	if err != nil {
+		log.Warnf("序列化用户 %v 的指令回应时出现错误: %v", identifier, err)
+		return
+	}
+
+	// 与直播数据经同一队列按顺序发送
+	socket.reply(data)
+}
+
+func execute(identifier string, socket *WebSocket, req *Request) (interface{}, error) {
+	switch req.Action {
+	case ActionSubscribe, ActionSet:
+		rooms, err := validateRooms(req)
+		if err != nil {
+			return nil, err
+		}
+		if req.Action == ActionSet {
+			log.Infof("用户 %v 设置订阅 %v \n", identifier, rooms)
+			subscriber.Update(identifier, rooms)
+			return rooms, nil
+		}
+		log.Infof("用户 %v 新增订阅 %v \n", identifier, rooms)
+		return subscriber.Add(identifier, rooms), nil
+
+	case ActionUnsubscribe:
+		if len(req.Rooms) == 0 {
+			return nil, fmt.Errorf("订阅列表不能为空")
+		}
+		log.Infof("用户 %v 移除订阅 %v \n", identifier, req.Rooms)
+		rooms, ok := subscriber.Remove(identifier, req.Rooms)
+		if !ok {
+			return nil, fmt.Errorf("删除失败，你尚未提交过任何订阅")
+		}
+		return rooms, nil
+
+	case ActionList:
+		rooms, _ := subscriber.GetOrEmpty(identifier)
+		return rooms, nil
+
+	case ActionFilter:
+		if req.Filter == nil {
+			return socket.getFilter().export(), nil
+		}
+		// 只套用于此连接
+		filter := req.Filter.compile()
+		socket.setFilter(filter)
+		log.Infof("用户 %v 已更新连接的指令过滤: %+v", identifier, req.Filter)
+		return filter.export(), nil
+
+	case ActionPing:
+		return map[string]int64{"time": time.Now().UnixMilli()}, nil
+
+	default:
+		return nil, fmt.Errorf("未知的指令: %q", req.Action)
+	}
+}
+
+// executeGlobal 全局连接不保留订阅，只可更改此连接的指令过滤
+func executeGlobal(identifier string, socket *WebSocket, req *Request) (interface{}, error) {
+	switch req.Action {
+	case ActionFilter, ActionPing:
+		return execute(identifier, socket, req)
+	default:
+		return nil, fmt.Errorf("全局连接不支持此指令: %q", req.Action)
+	}
+}
+
+// validateRooms 与 POST /subscribe 相同，检查房间是否存在并转换为真正的房间号，无效的房间会被忽略
+func validateRooms(req *Request) ([]int64, error) {
+	if len(req.Rooms) == 0 {
+		return nil, fmt.Errorf("订阅列表不能为空")
+	}
+
+	if req.Validate != nil && !*req.Validate {
+		return subscriber.ToSet(req.Rooms).ToSlice(), nil
+	}
+
+	rooms := make([]int64, 0, len(req.Rooms))
+	for _, room := range req.Rooms {
+		realRoom, err := api.GetRealRoom(room)
+		if err != nil {
+			log.Warnf("获取房间讯息时出现错误: %v", err)
+			return nil, err
+		}
+		if realRoom > 0 {
+			rooms = append(rooms, realRoom)
+		} else {
+			log.Warnf("房间 %v 无效，已过滤 \n", room)
+		}
+	}
+	return subscriber.ToSet(rooms).ToSlice(), nil
+}
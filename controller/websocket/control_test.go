@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/eric2788/biligo-live-ws/services/subscriber"
+	"github.com/go-playground/assert/v2"
+	"github.com/gorilla/websocket"
+)
+
+// testResponse 以原始 JSON 保留 data 的 Response
+type testResponse struct {
+	ID      string          `json:"id"`
+	Action  string          `json:"action"`
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+// control 发送控制指令并读取回应
+func control(t *testing.T, conn *websocket.Conn, request string) testResponse {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Command string       `json:"command"`
+		Content testResponse `json:"content"`
+	}
+	if err := json.Unmarshal(message, &data); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data.Command, ResponseCommand)
+	return data.Content
+}
+
+func responseRooms(t *testing.T, res testResponse) []int64 {
+	var list []int64
+	if err := json.Unmarshal(res.Data, &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+// openControl 连接 /ws，返回连接及用户的辨识 ID
+func openControl(t *testing.T, name string) (*websocket.Conn, string) {
+	server := newTestServer(t, config.WebSocket{})
+	id := testID(name)
+	identifier := "127.0.0.1@" + id
+	t.Cleanup(func() { subscriber.Delete(identifier) })
+	return dialWS(t, server, "/ws?id="+id), identifier
+}
+
+func TestControl(t *testing.T) {
+	conn, identifier := openControl(t, "control")
+	room, other := testRoom(), testRoom()
+
+	res := control(t, conn, fmt.Sprintf(`{"id": "1", "action": "subscribe", "rooms": [%v, %v], "validate": false}`, room, room))
+	assert.Equal(t, res.ID, "1")
+	assert.Equal(t, res.Action, ActionSubscribe)
+	assert.Equal(t, res.Success, true)
+	assert.Equal(t, responseRooms(t, res), []int64{room})
+
+	// 回应时订阅已生效
+	publish(room, "DANMU_MSG", "a")
+	data := readData(t, conn)
+	assert.Equal(t, data.Content, "a")
+
+	res = control(t, conn, `{"id": "2", "action": "list"}`)
+	assert.Equal(t, responseRooms(t, res), []int64{room})
+
+	res = control(t, conn, fmt.Sprintf(`{"id": "3", "action": "set", "rooms": [%v], "validate": false}`, other))
+	assert.Equal(t, responseRooms(t, res), []int64{other})
+	subscribed, _ := subscriber.Get(identifier)
+	assert.Equal(t, subscribed, []int64{other})
+
+	res = control(t, conn, fmt.Sprintf(`{"id": "4", "action": "unsubscribe", "rooms": [%v]}`, other))
+	assert.Equal(t, res.Success, true)
+	assert.Equal(t, responseRooms(t, res), []int64{})
+
+	res = control(t, conn, `{"id": "5", "action": "ping"}`)
+	assert.Equal(t, res.Success, true)
+	var pong map[string]int64
+	_ = json.Unmarshal(res.Data, &pong)
+	assert.Equal(t, pong["time"] > 0, true)
+}
+
+func TestControlErrors(t *testing.T) {
+	conn, _ := openControl(t, "errors")
+
+	res := control(t, conn, `{"id": "1", "action": "reboot"}`)
+	assert.Equal(t, res.ID, "1")
+	assert.Equal(t, res.Success, false)
+	assert.Equal(t, res.Error, `未知的指令: "reboot"`)
+
+	res = control(t, conn, `{"id": "2", "action": "subscribe", "rooms": []}`)
+	assert.Equal(t, res.Success, false)
+	assert.Equal(t, res.Error, "订阅列表不能为空")
+
+	res = control(t, conn, `not json`)
+	assert.Equal(t, res.ID, "")
+	assert.Equal(t, res.Success, false)
+
+	// 超过长度限制时关闭连接
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, controlReadLimit+1)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.Equal(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), true)
+}
+
+func TestControlFilter(t *testing.T) {
+	conn, identifier := openControl(t, "control-filter")
+	room := testRoom()
+	res := control(t, conn, fmt.Sprintf(`{"id": "0", "action": "subscribe", "rooms": [%v], "validate": false}`, room))
+	assert.Equal(t, res.Success, true)
+
+	res = control(t, conn, `{"id": "1", "action": "filter", "filter": {"include": ["danmu_msg"]}}`)
+	assert.Equal(t, res.Success, true)
+	filter := &Filter{}
+	_ = json.Unmarshal(res.Data, filter)
+	assert.Equal(t, filter, &Filter{Include: []string{"DANMU_MSG"}, Exclude: []string{}})
+
+	res = control(t, conn, `{"id": "2", "action": "filter"}`)
+	_ = json.Unmarshal(res.Data, filter)
+	assert.Equal(t, filter, &Filter{Include: []string{"DANMU_MSG"}, Exclude: []string{}})
+	// 只作用于当前连接，不改变用户的预设过滤
+	assert.Equal(t, getDefaultFilter(identifier) == nil, true)
+
+	publish(room, "SEND_GIFT", "gift")
+	publish(room, "DANMU_MSG", "danmaku")
+	assert.Equal(t, readData(t, conn).Command, "DANMU_MSG")
+}
+
+func TestGlobalControlFilter(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	command := fmt.Sprintf("TEST_%v", testRoom())
+	conn := dialWS(t, server, "/ws/global")
+
+	res := control(t, conn, fmt.Sprintf(`{"id": "0", "action": "filter", "filter": {"include": [%q]}}`, command))
+	assert.Equal(t, res.Success, true)
+	filter := &Filter{}
+	_ = json.Unmarshal(res.Data, filter)
+	assert.Equal(t, filter, &Filter{Include: []string{command}, Exclude: []string{}})
+
+	// 全局连接不保留订阅
+	res = control(t, conn, `{"id": "1", "action": "subscribe", "rooms": [545]}`)
+	assert.Equal(t, res.Success, false)
+
+	publish(testRoom(), "DANMU_MSG", "danmaku")
+	publish(testRoom(), command, "test")
+	assert.Equal(t, readData(t, conn).Content, "test")
+}
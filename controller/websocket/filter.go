@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eric2788/biligo-live-ws/services/subscriber"
+	"github.com/gin-gonic/gin"
+)
+
+// filterTable 用户预设的指令过滤，没有传入 include, exclude 的新连接会套用，与订阅一同过期。
+// 每个连接各自的指令过滤保存在连接上。
+var filterTable = sync.Map{}
+
+// Filter 指令过滤，Include 不为空时只推送其中的指令，再排除 Exclude 中的指令
+type Filter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// compiledFilter 以 map 查找的指令过滤
+type compiledFilter struct {
+	include map[string]struct{}
+	exclude map[string]struct{}
+}
+
+func init() {
+	subscriber.OnExpire(func(identifier string) {
+		filterTable.Delete(identifier)
+	})
+}
+
+func toCommandSet(commands []string) map[string]struct{} {
+	var set map[string]struct{}
+	for _, command := range commands {
+		for _, cmd := range strings.Split(command, ",") {
+			if cmd = strings.ToUpper(strings.TrimSpace(cmd)); cmd == "" {
+				continue
+			}
+			if set == nil {
+				set = make(map[string]struct{})
+			}
+			set[cmd] = struct{}{}
+		}
+	}
+	return set
+}
+
+func toCommandList(set map[string]struct{}) []string {
+	list := make([]string, 0, len(set))
+	for cmd := range set {
+		list = append(list, cmd)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// compile 返回以 map 查找的指令过滤，没有任何指令时为 nil (不过滤)
+func (f *Filter) compile() *compiledFilter {
+	compiled := &compiledFilter{include: toCommandSet(f.Include), exclude: toCommandSet(f.Exclude)}
+	if compiled.include == nil && compiled.exclude == nil {
+		return nil
+	}
+	return compiled
+}
+
+// export 返回可序列化的指令过滤，nil 为不过滤
+func (f *compiledFilter) export() *Filter {
+	if f == nil {
+		return &Filter{Include: []string{}, Exclude: []string{}}
+	}
+	return &Filter{Include: toCommandList(f.include), Exclude: toCommandList(f.exclude)}
+}
+
+func (f *compiledFilter) allow(command string) bool {
+	if f == nil {
+		return true
+	}
+	if f.include != nil {
+		if _, ok := f.include[command]; !ok {
+			return false
+		}
+	}
+	_, excluded := f.exclude[command]
+	return !excluded
+}
+
+// setDefaultFilter 更新用户预设的指令过滤，没有任何指令时清除
+func setDefaultFilter(identifier string, filter *Filter) *compiledFilter {
+	compiled := filter.compile()
+	if compiled == nil {
+		filterTable.Delete(identifier)
+		return nil
+	}
+	filterTable.Store(identifier, compiled)
+	return compiled
+}
+
+func getDefaultFilter(identifier string) *compiledFilter {
+	if f, ok := filterTable.Load(identifier); ok {
+		return f.(*compiledFilter)
+	}
+	return nil
+}
+
+// filterFromQuery 从连接的 query 参数 include, exclude 读取指令过滤 (以逗号分隔或重复传入)，
+// 都没有传入时返回用户预设的指令过滤
+func filterFromQuery(c *gin.Context, identifier string) *compiledFilter {
+	include, hasInclude := c.GetQueryArray("include")
+	exclude, hasExclude := c.GetQueryArray("exclude")
+	if hasInclude || hasExclude {
+		return (&Filter{Include: include, Exclude: exclude}).compile()
+	}
+	return getDefaultFilter(identifier)
+}
+
+// setFilter 更新此连接的指令过滤
+func (s *WebSocket) setFilter(filter *compiledFilter) {
+	s.filter.Store(filter)
+}
+
+func (s *WebSocket) getFilter() *compiledFilter {
+	filter, _ := s.filter.Load().(*compiledFilter)
+	return filter
+}
+
+// allow 检查此连接是否需要此指令
+func (s *WebSocket) allow(command string) bool {
+	return s.getFilter().allow(command)
+}
+
+// GetFilter 返回用户预设的指令过滤
+func GetFilter(c *gin.Context) {
+	c.IndentedJSON(200, getDefaultFilter(subscriber.ToClientId(c)).export())
+}
+
+// PutFilter 更新用户预设的指令过滤，用户连接中的 WebSocket 及 SSE 会立即套用
+func PutFilter(c *gin.Context) {
+	filter := &Filter{}
+	if err := c.ShouldBindJSON(filter); err != nil {
+		c.IndentedJSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	identifier := subscriber.ToClientId(c)
+	compiled := setDefaultFilter(identifier, filter)
+
+	for _, socket := range getConnections(identifier) {
+		socket.setFilter(compiled)
+	}
+	setSSEFilter(identifier, compiled)
+
+	log.Infof("用户 %v 已更新指令过滤: %+v", identifier, filter)
+
+	c.IndentedJSON(200, compiled.export())
+}
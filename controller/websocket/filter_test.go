@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestCompileFilter(t *testing.T) {
+	assert.Equal(t, (&Filter{}).compile() == nil, true)
+	assert.Equal(t, (&Filter{Include: []string{" ", ""}}).compile() == nil, true)
+
+	// 以逗号分隔或重复传入，不区分大小写
+	f := (&Filter{Include: []string{"danmu_msg, SEND_GIFT", "SUPER_CHAT_MESSAGE"}, Exclude: []string{"send_gift"}}).compile()
+	assert.Equal(t, f.allow("DANMU_MSG"), true)
+	assert.Equal(t, f.allow("SUPER_CHAT_MESSAGE"), true)
+	assert.Equal(t, f.allow("SEND_GIFT"), false)
+	assert.Equal(t, f.allow("INTERACT_WORD"), false)
+	assert.Equal(t, f.export(), &Filter{Include: []string{"DANMU_MSG", "SEND_GIFT", "SUPER_CHAT_MESSAGE"}, Exclude: []string{"SEND_GIFT"}})
+
+	f = (&Filter{Exclude: []string{"INTERACT_WORD"}}).compile()
+	assert.Equal(t, f.allow("DANMU_MSG"), true)
+	assert.Equal(t, f.allow("INTERACT_WORD"), false)
+
+	var none *compiledFilter
+	assert.Equal(t, none.allow("DANMU_MSG"), true)
+	assert.Equal(t, none.export(), &Filter{Include: []string{}, Exclude: []string{}})
+}
+
+// requestFilter 以 Authorization 辨识用户，发送 GET 或 PUT /ws/filter，返回状态码及指令过滤
+func requestFilter(t *testing.T, server *httptest.Server, method, id, body string) (int, *Filter) {
+	req, _ := http.NewRequest(method, server.URL+"/ws/filter", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", id)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	filter := &Filter{}
+	_ = json.NewDecoder(res.Body).Decode(filter)
+	return res.StatusCode, filter
+}
+
+func TestFilterQuery(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room := testRoom()
+	id := testID("filter")
+	identifier := "127.0.0.1@" + id
+	subscribe(t, identifier, room)
+
+	conn := dialWS(t, server, "/ws?id="+id+"&include=danmu_msg,super_chat_message&exclude=SUPER_CHAT_MESSAGE")
+	waitConnections(t, identifier, 1)
+
+	publish(room, "SEND_GIFT", "gift")
+	publish(room, "SUPER_CHAT_MESSAGE", "sc")
+	publish(room, "DANMU_MSG", "danmaku")
+
+	data := readData(t, conn)
+	assert.Equal(t, data.Command, "DANMU_MSG")
+	assert.Equal(t, data.Content, "danmaku")
+	expectNoData(t, conn)
+}
+
+func TestGlobalFilterQuery(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	command := fmt.Sprintf("TEST_%v", testRoom())
+
+	conn := dialWS(t, server, "/ws/global?include="+command)
+	waitGlobals(t, 1)
+
+	publish(testRoom(), "DANMU_MSG", "danmaku")
+	publish(testRoom(), command, "test")
+	assert.Equal(t, readData(t, conn).Content, "test")
+}
+
+func TestPutFilter(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room := testRoom()
+	id := testID("put")
+	identifier := "127.0.0.1@" + id
+	subscribe(t, identifier, room)
+
+	conn := dialWS(t, server, "/ws?id="+id)
+	waitConnections(t, identifier, 1)
+
+	code, filter := requestFilter(t, server, http.MethodPut, id, `{"exclude": ["send_gift"]}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, filter, &Filter{Include: []string{}, Exclude: []string{"SEND_GIFT"}})
+
+	code, filter = requestFilter(t, server, http.MethodGet, id, "")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, filter, &Filter{Include: []string{}, Exclude: []string{"SEND_GIFT"}})
+
+	// 连接中的 WebSocket 立即套用，之后的连接同样套用
+	later := dialWS(t, server, "/ws?id="+id)
+	waitConnections(t, identifier, 2)
+
+	publish(room, "SEND_GIFT", "gift")
+	publish(room, "DANMU_MSG", "danmaku")
+	assert.Equal(t, readData(t, conn).Command, "DANMU_MSG")
+	assert.Equal(t, readData(t, later).Command, "DANMU_MSG")
+
+	code, _ = requestFilter(t, server, http.MethodPut, id, `{"include": 1}`)
+	assert.Equal(t, code, 400)
+}
+
+func TestFilterSkipsBuild(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room := testRoom()
+	id := testID("skip")
+	identifier := "127.0.0.1@" + id
+	subscribe(t, identifier, room)
+
+	dialWS(t, server, fmt.Sprintf("/ws?id=%v&exclude=%v", id, StatsCommand))
+	waitConnections(t, identifier, 1)
+
+	// 没有连接需要房间统计时不会生成内容
+	built := false
+	broadcast(room, StatsCommand, func() BLiveData {
+		built = true
+		return BLiveData{Command: StatsCommand}
+	})
+	assert.Equal(t, built, false)
+}
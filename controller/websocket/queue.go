@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeWait 单则讯息的发送超时，超时视为连接已失效
+const writeWait = 10 * time.Second
+
+// PolicyDisconnect 发送队列已满时断开连接，否则丢弃最旧的讯息
+const PolicyDisconnect = "disconnect"
+
+// queueMetrics 连接发送队列的统计，可从 /debug/vars 查看
+var queueMetrics = expvar.NewMap("websocket_queue")
+
+var (
+	queueEnqueued     = new(expvar.Int)
+	queueDropped      = new(expvar.Int)
+	queueDisconnected = new(expvar.Int)
+)
+
+func init() {
+	queueMetrics.Set("enqueued", queueEnqueued)
+	queueMetrics.Set("dropped", queueDropped)
+	queueMetrics.Set("slow_consumer_disconnected", queueDisconnected)
+	queueMetrics.Set("connections", expvar.Func(func() interface{} {
+		n, _, _ := queueDepth()
+		return n
+	}))
+	queueMetrics.Set("queue_length", expvar.Func(func() interface{} {
+		_, total, _ := queueDepth()
+		return total
+	}))
+	queueMetrics.Set("max_queue_length", expvar.Func(func() interface{} {
+		_, _, longest := queueDepth()
+		return longest
+	}))
+}
+
+// outgoing 等待发送的讯息，room 和 seq 用于略过已补发的讯息，seq 为 0 时不检查
+type outgoing struct {
+	room int64
+	seq  uint64
+	data []byte
+	// replay 为重连补发的讯息，发送后记录到 replayed
+	replay bool
+}
+
+// newWebSocket 建立连接并启动发送讯息的 goroutine，连接失效时调用 onClose
+func newWebSocket(identifier string, ws *websocket.Conn, onClose func()) *WebSocket {
+	size := settings.SendQueueSize
+	if size <= 0 {
+		size = 256
+	}
+	socket := &WebSocket{
+		ws:       ws,
+		replayed: make(map[int64]uint64),
+		queue:    make(chan outgoing, size),
+		done:     make(chan struct{}),
+	}
+	go socket.writeLoop(identifier, onClose)
+	return socket
+}
+
+// writeLoop 按入队顺序逐条发送，直到连接关闭
+func (s *WebSocket) writeLoop(identifier string, onClose func()) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.queue:
+			if err := s.write(msg); err != nil {
+				// 已由其他地方关闭
+				select {
+				case <-s.done:
+					return
+				default:
+				}
+				log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
+				log.Warnf("关闭对用户 %v 的连线。", identifier)
+				s.close()
+				// 客户端非正常關閉连接
+				onClose()
+				return
+			}
+		}
+	}
+}
+
+func (s *WebSocket) write(msg outgoing) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 已在重连补发时发送过
+	if !msg.replay && msg.seq > 0 && msg.seq <= s.replayed[msg.room] {
+		return nil
+	}
+
+	if err := s.ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	if err := s.ws.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+		return err
+	}
+	if msg.replay {
+		s.replayed[msg.room] = msg.seq
+	}
+	return nil
+}
+
+// enqueue 将讯息放入发送队列，不会阻塞。队列已满时按设定丢弃最旧的讯息，
+// 或返回 false 表示应断开连接
+func (s *WebSocket) enqueue(msg outgoing) bool {
+	for {
+		select {
+		case <-s.done:
+			return true
+		case s.queue <- msg:
+			queueEnqueued.Add(1)
+			return true
+		default:
+		}
+
+		if strings.EqualFold(settings.SlowConsumerPolicy, PolicyDisconnect) {
+			queueDisconnected.Add(1)
+			return false
+		}
+
+		// 丢弃最旧的讯息后重试
+		select {
+		case <-s.queue:
+			queueDropped.Add(1)
+		default:
+		}
+	}
+}
+
+// reply 将控制指令的回应放入发送队列。回应不按慢速连接的设定丢弃或断开连接，
+// 队列已满时等待 writeLoop 取出讯息，期间暂停读取该连接的控制指令
+func (s *WebSocket) reply(data []byte) {
+	select {
+	case <-s.done:
+	case s.queue <- outgoing{data: data}:
+		queueEnqueued.Add(1)
+	}
+}
+
+// close 关闭连接并停止发送，可多次调用
+func (s *WebSocket) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.ws.Close()
+	})
+}
+
+// queueDepth 返回所有连接的数量、等待发送的讯息总数及最长的队列长度
+func queueDepth() (conns int, total int, longest int) {
+	count := func(s *WebSocket) {
+		n := len(s.queue)
+		conns++
+		total += n
+		if n > longest {
+			longest = n
+		}
+	}
+
+	tableMu.RLock()
+	for _, sockets := range websocketTable {
+		for socket := range sockets {
+			count(socket)
+		}
+	}
+	tableMu.RUnlock()
+
+	globalWebSockets.Range(func(socket, _ interface{}) bool {
+		count(socket.(*WebSocket))
+		return true
+	})
+	return
+}
@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/go-playground/assert/v2"
+	"github.com/gorilla/websocket"
+)
+
+func TestEnqueue(t *testing.T) {
+	settings.SlowConsumerPolicy = "drop_oldest"
+	s := &WebSocket{queue: make(chan outgoing, 2), done: make(chan struct{})}
+
+	dropped := queueDropped.Value()
+	for i := byte(1); i <= 3; i++ {
+		assert.Equal(t, s.enqueue(outgoing{data: []byte{i}}), true)
+	}
+	// 丢弃最旧的讯息
+	assert.Equal(t, queueDropped.Value(), dropped+1)
+	assert.Equal(t, (<-s.queue).data, []byte{2})
+	assert.Equal(t, (<-s.queue).data, []byte{3})
+
+	settings.SlowConsumerPolicy = PolicyDisconnect
+	s = &WebSocket{queue: make(chan outgoing, 1), done: make(chan struct{})}
+	assert.Equal(t, s.enqueue(outgoing{data: []byte{1}}), true)
+	assert.Equal(t, s.enqueue(outgoing{data: []byte{2}}), false)
+
+	// 已关闭的连接不再入队
+	close(s.done)
+	assert.Equal(t, s.enqueue(outgoing{data: []byte{3}}), true)
+	assert.Equal(t, len(s.queue), 1)
+}
+
+// blockWriter 暂停连接的发送，直到 writeLoop 已取出队列中的讯息
+func blockWriter(t *testing.T, socket *WebSocket) {
+	socket.mu.Lock()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(socket.queue) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("发送队列没有被取出")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{SendQueueSize: 2, SlowConsumerPolicy: "drop_oldest"})
+	room := testRoom()
+	slowID, fastID := testID("slow"), testID("fast")
+	slowIdentifier, fastIdentifier := "127.0.0.1@"+slowID, "127.0.0.1@"+fastID
+	subscribe(t, slowIdentifier, room)
+	subscribe(t, fastIdentifier, room)
+
+	slow := dialWS(t, server, "/ws?id="+slowID)
+	fast := dialWS(t, server, "/ws?id="+fastID)
+	waitConnections(t, slowIdentifier, 1)
+	waitConnections(t, fastIdentifier, 1)
+	socket := getConnections(slowIdentifier)[0]
+
+	publish(room, "DANMU_MSG", float64(1))
+	blockWriter(t, socket)
+	assert.Equal(t, readData(t, fast).Content, float64(1))
+
+	// 过慢的连接不影响其他连接
+	for i := 2; i <= 5; i++ {
+		publish(room, "DANMU_MSG", float64(i))
+		assert.Equal(t, readData(t, fast).Content, float64(i))
+	}
+
+	socket.mu.Unlock()
+	for _, i := range []float64{1, 4, 5} {
+		assert.Equal(t, readData(t, slow).Content, i)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{SendQueueSize: 1, SlowConsumerPolicy: PolicyDisconnect})
+	room := testRoom()
+	id := testID("disconnect")
+	identifier := "127.0.0.1@" + id
+	subscribe(t, identifier, room)
+
+	conn := dialWS(t, server, "/ws?id="+id)
+	waitConnections(t, identifier, 1)
+	socket := getConnections(identifier)[0]
+
+	disconnected := queueDisconnected.Value()
+	publish(room, "DANMU_MSG", float64(1))
+	blockWriter(t, socket)
+	publish(room, "DANMU_MSG", float64(2))
+	publish(room, "DANMU_MSG", float64(3))
+	socket.mu.Unlock()
+
+	// 队列已满时断开连接
+	waitConnections(t, identifier, 0)
+	assert.Equal(t, queueDisconnected.Value(), disconnected+1)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+func TestControlReplyQueueFull(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{SendQueueSize: 1, SlowConsumerPolicy: PolicyDisconnect})
+	room := testRoom()
+	id := testID("reply")
+	identifier := "127.0.0.1@" + id
+	subscribe(t, identifier, room)
+
+	conn := dialWS(t, server, "/ws?id="+id)
+	waitConnections(t, identifier, 1)
+	socket := getConnections(identifier)[0]
+
+	disconnected := queueDisconnected.Value()
+	publish(room, "DANMU_MSG", float64(1))
+	blockWriter(t, socket)
+	publish(room, "DANMU_MSG", float64(2))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"id": "0", "action": "ping"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// 队列已满时回应等待发送，不会断开连接
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, len(socket.queue), 1)
+	socket.mu.Unlock()
+
+	assert.Equal(t, readData(t, conn).Content, float64(1))
+	assert.Equal(t, readData(t, conn).Content, float64(2))
+	assert.Equal(t, readData(t, conn).Command, ResponseCommand)
+	assert.Equal(t, queueDisconnected.Value(), disconnected)
+	assert.Equal(t, len(getConnections(identifier)), 1)
+}
+
+func TestResumeSlowConsumer(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{SendQueueSize: 1, SlowConsumerPolicy: PolicyDisconnect})
+	room := testRoom()
+	id := testID("resume-slow")
+	identifier := "127.0.0.1@" + id
+	subscribe(t, identifier, room)
+
+	for i := 1; i <= 50; i++ {
+		publish(room, "DANMU_MSG", float64(i))
+	}
+
+	// 补发的讯息同样经发送队列，超过队列长度时按设定断开连接
+	disconnected := queueDisconnected.Value()
+	conn := dialWS(t, server, fmt.Sprintf("/ws?id=%v&resume_from=%v:0", id, room))
+	deadline := time.Now().Add(5 * time.Second)
+	for queueDisconnected.Value() == disconnected {
+		if time.Now().After(deadline) {
+			t.Fatal("补发时没有断开连接")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitConnections(t, identifier, 0)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
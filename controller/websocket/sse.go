@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/services/subscriber"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// sseBufferSize 每个用户保留的最近讯息数量，用于以 Last-Event-ID 重连时补发
+	sseBufferSize = 1000
+	// sseKeepAlive 没有讯息时发送注释的间隔，防止代理关闭连接
+	sseKeepAlive = 15 * time.Second
+	// sseRetry 建议客户端断线后重连的等待时间 (毫秒)
+	sseRetry = 3000
+	// sseExpire 断线后保留讯息缓冲的时间，与订阅过期相同
+	sseExpire = 5 * time.Minute
+)
+
+var sseTable = sync.Map{}
+
+// sseEvent 已编号的讯息
+type sseEvent struct {
+	id   uint64
+	data []byte
+}
+
+// sseStream 用户的讯息缓冲，断线期间仍会继续缓冲直到过期
+type sseStream struct {
+	mu     sync.Mutex
+	seq    uint64
+	buffer [sseBufferSize]sseEvent
+	// changed 有新讯息时关闭，通知所有连接中的请求
+	changed chan struct{}
+	// conns 连接中的请求数量
+	conns  int
+	expire *time.Timer
+	// closed 已过期并从 sseTable 移除
+	closed bool
+	// filter 指令过滤，同一用户的 SSE 连接共用讯息缓冲，因此共用指令过滤
+	filter *compiledFilter
+}
+
+func RegisterSSE(gp *gin.RouterGroup) {
+	gp.GET("", OpenSSE)
+}
+
+// OpenSSE 以 Server-Sent Events 推送订阅房间的直播数据，内容与 OpenWebSocket 相同。
+// 以 ?id= 或 Authorization 标头辨识用户，重连时可传入 Last-Event-ID 补发断线期间的讯息。
+func OpenSSE(c *gin.Context) {
+
+	id, ok := c.GetQuery("id")
+
+	if !ok {
+		id = c.GetHeader("Authorization")
+	}
+
+	// 沒有 id 則为 anonymous
+	if id == "" {
+		id = "anonymous"
+	}
+
+	identifier := fmt.Sprintf("%v@%v", c.ClientIP(), id)
+
+	// 没有 Last-Event-ID 时只发送之后的讯息
+	last := uint64(math.MaxUint64)
+	if v := c.GetHeader("Last-Event-ID"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.IndentedJSON(400, gin.H{
+				"error": fmt.Sprintf("Last-Event-ID 无效: %q", v),
+			})
+			return
+		}
+		last = n
+	}
+
+	stream := connectSSE(identifier)
+	defer disconnectSSE(identifier, stream)
+
+	stream.setFilter(filterFromQuery(c, identifier))
+
+	// 先前尚未有订阅时使用空值防止启动订阅过期
+	subscriber.InitIfAbsent(identifier)
+
+	// 中止五分钟后清除订阅記憶
+	subscriber.CancelExpire(identifier)
+
+	log.Infof("用户 %v 已连接 SSE", identifier)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// 防止 nginx 缓冲
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	if _, err := fmt.Fprintf(c.Writer, "retry: %d\n\n", sseRetry); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	if err := stream.serve(c.Request.Context(), c, last); err != nil {
+		log.Infof("已关闭对 %v 的 SSE 连接: %v", identifier, err)
+	}
+}
+
+// serve 持续发送编号大于 last 的讯息，直到连接关闭
+func (s *sseStream) serve(ctx context.Context, c *gin.Context, last uint64) error {
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	s.mu.Lock()
+	if last == math.MaxUint64 {
+		last = s.seq
+	} else if last > s.seq {
+		// 缓冲已过期后重新建立，编号从头开始，补发全部缓冲
+		last = 0
+	}
+	s.mu.Unlock()
+
+	for {
+		events, skipped, changed := s.since(last)
+		if skipped > 0 {
+			log.Warnf("SSE 讯息缓冲已满，略过 %v 条讯息", skipped)
+			if err := writeSSEGap(c, last+1, last+skipped); err != nil {
+				return err
+			}
+		}
+		for _, ev := range events {
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", ev.id, ev.data); err != nil {
+				return err
+			}
+			last = ev.id
+		}
+		if len(events) > 0 {
+			c.Writer.Flush()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-ticker.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// writeSSEGap 发送指令为 REPLAY_GAP 的事件，内容为已不在缓冲中的编号范围。
+// 事件没有 id，不影响客户端重连时的 Last-Event-ID
+func writeSSEGap(c *gin.Context, from, to uint64) error {
+	gap, err := json.Marshal(BLiveData{
+		Command: ReplayGapCommand,
+		Content: gin.H{"from": from, "to": to},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "data: %s\n\n", gap)
+	return err
+}
+
+// since 返回编号大于 last 且仍在缓冲中的讯息、已被覆盖而无法补发的数量，以及等待下一条讯息的 channel
+func (s *sseStream) since(last uint64) ([]sseEvent, uint64, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var skipped uint64
+	if s.seq > sseBufferSize && last < s.seq-sseBufferSize {
+		skipped = s.seq - sseBufferSize - last
+		last = s.seq - sseBufferSize
+	}
+
+	events := make([]sseEvent, 0, s.seq-last)
+	for id := last + 1; id <= s.seq; id++ {
+		events = append(events, s.buffer[id%sseBufferSize])
+	}
+	return events, skipped, s.changed
+}
+
+// push 编号并缓冲讯息，通知连接中的请求
+func (s *sseStream) push(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.buffer[s.seq%sseBufferSize] = sseEvent{id: s.seq, data: data}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// connectSSE 取得用户的讯息缓冲，不存在则建立
+func connectSSE(identifier string) *sseStream {
+	for {
+		v, _ := sseTable.LoadOrStore(identifier, &sseStream{changed: make(chan struct{})})
+		stream := v.(*sseStream)
+
+		stream.mu.Lock()
+		// 刚好过期，重新建立
+		if stream.closed {
+			stream.mu.Unlock()
+			continue
+		}
+		stream.conns++
+		if stream.expire != nil {
+			stream.expire.Stop()
+			stream.expire = nil
+		}
+		stream.mu.Unlock()
+		return stream
+	}
+}
+
+// disconnectSSE 最后一个连接关闭后，等待五分钟没有重连则清除讯息缓冲及订阅
+func disconnectSSE(identifier string, stream *sseStream) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.conns--
+	if stream.conns > 0 {
+		return
+	}
+	stream.expire = time.AfterFunc(sseExpire, func() {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		if stream.conns == 0 {
+			stream.closed = true
+			sseTable.Delete(identifier)
+		}
+	})
+	// 仍有 WebSocket 连接时由最后关闭的连接计算过期
+	if len(getConnections(identifier)) == 0 {
+		subscriber.ExpireAfterWithCheck(identifier, time.NewTimer(sseExpire), false)
+	}
+}
+
+// sseConnected 返回用户是否有连接中的 SSE 请求
+func sseConnected(identifier string) bool {
+	v, ok := sseTable.Load(identifier)
+	if !ok {
+		return false
+	}
+	stream := v.(*sseStream)
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return stream.conns > 0
+}
+
+// loadSSE 返回用户的讯息缓冲，用户未曾以 SSE 连接或已过期时返回 false
+func loadSSE(identifier string) (*sseStream, bool) {
+	if stream, ok := sseTable.Load(identifier); ok {
+		return stream.(*sseStream), true
+	}
+	return nil, false
+}
+
+func (s *sseStream) setFilter(filter *compiledFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = filter
+}
+
+// allow 检查 SSE 是否需要此指令
+func (s *sseStream) allow(command string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter.allow(command)
+}
+
+// setSSEFilter 更新用户 SSE 的指令过滤，用户未曾以 SSE 连接则略过
+func setSSEFilter(identifier string, filter *compiledFilter) {
+	if stream, ok := loadSSE(identifier); ok {
+		stream.setFilter(filter)
+	}
+}
@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/go-playground/assert/v2"
+)
+
+// openSSE 连接 /sse，读取到 retry 后返回，此时已开始接收讯息
+func openSSE(t *testing.T, url, lastEventID string) (*bufio.Reader, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		res.Body.Close()
+	})
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/event-stream")
+
+	r := bufio.NewReader(res.Body)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line, "retry: 3000\n")
+	return r, cancel
+}
+
+// readEvent 读取下一则事件的 id 及内容，略过注释
+func readEvent(t *testing.T, r *bufio.Reader) (string, BLiveData) {
+	var (
+		id   string
+		data BLiveData
+		read bool
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && read:
+			return id, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatal(err)
+			}
+			read = true
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	id := testID("sse")
+	room, other := testRoom(), testRoom()
+	subscribe(t, "127.0.0.1@"+id, room)
+
+	r, cancel := openSSE(t, server.URL+"/sse?id="+id, "")
+
+	publish(room, "DANMU_MSG", "a")
+	publish(other, "DANMU_MSG", "未订阅")
+	publish(room, "DANMU_MSG", "b")
+
+	seq, data := readEvent(t, r)
+	assert.Equal(t, seq, "1")
+	assert.Equal(t, data.Command, "DANMU_MSG")
+	assert.Equal(t, data.Content, "a")
+	seq, data = readEvent(t, r)
+	assert.Equal(t, seq, "2")
+	assert.Equal(t, data.Content, "b")
+
+	// 断线期间的讯息仍会缓冲，以 Last-Event-ID 重连时补发
+	cancel()
+	publish(room, "DANMU_MSG", "c")
+	publish(room, "DANMU_MSG", "d")
+
+	r, _ = openSSE(t, server.URL+"/sse?id="+id, "3")
+	seq, data = readEvent(t, r)
+	assert.Equal(t, seq, "4")
+	assert.Equal(t, data.Content, "d")
+
+	publish(room, "DANMU_MSG", "e")
+	seq, data = readEvent(t, r)
+	assert.Equal(t, seq, "5")
+	assert.Equal(t, data.Content, "e")
+}
+
+func TestSSEGap(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	id := testID("sse-gap")
+	room := testRoom()
+	subscribe(t, "127.0.0.1@"+id, room)
+
+	_, cancel := openSSE(t, server.URL+"/sse?id="+id, "")
+	cancel()
+	for i := 1; i <= sseBufferSize+5; i++ {
+		publish(room, "DANMU_MSG", float64(i))
+	}
+
+	// 第 3 至 5 条已被覆盖
+	r, _ := openSSE(t, server.URL+"/sse?id="+id, "2")
+	seq, data := readEvent(t, r)
+	assert.Equal(t, seq, "")
+	assert.Equal(t, data.Command, ReplayGapCommand)
+	assert.Equal(t, data.Content, map[string]interface{}{"from": float64(3), "to": float64(5)})
+
+	seq, data = readEvent(t, r)
+	assert.Equal(t, seq, "6")
+	assert.Equal(t, data.Content, float64(6))
+}
+
+func TestSSEAuthorization(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	token := testID("token")
+	room := testRoom()
+	subscribe(t, "127.0.0.1@"+token, room)
+
+	// 没有 ?id= 时以 Authorization 标头辨识用户
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/sse", nil)
+	req.Header.Set("Authorization", token)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	r := bufio.NewReader(res.Body)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	publish(room, "DANMU_MSG", "a")
+	_, data := readEvent(t, r)
+	assert.Equal(t, data.Content, "a")
+}
+
+func TestSSEInvalidLastEventID(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/sse?id=invalid", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, res.StatusCode, 400)
+}
@@ -5,30 +5,61 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	live "github.com/eric2788/biligo-live"
+	"github.com/eric2788/biligo-live-ws/config"
 	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/eric2788/biligo-live-ws/services/replay"
+	"github.com/eric2788/biligo-live-ws/services/stats"
 	"github.com/eric2788/biligo-live-ws/services/subscriber"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// StatsCommand 定时推送的房间统计指令
+	StatsCommand = "STATS"
+	// ReplayGapCommand 重连补发时部分讯息已不在缓冲中，内容为房间号及缺失的编号范围
+	ReplayGapCommand = "REPLAY_GAP"
+)
+
 var (
-	websocketTable = sync.Map{}
+	// websocketTable 每个用户的所有连接，同一用户可同时有多个连接
+	websocketTable = make(map[string]map[*WebSocket]struct{})
+	tableMu        sync.RWMutex
 	log            = logrus.WithField("controller", "websocket")
+	settings       config.WebSocket
 )
 
 type WebSocket struct {
 	ws *websocket.Conn
+	// mu 同一时间只有一个 goroutine 写入连接
 	mu sync.Mutex
+	// order 重连补发的讯息入队期间持有，令之后入队的房间讯息排在补发的讯息之后
+	order sync.Mutex
+	// replayed 重连时已补发到的讯息编号，之后收到编号较小的讯息则略过，只由 writeLoop 存取
+	replayed map[int64]uint64
+	// filter 此连接的指令过滤 (*compiledFilter)
+	filter atomic.Value
+	// queue 等待发送的讯息，由 writeLoop 按顺序发送
+	queue     chan outgoing
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func Register(gp *gin.RouterGroup) {
+func Register(gp *gin.RouterGroup, cfg config.WebSocket) {
+	settings = cfg
 	gp.GET("", OpenWebSocket)
 	gp.GET("/global", OpenGlobalWebSocket)
+	gp.GET("/filter", GetFilter)
+	gp.PUT("/filter", PutFilter)
 	go blive.SubscribedRoomTracker(handleBLiveMessage)
+	if cfg.StatsInterval > 0 {
+		go stats.Publish(cfg.StatsInterval, handleStats)
+	}
 }
 
 func OpenWebSocket(c *gin.Context) {
@@ -48,6 +79,20 @@ func OpenWebSocket(c *gin.Context) {
 		id = "anonymous"
 	}
 
+	var resume map[int64]uint64
+
+	// 房间号:编号 以逗号分隔，补发编号之后的讯息
+	if v := c.Query("resume_from"); v != "" {
+		vector, err := replay.ParseVector(v)
+		if err != nil {
+			c.IndentedJSON(400, gin.H{
+				"error": fmt.Sprintf("resume_from 无效: %v", err),
+			})
+			return
+		}
+		resume = vector
+	}
+
 	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		_ = c.Error(err)
@@ -56,127 +101,348 @@ func OpenWebSocket(c *gin.Context) {
 
 	identifier := fmt.Sprintf("%v@%v", c.ClientIP(), id)
 
+	var socket *WebSocket
+	socket = newWebSocket(identifier, ws, func() {
+		HandleClose(identifier, socket)
+	})
+	socket.setFilter(filterFromQuery(c, identifier))
+
 	// 客户端正常關閉连接
 	ws.SetCloseHandler(func(code int, text string) error {
 		log.Infof("已关闭对 %v 的 Websocket 连接: (%v) %v", identifier, code, text)
-		HandleClose(identifier)
-		return ws.WriteMessage(websocket.CloseMessage, nil)
+		err := ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(writeWait))
+		HandleClose(identifier, socket)
+		return err
 	})
 
-	websocketTable.Store(identifier, &WebSocket{ws: ws})
+	// 补发的讯息入队前暂停入队新的讯息
+	socket.order.Lock()
+	addConnection(identifier, socket)
+	full := len(resume) > 0 && !replayMessages(identifier, socket, resume)
+	socket.order.Unlock()
 
-	// 先前尚未有订阅
-	if _, subBefore := subscriber.Get(identifier); !subBefore {
-		// 使用空值防止启动订阅过期
-		subscriber.Update(identifier, []int64{})
+	if full {
+		log.Warnf("用户 %v 的发送队列已满，关闭连线。", identifier)
+		HandleClose(identifier, socket)
+		return
 	}
 
+	// 先前尚未有订阅时使用空值防止启动订阅过期
+	subscriber.InitIfAbsent(identifier)
+
 	// 中止五分钟后清除订阅記憶
 	subscriber.CancelExpire(identifier)
 
+	ws.SetReadLimit(controlReadLimit)
+
 	go func() {
 		for {
-			// 接收客户端關閉訊息
-			if _, _, err = ws.NextReader(); err != nil {
-				if err := ws.Close(); err != nil {
-					log.Warnf("关闭用户 %v 的 WebSocket 时发生错误: %v", identifier, err)
-				}
+			// 接收客户端的控制指令及關閉訊息
+			messageType, message, err := ws.ReadMessage()
+			if err != nil {
+				HandleClose(identifier, socket)
 				return
 			}
+			if messageType == websocket.TextMessage {
+				handleControl(identifier, socket, message, execute)
+			}
 		}
 	}()
 }
 
-func handleBLiveMessage(room int64, info *blive.LiveInfo, msg live.Msg) {
+// replayMessages 将订阅房间在 resume 编号之后的讯息放入发送队列，须持有 socket.order。
+// 补发的讯息与其他讯息同样受发送队列长度限制，按设定应断开连接时返回 false
+func replayMessages(identifier string, socket *WebSocket, resume map[int64]uint64) bool {
 
-	raw := msg.Raw()
+	subscribed, _ := subscriber.Get(identifier)
 
-	// 人氣值轉換为 json string
-	if reply, ok := msg.(*live.MsgHeartbeatReply); ok {
-		hot := reply.GetHot()
-		raw = []byte(fmt.Sprintf("{\"popularity\": %v}", hot))
-	}
+	for room, seq := range resume {
 
-	var content interface{}
+		real := realRoom(room)
 
-	if err := json.Unmarshal(raw, &content); err != nil {
-		log.Warnf("序列化 原始数据内容 时出现错误: %v, 将转换为 string", err)
-		content = string(raw)
-	}
+		if !containsRoom(subscribed, room) && !containsRoom(subscribed, real) {
+			continue
+		}
+
+		events, missing := replay.Since(real, seq)
+
+		// 部分讯息已不在缓冲中
+		if missing > 0 {
+			to := replay.Last(real)
+			if len(events) > 0 {
+				to = events[0].Seq - 1
+			}
+			gap, _ := json.Marshal(BLiveData{
+				Command: ReplayGapCommand,
+				Content: gin.H{"room_id": real, "from": missing, "to": to},
+			})
+			if !socket.enqueue(outgoing{data: gap}) {
+				return false
+			}
+		}
+
+		filter := socket.getFilter()
+
+		for _, ev := range events {
+			if !filter.allow(ev.Command) {
+				continue
+			}
+			if !socket.enqueue(outgoing{room: real, seq: ev.Seq, data: ev.Data, replay: true}) {
+				return false
+			}
+		}
 
-	bLiveData := BLiveData{
-		Command:  msg.Cmd(),
-		LiveInfo: info,
-		Content:  content,
+		log.Infof("已向用户 %v 补发房间 %v 的 %v 条讯息", identifier, real, len(events))
 	}
+	return true
+}
 
-	// 订阅用户
-	for _, identifier := range subscriber.GetAllSubscribers(room) {
-		if err := writeMessage(identifier, bLiveData); err != nil {
-			log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
+// realRoom 返回短号对应的真正房间号
+func realRoom(room int64) int64 {
+	real := room
+	blive.ShortRoomMap.Range(func(r, short interface{}) bool {
+		if short.(int64) == room {
+			real = r.(int64)
+			return false
+		}
+		return true
+	})
+	return real
+}
+
+func containsRoom(rooms []int64, room int64) bool {
+	for _, r := range rooms {
+		if r == room {
+			return true
 		}
 	}
+	return false
+}
+
+func handleBLiveMessage(room int64, info *blive.LiveInfo, msg live.Msg) {
+
+	// 在序列化前按指令过滤，没有用户需要时略过
+	broadcast(room, msg.Cmd(), func() BLiveData {
+
+		raw := msg.Raw()
+
+		// 人氣值轉換为 json string
+		if reply, ok := msg.(*live.MsgHeartbeatReply); ok {
+			hot := reply.GetHot()
+			raw = []byte(fmt.Sprintf("{\"popularity\": %v}", hot))
+		}
+
+		var content interface{}
+
+		if err := json.Unmarshal(raw, &content); err != nil {
+			log.Warnf("序列化 原始数据内容 时出现错误: %v, 将转换为 string", err)
+			content = string(raw)
+		}
+
+		return BLiveData{
+			Command:  msg.Cmd(),
+			LiveInfo: info,
+			Content:  content,
+		}
+	})
+}
+
+// handleStats 以 STATS 指令推送房间的统计
+func handleStats(s *stats.Stats) {
+
+	broadcast(s.RoomId, StatsCommand, func() BLiveData {
+
+		info, err := blive.GetLiveInfoCache(s.RoomId)
+
+		if err != nil {
+			log.Warnf("获取房间 %v 的直播资讯时出现错误: %v", s.RoomId, err)
+		}
+
+		return BLiveData{
+			Command:  StatsCommand,
+			LiveInfo: info,
+			Content:  s,
+		}
+	})
+}
+
+// broadcast 发送给订阅该房间 (包括短号) 且没有过滤此指令的连接及全局连接。
+// 启用讯息缓冲时房间讯息须编号并保留以便补发，因此总会调用 build 并序列化一次，
+// 再按连接过滤，所有连接及补发共用同一份内容；停用缓冲时的房间讯息及房间统计
+// 在没有任何连接需要时不会调用 build
+func broadcast(room int64, command string, build func() BLiveData) {
+
+	// 订阅用户
+	identifiers := subscriber.GetAllSubscribers(room)
 
 	// 短号用户
 	if shortRoomId, ok := blive.ShortRoomMap.Load(room); ok {
+		identifiers = append(identifiers, subscriber.GetAllSubscribers(shortRoomId.(int64))...)
+	}
 
-		for _, identifier := range subscriber.GetAllSubscribers(shortRoomId.(int64)) {
-			if err := writeMessage(identifier, bLiveData); err != nil {
-				log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
-			}
+	wanted := false
+	for _, identifier := range identifiers {
+		if wantsCommand(identifier, command) {
+			wanted = true
+			break
 		}
-
 	}
 
 	// 全局用户
-	globalWebSockets.Range(func(id, conn interface{}) bool {
-		if err := writeGlobalMessage(id.(string), conn.(*WebSocket), bLiveData); err != nil {
-			log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", id, err, err)
+	var globals []*WebSocket
+	globalWebSockets.Range(func(conn, _ interface{}) bool {
+		if socket := conn.(*WebSocket); socket.allow(command) {
+			globals = append(globals, socket)
 		}
 		return true
 	})
 
+	// 房间讯息无论当下是否有连接需要都须编号并保留，之后以 resume_from 补发时才不会缺失
+	sequenced := command != StatsCommand && replay.Enabled()
+
+	if !sequenced && !wanted && len(globals) == 0 {
+		return
+	}
+
+	bLiveData := build()
+
+	var (
+		seq      uint64
+		byteData []byte
+		err      error
+	)
+
+	// 房间统计只反映当下，不编号也不保留
+	if command == StatsCommand {
+		byteData, err = json.Marshal(bLiveData)
+	} else {
+		seq, byteData, err = replay.Append(room, command, func(seq uint64) ([]byte, error) {
+			bLiveData.Seq = seq
+			return json.Marshal(bLiveData)
+		})
+	}
+
+	if err != nil {
+		log.Warnf("序列化房间 %v 的直播数据时出现错误: %v", room, err)
+		return
+	}
+
+	for _, identifier := range identifiers {
+		if err := writeMessage(identifier, room, seq, command, byteData); err != nil {
+			log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
+		}
+	}
+
+	for _, socket := range globals {
+		identifier, ok := globalWebSockets.Load(socket)
+		if !ok {
+			continue
+		}
+		if err := writeGlobalMessage(identifier.(string), socket, byteData); err != nil {
+			log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
+		}
+	}
+
 }
 
-func writeMessage(identifier string, data BLiveData) error {
-	conn, ok := websocketTable.Load(identifier)
+// wantsCommand 检查用户是否有连接需要此指令
+func wantsCommand(identifier, command string) bool {
+	sockets := getConnections(identifier)
+	stream, sse := loadSSE(identifier)
+	for _, socket := range sockets {
+		if socket.allow(command) {
+			return true
+		}
+	}
+	return sse && stream.allow(command)
+}
 
-	if !ok {
+// writeMessage 向用户每个没有过滤此指令的连接发送房间第 seq 条讯息，已在重连补发时发送过的讯息会略过
+func writeMessage(identifier string, room int64, seq uint64, command string, byteData []byte) error {
+	sockets := getConnections(identifier)
+	stream, sse := loadSSE(identifier)
+
+	if len(sockets) == 0 && !sse {
 		//log.Infof("用户 %v 尚未连接到WS，略过發送。\n", identifier)
 		return nil
 	}
 
-	socket := conn.(*WebSocket)
+	// SSE 用户断线期间仍会缓冲讯息
+	if sse && stream.allow(command) {
+		stream.push(byteData)
+	}
 
-	defer socket.mu.Unlock()
-	socket.mu.Lock()
+	// 各连接独立发送，其中一个过慢或出错不影响其他连接
+	for _, socket := range sockets {
+		if !socket.allow(command) {
+			continue
+		}
+		socket.order.Lock()
+		ok := socket.enqueue(outgoing{room: room, seq: seq, data: byteData})
+		socket.order.Unlock()
+		if !ok {
+			log.Warnf("用户 %v 的发送队列已满，关闭连线。", identifier)
+			HandleClose(identifier, socket)
+		}
+	}
 
-	con := socket.ws
-	byteData, err := json.Marshal(data)
+	return nil
+}
 
-	if err != nil {
-		return err
+// addConnection 加入用户的一个连接
+func addConnection(identifier string, socket *WebSocket) {
+	tableMu.Lock()
+	defer tableMu.Unlock()
+	sockets, ok := websocketTable[identifier]
+	if !ok {
+		sockets = make(map[*WebSocket]struct{})
+		websocketTable[identifier] = sockets
 	}
+	sockets[socket] = struct{}{}
+}
 
-	if err = con.WriteMessage(websocket.TextMessage, byteData); err != nil {
-		log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
-		log.Warnf("关闭对用户 %v 的连线。", identifier)
-		_ = con.Close()
-		// 客户端非正常關閉连接
-		HandleClose(identifier)
+// getConnections 返回用户目前的所有连接
+func getConnections(identifier string) []*WebSocket {
+	tableMu.RLock()
+	defer tableMu.RUnlock()
+	sockets := make([]*WebSocket, 0, len(websocketTable[identifier]))
+	for socket := range websocketTable[identifier] {
+		sockets = append(sockets, socket)
 	}
-
-	return nil
+	return sockets
 }
 
-func HandleClose(identifier string) {
-	websocketTable.Delete(identifier)
+// HandleClose 关闭并移除用户的一个连接，最后一个连接关闭后才开始计算订阅过期。
+// 同一连接可能因关闭讯息、读取及发送错误多次调用，只有第一次有效。
+func HandleClose(identifier string, socket *WebSocket) {
+	socket.close()
+
+	tableMu.Lock()
+	sockets, ok := websocketTable[identifier]
+	if ok {
+		if _, ok = sockets[socket]; ok {
+			delete(sockets, socket)
+		}
+	}
+	last := ok && len(sockets) == 0
+	if last {
+		delete(websocketTable, identifier)
+	}
+	tableMu.Unlock()
+
+	// 仍有 SSE 连接时由 SSE 断线时计算过期
+	if !last || sseConnected(identifier) {
+		return
+	}
+
 	// 等待五分钟，如果五分钟后沒有重连則刪除订阅記憶
 	// 由于斷線的时候已经有订阅列表，因此此方法不會检查是否有订阅列表
 	subscriber.ExpireAfterWithCheck(identifier, time.NewTimer(time.Minute*5), false)
 }
 
 type BLiveData struct {
+	// Seq 房间内递增的讯息编号，用于 resume_from 重连补发，房间统计没有编号
+	Seq      uint64          `json:"seq,omitempty"`
 	Command  string          `json:"command"`
 	LiveInfo *blive.LiveInfo `json:"live_info"`
 	Content  interface{}     `json:"content"`
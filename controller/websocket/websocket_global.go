@@ -1,24 +1,24 @@
 package websocket
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
+// globalWebSockets 所有全局连接 (*WebSocket) 及其辨识ID，同一 IP 可同时有多个连接
 var globalWebSockets = sync.Map{}
 
 func OpenGlobalWebSocket(c *gin.Context) {
 
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			if os.Getenv("RESTRICT_GLOBAL") != "" {
-				return c.Query("token") == os.Getenv("RESTRICT_GLOBAL")
+			if settings.RestrictGlobal != "" {
+				return c.Query("token") == settings.RestrictGlobal
 			}
 			return true
 		},
@@ -34,45 +34,52 @@ func OpenGlobalWebSocket(c *gin.Context) {
 
 	identifier := fmt.Sprintf("%v@%v", c.ClientIP(), "global")
 
+	var socket *WebSocket
+	socket = newWebSocket(identifier, ws, func() {
+		closeGlobal(socket)
+	})
+
+	// 全局连接不保留订阅，以 query 参数或控制指令 filter 设定指令过滤
+	socket.setFilter((&Filter{Include: c.QueryArray("include"), Exclude: c.QueryArray("exclude")}).compile())
+
 	// 客户端正常關閉连接
 	ws.SetCloseHandler(func(code int, text string) error {
 		log.Infof("已关闭对 %v 的 Websocket 连接: (%v) %v", identifier, code, text)
-		globalWebSockets.Delete(identifier)
-		return ws.WriteMessage(websocket.CloseMessage, nil)
+		err := ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(writeWait))
+		closeGlobal(socket)
+		return err
 	})
 
-	globalWebSockets.Store(identifier, &WebSocket{ws: ws})
+	globalWebSockets.Store(socket, identifier)
+
+	ws.SetReadLimit(controlReadLimit)
 
 	go func() {
 		for {
-			// 接收客户端關閉訊息
-			if _, _, err = ws.NextReader(); err != nil {
-				if err := ws.Close(); err != nil {
-					log.Warnf("关闭用户 %v 的 WebSocket 时发生错误: %v", identifier, err)
-				}
+			// 接收客户端的控制指令及關閉訊息
+			messageType, message, err := ws.ReadMessage()
+			if err != nil {
+				closeGlobal(socket)
 				return
 			}
+			if messageType == websocket.TextMessage {
+				handleControl(identifier, socket, message, executeGlobal)
+			}
 		}
 	}()
 }
 
-func writeGlobalMessage(identifier string, socket *WebSocket, data BLiveData) error {
-
-	defer socket.mu.Unlock()
-	socket.mu.Lock()
-
-	con := socket.ws
-	byteData, err := json.Marshal(data)
+// closeGlobal 关闭并移除全局连接
+func closeGlobal(socket *WebSocket) {
+	socket.close()
+	globalWebSockets.Delete(socket)
+}
 
-	if err != nil {
-		return err
-	}
+func writeGlobalMessage(identifier string, socket *WebSocket, byteData []byte) error {
 
-	if err = con.WriteMessage(websocket.TextMessage, byteData); err != nil {
-		log.Warnf("向 用户 %v 发送直播数据时出现错误: (%T)%v\n", identifier, err, err)
-		log.Warnf("关闭对用户 %v 的连线。", identifier)
-		_ = con.Close()
-		globalWebSockets.Delete(identifier)
+	if !socket.enqueue(outgoing{data: byteData}) {
+		log.Warnf("用户 %v 的发送队列已满，关闭连线。", identifier)
+		closeGlobal(socket)
 	}
 
 	return nil
@@ -0,0 +1,273 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/eric2788/biligo-live-ws/services/replay"
+	"github.com/eric2788/biligo-live-ws/services/subscriber"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer 以指定设定启动 /ws 及 /sse 的路由，不启动房间监听及统计推送
+func newTestServer(t *testing.T, cfg config.WebSocket) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	settings = cfg
+	router := gin.New()
+	router.GET("/ws", OpenWebSocket)
+	router.GET("/ws/global", OpenGlobalWebSocket)
+	router.GET("/ws/filter", GetFilter)
+	router.PUT("/ws/filter", PutFilter)
+	router.GET("/sse", OpenSSE)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+var testIDs, testRooms int64
+
+// testID 返回此次运行中不重复的用户 id，重复运行测试时不会沿用先前的订阅及讯息缓冲
+func testID(name string) string {
+	return fmt.Sprintf("%v-%v-%v", name, time.Now().UnixNano(), atomic.AddInt64(&testIDs, 1))
+}
+
+// testRoom 返回此次运行中不重复的房间号，讯息编号不会沿用先前的测试
+func testRoom() int64 {
+	return 100000 + atomic.AddInt64(&testRooms, 1)
+}
+
+// subscribe 设置用户的订阅，测试结束后删除
+func subscribe(t *testing.T, identifier string, rooms ...int64) {
+	subscriber.Update(identifier, rooms)
+	t.Cleanup(func() { subscriber.Delete(identifier) })
+}
+
+// dialWS 以 gorilla 客户端连接，path 包含 query 参数
+func dialWS(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitConnections 等待用户的连接数量为 n
+func waitConnections(t *testing.T, identifier string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(getConnections(identifier)) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("用户 %v 的连接数量为 %v，预期 %v", identifier, len(getConnections(identifier)), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// globalCount 返回目前的全局连接数量
+func globalCount() int {
+	n := 0
+	globalWebSockets.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// waitGlobals 等待全局连接数量为 n
+func waitGlobals(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for globalCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("全局连接数量为 %v，预期 %v", globalCount(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readData 读取下一则讯息
+func readData(t *testing.T, conn *websocket.Conn) BLiveData {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data BLiveData
+	if err := json.Unmarshal(message, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// expectNoData 检查短时间内没有收到讯息，读取超时后连接不能再读取，须在最后调用
+func expectNoData(t *testing.T, conn *websocket.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, message, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("不应收到讯息: %s", message)
+	}
+}
+
+// publish 模拟收到房间的讯息
+func publish(room int64, command string, content interface{}) {
+	broadcast(room, command, func() BLiveData {
+		return BLiveData{Command: command, Content: content}
+	})
+}
+
+func TestResume(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room, other := testRoom(), testRoom()
+	id := testID("resume")
+	subscribe(t, "127.0.0.1@"+id, room)
+
+	// 没有连接时同样编号并保留
+	publish(room, "DANMU_MSG", "a")
+	publish(room, "DANMU_MSG", "b")
+	publish(room, "DANMU_MSG", "c")
+	publish(other, "DANMU_MSG", "未订阅")
+
+	conn := dialWS(t, server, fmt.Sprintf("/ws?id=%v&resume_from=%v:1,%v:0", id, room, other))
+
+	data := readData(t, conn)
+	assert.Equal(t, data.Seq, uint64(2))
+	assert.Equal(t, data.Content, "b")
+	data = readData(t, conn)
+	assert.Equal(t, data.Seq, uint64(3))
+	assert.Equal(t, data.Content, "c")
+
+	// 补发后继续推送新的讯息
+	publish(room, "DANMU_MSG", "d")
+	data = readData(t, conn)
+	assert.Equal(t, data.Seq, uint64(4))
+	assert.Equal(t, data.Content, "d")
+
+	// 未订阅的房间不会补发
+	expectNoData(t, conn)
+}
+
+func TestResumeGap(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room := testRoom()
+
+	// 没有用户订阅时同样编号并保留
+	replay.Setup(3)
+	for i := 1; i <= 5; i++ {
+		publish(room, "DANMU_MSG", i)
+	}
+	replay.Setup(100)
+
+	id := testID("gap")
+	subscribe(t, "127.0.0.1@"+id, room)
+	conn := dialWS(t, server, fmt.Sprintf("/ws?id=%v&resume_from=%v:1", id, room))
+
+	// 第 2 条已不在缓冲中
+	data := readData(t, conn)
+	assert.Equal(t, data.Command, ReplayGapCommand)
+	assert.Equal(t, data.Content, map[string]interface{}{"room_id": float64(room), "from": float64(2), "to": float64(2)})
+
+	for seq := uint64(3); seq <= 5; seq++ {
+		data = readData(t, conn)
+		assert.Equal(t, data.Seq, seq)
+		assert.Equal(t, data.Content, float64(seq))
+	}
+}
+
+func TestResumeFiltered(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room := testRoom()
+	id := testID("resume-filtered")
+	subscribe(t, "127.0.0.1@"+id, room)
+
+	danmaku := dialWS(t, server, "/ws?id="+id+"&include=DANMU_MSG")
+	waitConnections(t, "127.0.0.1@"+id, 1)
+
+	// 被所有连接过滤的指令同样编号并保留
+	publish(room, "SEND_GIFT", "gift")
+	publish(room, "DANMU_MSG", "danmaku")
+	data := readData(t, danmaku)
+	assert.Equal(t, data.Seq, uint64(2))
+
+	all := dialWS(t, server, fmt.Sprintf("/ws?id=%v&resume_from=%v:0", id, room))
+	data = readData(t, all)
+	assert.Equal(t, data.Seq, uint64(1))
+	assert.Equal(t, data.Content, "gift")
+	data = readData(t, all)
+	assert.Equal(t, data.Seq, uint64(2))
+
+	// 补发时同样按连接过滤
+	danmaku = dialWS(t, server, fmt.Sprintf("/ws?id=%v&include=DANMU_MSG&resume_from=%v:0", id, room))
+	data = readData(t, danmaku)
+	assert.Equal(t, data.Seq, uint64(2))
+	assert.Equal(t, data.Content, "danmaku")
+}
+
+func TestResumeInvalid(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?resume_from=abc", nil)
+	assert.Equal(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, res.StatusCode, 400)
+}
+
+func TestMultipleConnections(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	room := testRoom()
+	id := testID("multi")
+	identifier := "127.0.0.1@" + id
+	subscriber.Update(identifier, []int64{room})
+	defer subscriber.Delete(identifier)
+
+	all := dialWS(t, server, "/ws?id="+id)
+	danmaku := dialWS(t, server, "/ws?id="+id+"&include=DANMU_MSG")
+	waitConnections(t, identifier, 2)
+
+	// 同一用户的连接各自过滤
+	publish(room, "SEND_GIFT", "gift")
+	publish(room, "DANMU_MSG", "danmaku")
+	assert.Equal(t, readData(t, all).Command, "SEND_GIFT")
+	assert.Equal(t, readData(t, all).Command, "DANMU_MSG")
+	assert.Equal(t, readData(t, danmaku).Command, "DANMU_MSG")
+
+	// 关闭其中一个连接不影响其他连接及订阅
+	_ = all.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	waitConnections(t, identifier, 1)
+
+	publish(room, "DANMU_MSG", "after")
+	assert.Equal(t, readData(t, danmaku).Content, "after")
+	_, ok := subscriber.Get(identifier)
+	assert.Equal(t, ok, true)
+
+	danmaku.Close()
+	waitConnections(t, identifier, 0)
+}
+
+func TestMultipleGlobalConnections(t *testing.T) {
+	server := newTestServer(t, config.WebSocket{})
+	command := fmt.Sprintf("TEST_%v", testRoom())
+
+	before := globalCount()
+	first := dialWS(t, server, "/ws/global?include="+command)
+	second := dialWS(t, server, "/ws/global?include="+command)
+	// 同一 IP 的全局连接各自保留
+	waitGlobals(t, before+2)
+
+	publish(testRoom(), command, "a")
+	assert.Equal(t, readData(t, first).Content, "a")
+	assert.Equal(t, readData(t, second).Content, "a")
+
+	first.Close()
+	waitGlobals(t, before+1)
+
+	publish(testRoom(), command, "b")
+	assert.Equal(t, readData(t, second).Content, "b")
+
+	second.Close()
+	waitGlobals(t, before)
+}
@@ -6,8 +6,8 @@ import (
 	_ "net/http/pprof"
 )
 
-func debugServe() {
-	if err := http.ListenAndServe("0.0.0.0:8082", http.DefaultServeMux); err != nil {
+func debugServe(addr string) {
+	if err := http.ListenAndServe(addr, http.DefaultServeMux); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/eric2788/biligo-live-ws/services/export"
+	log "github.com/sirupsen/logrus"
+)
+
+// runExport 导出直播场次的弹幕记录，用法: biligo-live-ws export [参数] <场次id>
+func runExport(name string, args []string) error {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	format := fs.String("format", "csv", "set the export format: csv, ndjson, xml, ass")
+	output := fs.String("o", "", "set the output file, default <session id>.<format>, - for stdout")
+	types := fs.String("type", "", "set the exported record types, comma separated, default depends on the format")
+
+	cfg, err := config.LoadFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("请指定一个直播场次 id")
+	}
+	id := fs.Arg(0)
+
+	if _, _, err := blive.ParseSessionID(id); err != nil {
+		return err
+	}
+
+	f, err := export.Lookup(*format)
+	if err != nil {
+		return err
+	}
+
+	if err := blive.OpenSinks(cfg.Sink, cfg.Postgres); err != nil {
+		return err
+	}
+	defer blive.CloseSinks()
+
+	ctx := context.Background()
+
+	live, err := blive.QuerySession(ctx, id, 0)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	path := *output
+	if path == "" {
+		path = f.Filename(live.Session)
+	}
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	var typeList []string
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			typeList = append(typeList, t)
+		}
+	}
+
+	if err := export.Session(ctx, w, f, live.Session, typeList); err != nil {
+		return fmt.Errorf("导出直播场次 %v 时错误: %w", id, err)
+	}
+
+	if path != "-" {
+		log.Infof("已导出到 %v", path)
+	}
+	return nil
+}
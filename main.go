@@ -1,24 +1,42 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/eric2788/biligo-live-ws/controller/alerts"
+	"github.com/eric2788/biligo-live-ws/controller/history"
+	"github.com/eric2788/biligo-live-ws/controller/leaderboards"
 	"github.com/eric2788/biligo-live-ws/controller/listening"
+	"github.com/eric2788/biligo-live-ws/controller/notifications"
+	"github.com/eric2788/biligo-live-ws/controller/search"
+	"github.com/eric2788/biligo-live-ws/controller/sessions"
+	"github.com/eric2788/biligo-live-ws/controller/stats"
 	"github.com/eric2788/biligo-live-ws/controller/subscribe"
+	"github.com/eric2788/biligo-live-ws/controller/viewers"
+	"github.com/eric2788/biligo-live-ws/controller/webhooks"
 	ws "github.com/eric2788/biligo-live-ws/controller/websocket"
+	"github.com/eric2788/biligo-live-ws/services/alert"
 	"github.com/eric2788/biligo-live-ws/services/api"
+	"github.com/eric2788/biligo-live-ws/services/blive"
 	"github.com/eric2788/biligo-live-ws/services/database"
+	"github.com/eric2788/biligo-live-ws/services/notify"
+	"github.com/eric2788/biligo-live-ws/services/replay"
 	"github.com/eric2788/biligo-live-ws/services/updater"
+	"github.com/eric2788/biligo-live-ws/services/webhook"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
-var release = flag.Bool("release", os.Getenv("GIN_MODE") == "release", "set release mode")
-var port = flag.Int("port", 8080, "set the websocket port")
-
 func main() {
 	Run()
 }
@@ -26,11 +44,23 @@ func main() {
 //export Run
 func Run() {
 
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[0]+" export", os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatalf("导出失败: %v", err)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("读取设定时出现错误: %v", err)
+	}
 
 	log.Infof("biligo-live-ws v%v", updater.VersionTag)
 
-	if *release {
+	if cfg.Server.Release {
 		gin.SetMode(gin.ReleaseMode)
 		log.SetLevel(log.InfoLevel)
 	} else {
@@ -38,6 +68,12 @@ func Run() {
 		log.Debug("启动debug模式")
 	}
 
+	database.Setup(cfg.Database)
+	api.Setup(cfg.Api)
+	blive.Setup(cfg.Live)
+	webhook.Setup(cfg.Webhook)
+	replay.Setup(cfg.WebSocket.ReplaySize)
+
 	log.Info("正在初始化数据库...")
 	if err := database.StartDB(); err != nil {
 		log.Fatalf("初始化数据库时出现严重错误: %v", err)
@@ -45,9 +81,25 @@ func Run() {
 		log.Info("数据库已成功初始化。")
 	}
 
+	if err := alert.Load(); err != nil {
+		log.Errorf("载入提醒规则时出现错误: %v", err)
+	}
+
+	if err := notify.Load(); err != nil {
+		log.Errorf("载入开播通知时出现错误: %v", err)
+	}
+
+	if cfg.WebSocket.ReplayPersist {
+		if err := replay.Load(); err != nil {
+			log.Errorf("恢复讯息缓冲时出现错误: %v", err)
+		}
+	}
+
+	blive.StartSaver(cfg.Sink, cfg.Postgres)
+
 	router := gin.New()
 
-	if os.Getenv("NO_LISTENING_LOG") == "true" {
+	if cfg.Server.NoListeningLog {
 		router.Use(func(c *gin.Context) {
 			if strings.HasPrefix(c.Request.URL.Path, "/listening") {
 				c.Next()
@@ -57,7 +109,7 @@ func Run() {
 		})
 	}
 
-	if os.Getenv("RESET_LOW_LATENCY") == "true" {
+	if cfg.Live.ResetLowLatency {
 		go api.ResetAllLowLatency()
 	}
 
@@ -68,18 +120,54 @@ func Run() {
 	router.POST("validate", ValidateProcess)
 
 	subscribe.Register(router.Group("subscribe"))
-	ws.Register(router.Group("ws"))
+	ws.Register(router.Group("ws"), cfg.WebSocket)
+	ws.RegisterSSE(router.Group("sse"))
 	listening.Register(router.Group("listening"))
-
-	port := fmt.Sprintf(":%d", *port)
+	history.Register(router.Group("history"))
+	sessions.Register(router.Group("sessions"))
+	search.Register(router.Group("search"))
+	viewers.Register(router.Group("viewers"))
+	stats.Register(router.Group("stats"))
+	leaderboards.Register(router.Group("leaderboards"))
+	admin := AdminAuth(cfg.Server.AdminToken)
+	alerts.Register(router.Group("alerts", admin))
+	notifications.Register(router.Group("notifications", admin))
+	webhooks.Register(router.Group("webhooks", admin))
+
+	port := fmt.Sprintf(":%d", cfg.Server.Port)
 
 	log.Infof("使用端口 %s\n", port)
 
-	go debugServe()
+	if cfg.Server.DebugAddr != "" {
+		go debugServe(cfg.Server.DebugAddr)
+	}
 	go updater.StartUpdater()
 
-	if err := router.Run(port); err != nil {
-		log.Fatal(err)
+	server := &http.Server{Addr: port, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Info("正在关闭服务...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("关闭 HTTP 服务时错误: %v", err)
+	}
+
+	blive.StopSaver()
+
+	if cfg.WebSocket.ReplayPersist {
+		if err := replay.Save(); err != nil {
+			log.Errorf("保存讯息缓冲时出现错误: %v", err)
+		}
 	}
 
 	if err := database.CloseDB(); err != nil {
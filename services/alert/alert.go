@@ -0,0 +1,347 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	live "github.com/eric2788/biligo-live"
+	"github.com/eric2788/biligo-live-ws/services/database"
+	"github.com/eric2788/biligo-live-ws/services/webhook"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Event 推送提醒时的事件名称
+const Event = "alert"
+
+// dbPrefix 规则在缓存数据库中的键前缀
+const dbPrefix = "alert:"
+
+var (
+	log = logrus.WithField("service", "alert")
+
+	ErrNotFound = errors.New("规则不存在")
+
+	mu    sync.RWMutex
+	rules = make(map[string]*compiled)
+)
+
+// Rule 提醒规则，设定的条件须全部符合才会推送
+type Rule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Rooms 只检查这些房间，为空则检查所有房间
+	Rooms []int64 `json:"rooms,omitempty"`
+	// Keywords 内容包含其中一个关键字 (不区分大小写)
+	Keywords []string `json:"keywords,omitempty"`
+	// Regex 内容符合此正则表达式
+	Regex string `json:"regex,omitempty"`
+	// UIDs 发送者为其中一人
+	UIDs []int64 `json:"uids,omitempty"`
+	// MinSuperChat SC 金额不少于此数值 (元)，设定后只检查 SC
+	MinSuperChat int64 `json:"min_super_chat,omitempty"`
+	// Cooldown 同一规则两次推送的最少间隔 (秒)，避免刷屏时大量推送
+	Cooldown int64          `json:"cooldown,omitempty"`
+	Webhook  webhook.Target `json:"webhook"`
+
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// ValidationError 规则的内容无效
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// Message 用于比对规则的弹幕或 SC
+type Message struct {
+	RoomId int64  `json:"room_id"`
+	Type   string `json:"type"`
+	UID    int64  `json:"uid"`
+	Uname  string `json:"username"`
+	Text   string `json:"message"`
+	// Price SC 的金额 (元)
+	Price int64 `json:"price,omitempty"`
+	Time  int64 `json:"time"`
+}
+
+// Alert 推送的内容
+type Alert struct {
+	Event   string   `json:"event"`
+	RuleID  string   `json:"rule_id"`
+	Rule    string   `json:"rule_name"`
+	Message *Message `json:"message"`
+}
+
+type compiled struct {
+	*Rule
+	regex    *regexp.Regexp
+	keywords []string
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// Validate 检查规则是否有效
+func (r *Rule) Validate() error {
+	if len(r.Keywords) == 0 && r.Regex == "" && len(r.UIDs) == 0 && r.MinSuperChat <= 0 {
+		return &ValidationError{"须至少设定 keywords, regex, uids 或 min_super_chat 其中一项"}
+	}
+	if r.MinSuperChat < 0 || r.Cooldown < 0 {
+		return &ValidationError{"min_super_chat 和 cooldown 不可为负数"}
+	}
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			return &ValidationError{fmt.Sprintf("regex 无效: %v", err)}
+		}
+	}
+	if err := webhook.CheckURL(r.Webhook.URL); err != nil {
+		return &ValidationError{err.Error()}
+	}
+	return nil
+}
+
+func compile(r *Rule) *compiled {
+	c := &compiled{Rule: r}
+	if r.Regex != "" {
+		c.regex = regexp.MustCompile(r.Regex)
+	}
+	for _, k := range r.Keywords {
+		if k = strings.TrimSpace(k); k != "" {
+			c.keywords = append(c.keywords, strings.ToLower(k))
+		}
+	}
+	return c
+}
+
+// Match 检查讯息是否符合规则
+func (c *compiled) Match(m *Message) bool {
+	if !c.Enabled {
+		return false
+	}
+	if len(c.Rooms) > 0 && !contains(c.Rooms, m.RoomId) {
+		return false
+	}
+	if len(c.UIDs) > 0 && !contains(c.UIDs, m.UID) {
+		return false
+	}
+	if c.MinSuperChat > 0 && (m.Type != "super_chat" || m.Price < c.MinSuperChat) {
+		return false
+	}
+	if len(c.keywords) > 0 {
+		text := strings.ToLower(m.Text)
+		found := false
+		for _, k := range c.keywords {
+			if strings.Contains(text, k) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.regex != nil && !c.regex.MatchString(m.Text) {
+		return false
+	}
+	return true
+}
+
+// cooldown 检查是否仍在冷却中，否则记录这次推送的时间
+func (c *compiled) cooldown(now time.Time) bool {
+	if c.Cooldown <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.last) < time.Duration(c.Cooldown)*time.Second {
+		return true
+	}
+	c.last = now
+	return false
+}
+
+func contains(list []int64, v int64) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Load 从缓存数据库读取所有规则，须在数据库启动后调用
+func Load() error {
+	loaded := make(map[string]*compiled)
+	err := database.UpdateDB(func(db *leveldb.Transaction) error {
+		iter := db.NewIterator(util.BytesPrefix([]byte(dbPrefix)), nil)
+		defer iter.Release()
+		for iter.Next() {
+			r := &Rule{}
+			if err := json.Unmarshal(iter.Value(), r); err != nil {
+				log.Errorf("尝试 decode %v 的数据时错误: %v, 已略过", string(iter.Key()), err)
+				continue
+			}
+			if err := r.Validate(); err != nil {
+				log.Errorf("规则 %v 无效: %v, 已略过", r.ID, err)
+				continue
+			}
+			loaded[r.ID] = compile(r)
+		}
+		return iter.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	rules = loaded
+	mu.Unlock()
+
+	log.Infof("已载入 %v 条提醒规则。", len(loaded))
+	return nil
+}
+
+// List 返回所有规则，按建立时间排列
+func List() []*Rule {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]*Rule, 0, len(rules))
+	for _, c := range rules {
+		list = append(list, c.Rule)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt < list[j].CreatedAt
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Get 返回规则
+func Get(id string) (*Rule, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := rules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return c.Rule, nil
+}
+
+// Put 新增或更新规则并保存，r.ID 为空时新增
+func Put(r *Rule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now().Unix()
+	if r.ID == "" {
+		r.ID = newID()
+		r.CreatedAt = now
+	} else if old, ok := rules[r.ID]; ok {
+		r.CreatedAt = old.CreatedAt
+	} else {
+		return ErrNotFound
+	}
+	r.UpdatedAt = now
+
+	if err := database.PutToDB(dbPrefix+r.ID, r); err != nil {
+		return err
+	}
+	rules[r.ID] = compile(r)
+	return nil
+}
+
+// Delete 删除规则
+func Delete(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := rules[id]; !ok {
+		return ErrNotFound
+	}
+	err := database.UpdateDB(func(db *leveldb.Transaction) error {
+		return db.Delete([]byte(dbPrefix+id), nil)
+	})
+	if err != nil {
+		return err
+	}
+	delete(rules, id)
+	return nil
+}
+
+// Evaluate 以所有规则检查房间收到的讯息，符合时推送到规则的 webhook
+func Evaluate(room int64, msg live.Msg) {
+	mu.RLock()
+	empty := len(rules) == 0
+	mu.RUnlock()
+	if empty {
+		return
+	}
+
+	m := parse(room, msg)
+	if m == nil {
+		return
+	}
+
+	var matched []*compiled
+	mu.RLock()
+	for _, c := range rules {
+		if c.Match(m) {
+			matched = append(matched, c)
+		}
+	}
+	mu.RUnlock()
+
+	now := time.Now()
+	for _, c := range matched {
+		if c.cooldown(now) {
+			continue
+		}
+		alert := &Alert{Event: Event, RuleID: c.ID, Rule: c.Name, Message: m}
+		if _, err := webhook.Send(c.Webhook, Event, alert); err != nil {
+			log.Warnf("推送规则 %v 的提醒时出现错误: %v", c.ID, err)
+		}
+	}
+}
+
+// parse 将弹幕及 SC 转换为 Message，其他讯息返回 nil
+func parse(room int64, msg live.Msg) *Message {
+	switch msg := msg.(type) {
+	case *live.MsgDanmaku:
+		dm, err := msg.Parse()
+		if err != nil {
+			return nil
+		}
+		return &Message{RoomId: room, Type: "danmaku", UID: dm.MID, Uname: dm.Uname, Text: dm.Content, Time: dm.Time / 1000}
+
+	// SC_JPN 与 SC 重复推送，只检查 SC
+	case *live.MsgSuperChatMessage:
+		dm, err := msg.Parse()
+		if err != nil {
+			return nil
+		}
+		return &Message{RoomId: room, Type: "super_chat", UID: dm.UID, Uname: dm.UserInfo.Uname, Text: dm.Message, Price: int64(dm.Price), Time: dm.StartTime}
+	}
+	return nil
+}
+
+func newID() string {
+	return fmt.Sprintf("%x", time.Now().UnixNano())
+}
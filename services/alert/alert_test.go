@@ -0,0 +1,47 @@
+package alert
+
+import (
+	"testing"
+
+	"github.com/eric2788/biligo-live-ws/services/webhook"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestValidate(t *testing.T) {
+	target := webhook.Target{URL: "https://example.com/hook"}
+
+	_, ok := (&Rule{Webhook: target}).Validate().(*ValidationError)
+	assert.Equal(t, ok, true)
+	_, ok = (&Rule{Regex: "(", Webhook: target}).Validate().(*ValidationError)
+	assert.Equal(t, ok, true)
+	_, ok = (&Rule{Keywords: []string{"a"}, Webhook: webhook.Target{URL: "ftp://example.com"}}).Validate().(*ValidationError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, (&Rule{UIDs: []int64{1}, Webhook: target}).Validate(), nil)
+}
+
+func TestMatch(t *testing.T) {
+	danmaku := &Message{RoomId: 545, Type: "danmaku", UID: 1, Text: "Hello World"}
+	sc := &Message{RoomId: 545, Type: "super_chat", UID: 2, Text: "感谢", Price: 100}
+
+	keyword := compile(&Rule{Enabled: true, Keywords: []string{"hello", "bye"}})
+	assert.Equal(t, keyword.Match(danmaku), true)
+	assert.Equal(t, keyword.Match(sc), false)
+
+	regex := compile(&Rule{Enabled: true, Regex: `^感谢$`})
+	assert.Equal(t, regex.Match(danmaku), false)
+	assert.Equal(t, regex.Match(sc), true)
+
+	price := compile(&Rule{Enabled: true, MinSuperChat: 50})
+	assert.Equal(t, price.Match(danmaku), false)
+	assert.Equal(t, price.Match(sc), true)
+	assert.Equal(t, compile(&Rule{Enabled: true, MinSuperChat: 500}).Match(sc), false)
+
+	// 所有条件须同时符合
+	both := compile(&Rule{Enabled: true, UIDs: []int64{1}, Keywords: []string{"world"}, Rooms: []int64{545}})
+	assert.Equal(t, both.Match(danmaku), true)
+	assert.Equal(t, both.Match(&Message{RoomId: 546, UID: 1, Text: "world"}), false)
+	assert.Equal(t, both.Match(&Message{RoomId: 545, UID: 3, Text: "world"}), false)
+
+	disabled := compile(&Rule{Keywords: []string{"hello"}})
+	assert.Equal(t, disabled.Match(danmaku), false)
+}
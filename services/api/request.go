@@ -3,8 +3,20 @@ package api
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/eric2788/biligo-live-ws/config"
 )
 
+var settings = config.Default().Api
+
+var client = &http.Client{Timeout: settings.Timeout}
+
+// Setup 按设定更新 B站 API 的请求方式
+func Setup(cfg config.Api) {
+	settings = cfg
+	client = &http.Client{Timeout: cfg.Timeout}
+}
+
 func getWithAgent(url string, args ...interface{}) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(url, args...), nil)
 	if err != nil {
@@ -12,6 +24,6 @@ func getWithAgent(url string, args ...interface{}) (*http.Response, error) {
 	}
 	req.Header.Set("Origin", "https://live.bilibili.com")
 	req.Header.Set("Referer", "https://live.bilibili.com/")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	return http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", settings.UserAgent)
+	return client.Do(req)
 }
@@ -2,6 +2,7 @@ package blive
 
 import (
 	"errors"
+	"time"
 
 	"github.com/eric2788/biligo-live-ws/services/api"
 )
@@ -43,6 +44,7 @@ func UpdateLiveInfo(info *LiveInfo, room int64) {
 		info.Cover = latestRoomInfo.Data.UserCover
 		info.Title = latestRoomInfo.Data.Title
 		info.UID = latestRoomInfo.Data.Uid
+		info.LiveTime = parseLiveTime(latestRoomInfo.Data)
 		log.Debugf("房间直播资讯 %v 刷新成功。", room)
 	} else {
 		if err != nil {
@@ -94,6 +96,7 @@ func GetLiveInfoCache(room int64) (*LiveInfo, error) {
 		Cover:           data.UserCover,
 		UserFace:        user.Data.Face,
 		UserDescription: user.Data.Sign,
+		LiveTime:        parseLiveTime(data),
 	}
 
 	return liveInfo, nil
@@ -166,8 +169,24 @@ func GetLiveInfo(room int64) (*LiveInfo, error) {
 		Cover:           data.UserCover,
 		UserFace:        user.Data.Face,
 		UserDescription: user.Data.Sign,
+		LiveTime:        parseLiveTime(data),
 	}
 
 	return liveInfo, nil
 
 }
+
+// cst 开播时间使用的时区
+var cst = time.FixedZone("CST", 8*60*60)
+
+// parseLiveTime 返回房间本场直播的开播时间，未开播或无法解析时返回 0
+func parseLiveTime(data *api.RoomInfoData) int64 {
+	if data.LiveStatus != 1 {
+		return 0
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", data.LiveTime, cst)
+	if err != nil || t.Unix() <= 0 {
+		return 0
+	}
+	return t.Unix()
+}
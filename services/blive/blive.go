@@ -6,12 +6,19 @@ import (
 	"time"
 
 	live "github.com/eric2788/biligo-live"
+	"github.com/eric2788/biligo-live-ws/config"
 	"github.com/eric2788/biligo-live-ws/services/subscriber"
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.WithField("service", "blive")
 var stopMap = sync.Map{}
+var settings config.Live
+
+// Setup 设定B站直播的连接方式，须在 SubscribedRoomTracker 前调用
+func Setup(cfg config.Live) {
+	settings = cfg
+}
 
 func SubscribedRoomTracker(handleWs func(int64, *LiveInfo, live.Msg)) {
 	log.Info("已启动房间订阅监听。")
@@ -0,0 +1,145 @@
+package blive
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/services/database"
+)
+
+const (
+	// superChatTTL SC 最长显示两小时，期间可能重复推送
+	superChatTTL = 3 * time.Hour
+	// superChatCapacity 最多记住的 SC 数量，超过时先移除最久未见的
+	superChatCapacity = 10000
+	superChatDbKey    = "dedupe:superchat"
+)
+
+// superChats SC 和 SC_JPN 共用的去重记录，只由保存弹幕的 goroutine 读写
+var superChats = newDedupe(superChatCapacity, superChatTTL)
+
+// dedupe 有过期时间和数量上限的去重记录
+type dedupe struct {
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	// order 由新到旧排列，再次出现时移到最前并延长有效期，因此同时按过期时间排列
+	order *list.List
+	items map[string]*list.Element
+
+	// key 保存到缓存数据库的键，为空则不保存
+	key   string
+	dirty bool
+}
+
+type dedupeEntry struct {
+	Key    string `json:"key"`
+	Expire int64  `json:"expire"`
+}
+
+func newDedupe(capacity int, ttl time.Duration) *dedupe {
+	return &dedupe{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Seen 返回 key 是否在有效期内出现过，未出现过则记录下来，出现过则重新计算有效期
+func (d *dedupe) Seen(key string) bool {
+	now := d.now()
+	d.expire(now)
+
+	expire := now.Add(d.ttl).UnixMilli()
+	d.dirty = true
+
+	if e, ok := d.items[key]; ok {
+		e.Value.(*dedupeEntry).Expire = expire
+		d.order.MoveToFront(e)
+		return true
+	}
+
+	d.add(dedupeEntry{Key: key, Expire: expire})
+	return false
+}
+
+// Len 返回记录数量
+func (d *dedupe) Len() int {
+	return d.order.Len()
+}
+
+func (d *dedupe) add(entry dedupeEntry) {
+	d.items[entry.Key] = d.order.PushFront(&entry)
+	for d.order.Len() > d.capacity {
+		d.remove(d.order.Back())
+	}
+}
+
+func (d *dedupe) remove(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.items, e.Value.(*dedupeEntry).Key)
+}
+
+// expire 从最旧的记录开始移除已过期的记录，遇到未过期的记录即停止
+func (d *dedupe) expire(now time.Time) {
+	ms := now.UnixMilli()
+	for e := d.order.Back(); e != nil && e.Value.(*dedupeEntry).Expire <= ms; e = d.order.Back() {
+		d.remove(e)
+		d.dirty = true
+	}
+}
+
+// entries 返回未过期的记录，由旧到新排列
+func (d *dedupe) entries() []dedupeEntry {
+	d.expire(d.now())
+	entries := make([]dedupeEntry, 0, d.order.Len())
+	for e := d.order.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, *e.Value.(*dedupeEntry))
+	}
+	return entries
+}
+
+// restore 还原由 entries 返回的记录，按过期时间由旧到新加入
+func (d *dedupe) restore(entries []dedupeEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Expire < entries[j].Expire
+	})
+	for _, entry := range entries {
+		if _, ok := d.items[entry.Key]; ok {
+			continue
+		}
+		d.add(entry)
+	}
+	d.expire(d.now())
+}
+
+// load 从缓存数据库读取上次保存的记录，之后 save 会保存到同一个键
+func (d *dedupe) load(key string) {
+	d.key = key
+
+	var entries []dedupeEntry
+	if err := database.GetFromDB(key, &entries); err != nil {
+		if _, ok := err.(*database.EmptyError); !ok {
+			log.Warnf("读取去重记录 %v 时错误: %v", key, err)
+		}
+		return
+	}
+	d.restore(entries)
+	log.Debugf("已读取 %v 条去重记录 %v", d.Len(), key)
+}
+
+// save 有变更时保存到缓存数据库
+func (d *dedupe) save() {
+	if d.key == "" || !d.dirty {
+		return
+	}
+	if err := database.PutToDB(d.key, d.entries()); err != nil {
+		log.Warnf("保存去重记录 %v 时错误: %v", d.key, err)
+		return
+	}
+	d.dirty = false
+}
@@ -0,0 +1,96 @@
+package blive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/services/database"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestDedupeExpire(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newDedupe(10, time.Minute)
+	d.now = func() time.Time { return now }
+
+	assert.Equal(t, d.Seen("1"), false)
+	assert.Equal(t, d.Seen("1"), true)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, d.Seen("1"), false)
+	assert.Equal(t, d.Len(), 1)
+}
+
+func TestDedupeRefresh(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newDedupe(10, time.Minute)
+	d.now = func() time.Time { return now }
+
+	d.Seen("1")
+	d.Seen("2")
+
+	// 再次出现时重新计算有效期
+	now = now.Add(50 * time.Second)
+	assert.Equal(t, d.Seen("1"), true)
+
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, d.Seen("1"), true)
+	assert.Equal(t, d.Len(), 1)
+	assert.Equal(t, d.Seen("2"), false)
+
+	// 记录按过期时间由旧到新排列
+	entries := d.entries()
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[0].Key, "1")
+	assert.Equal(t, entries[1].Key, "2")
+	assert.Equal(t, entries[0].Expire <= entries[1].Expire, true)
+}
+
+func TestDedupeRestoreOrder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newDedupe(10, time.Minute)
+	d.now = func() time.Time { return now }
+
+	d.restore([]dedupeEntry{
+		{Key: "late", Expire: now.Add(50 * time.Second).UnixMilli()},
+		{Key: "early", Expire: now.Add(10 * time.Second).UnixMilli()},
+		{Key: "expired", Expire: now.UnixMilli()},
+	})
+	assert.Equal(t, d.Len(), 2)
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, d.Seen("early"), false)
+	assert.Equal(t, d.Seen("late"), true)
+}
+
+func TestDedupeCapacity(t *testing.T) {
+	d := newDedupe(2, time.Hour)
+
+	d.Seen("1")
+	d.Seen("2")
+	// 再次出现的记录视为最近使用
+	d.Seen("1")
+	d.Seen("3")
+
+	assert.Equal(t, d.Len(), 2)
+	assert.Equal(t, d.Seen("1"), true)
+	assert.Equal(t, d.Seen("2"), false)
+}
+
+func TestDedupePersist(t *testing.T) {
+	// 缓存数据库已在 live_server_test.go 的 init 开启
+	key := "dedupe:test"
+	_ = database.PutToDB(key, []dedupeEntry{})
+
+	d := newDedupe(10, time.Hour)
+	d.load(key)
+	d.Seen("1")
+	d.Seen("2")
+	d.save()
+
+	restored := newDedupe(10, time.Hour)
+	restored.load(key)
+	assert.Equal(t, restored.Len(), 2)
+	assert.Equal(t, restored.Seen("2"), true)
+	assert.Equal(t, restored.Seen("3"), false)
+}
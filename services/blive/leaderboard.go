@@ -0,0 +1,210 @@
+package blive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 排行榜的排序方式
+const (
+	// BySpend 礼物、上舰和 SC 的总消费
+	BySpend = "spend"
+	// BySuperChat SC 的总金额
+	BySuperChat = "super_chat"
+	// ByDanmaku 弹幕数量
+	ByDanmaku = "danmaku"
+)
+
+// 房间排行榜的时间范围，以北京时间的日期计算并包含今天
+const (
+	WindowDay   = "day"
+	WindowWeek  = "week"
+	WindowMonth = "month"
+	WindowAll   = "all"
+)
+
+var windowDays = map[string]int64{
+	WindowDay:   1,
+	WindowWeek:  7,
+	WindowMonth: 30,
+	WindowAll:   0,
+}
+
+// ErrInvalidLeaderboard 排行榜的参数无效
+var ErrInvalidLeaderboard = errors.New("无效的排行榜参数")
+
+// dayOffset 以北京时间划分日期
+const dayOffset = 8 * 60 * 60
+
+// rollupDay 返回时间所在的日期 (自 1970-01-01 起的天数)，用于 viewer_daily 表
+func rollupDay(t int64) int64 {
+	return (t + dayOffset) / 86400
+}
+
+// LeaderboardQuery 排行榜的查询条件。
+// Rollup 为 true 时从按日汇总的 viewer_daily 表读取，From, To 只精确到日期。
+type LeaderboardQuery struct {
+	RoomId   int64
+	By       string
+	From, To int64
+	Rollup   bool
+	Limit    int
+}
+
+// LeaderboardEntry 排行榜中的一名用户，金额单位为毫元
+type LeaderboardEntry struct {
+	Rank      int    `json:"rank"`
+	UID       int64  `json:"uid"`
+	Uname     string `json:"username"`
+	Danmaku   int64  `json:"danmaku"`
+	Gift      int64  `json:"gift"`
+	Guard     int64  `json:"guard"`
+	SuperChat int64  `json:"super_chat"`
+	Spend     int64  `json:"spend"`
+}
+
+// Leaderboard 排行榜
+type Leaderboard struct {
+	RoomId  int64               `json:"room_id"`
+	Session string              `json:"session,omitempty"`
+	By      string              `json:"by"`
+	Window  string              `json:"window,omitempty"`
+	From    int64               `json:"from"`
+	To      int64               `json:"to"`
+	Entries []*LeaderboardEntry `json:"entries"`
+}
+
+// leaderboardCache 缓存排行榜的结果，已结束的直播场次不会再变更，缓存较久
+var leaderboardCache = struct {
+	sync.Mutex
+	entries map[string]*cachedLeaderboard
+}{entries: make(map[string]*cachedLeaderboard)}
+
+type cachedLeaderboard struct {
+	board   *Leaderboard
+	expires time.Time
+}
+
+const (
+	leaderboardTTL      = 30 * time.Second
+	endedLeaderboardTTL = 10 * time.Minute
+	leaderboardCacheMax = 1000
+)
+
+func cachedBoard(key string) (*Leaderboard, bool) {
+	leaderboardCache.Lock()
+	defer leaderboardCache.Unlock()
+	c, ok := leaderboardCache.entries[key]
+	if !ok || time.Now().After(c.expires) {
+		return nil, false
+	}
+	return c.board, true
+}
+
+func cacheBoard(key string, board *Leaderboard, ttl time.Duration) {
+	leaderboardCache.Lock()
+	defer leaderboardCache.Unlock()
+	now := time.Now()
+	if len(leaderboardCache.entries) >= leaderboardCacheMax {
+		for k, c := range leaderboardCache.entries {
+			if now.After(c.expires) {
+				delete(leaderboardCache.entries, k)
+			}
+		}
+		// 仍然已满时清空
+		if len(leaderboardCache.entries) >= leaderboardCacheMax {
+			leaderboardCache.entries = make(map[string]*cachedLeaderboard)
+		}
+	}
+	leaderboardCache.entries[key] = &cachedLeaderboard{board: board, expires: now.Add(ttl)}
+}
+
+func validLeaderboard(by string, limit int) error {
+	switch by {
+	case BySpend, BySuperChat, ByDanmaku:
+	default:
+		return fmt.Errorf("%w: 排序方式 %q", ErrInvalidLeaderboard, by)
+	}
+	if limit <= 0 {
+		return fmt.Errorf("%w: 数量 %v", ErrInvalidLeaderboard, limit)
+	}
+	return nil
+}
+
+// RoomLeaderboard 返回房间在时间范围内的排行榜
+func RoomLeaderboard(ctx context.Context, room int64, by, window string, limit int) (*Leaderboard, error) {
+	if err := validLeaderboard(by, limit); err != nil {
+		return nil, err
+	}
+	days, ok := windowDays[window]
+	if !ok {
+		return nil, fmt.Errorf("%w: 时间范围 %q", ErrInvalidLeaderboard, window)
+	}
+
+	key := fmt.Sprintf("room:%d:%s:%s:%d", room, by, window, limit)
+	if board, ok := cachedBoard(key); ok {
+		return board, nil
+	}
+
+	querier := sinks.querier()
+	if querier == nil {
+		return nil, ErrNoQuerier
+	}
+
+	now := time.Now().Unix()
+	q := &LeaderboardQuery{RoomId: room, By: by, Rollup: true, To: now, Limit: limit}
+	if days > 0 {
+		// 今天及之前 days-1 天，从当天零点开始
+		q.From = (rollupDay(now)-days+1)*86400 - dayOffset
+	}
+
+	entries, err := querier.QueryLeaderboard(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	board := &Leaderboard{RoomId: room, By: by, Window: window, From: q.From, To: q.To, Entries: entries}
+	cacheBoard(key, board, leaderboardTTL)
+	return board, nil
+}
+
+// SessionLeaderboard 返回直播场次期间的排行榜
+func SessionLeaderboard(ctx context.Context, id, by string, limit int) (*Leaderboard, error) {
+	if err := validLeaderboard(by, limit); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("session:%s:%s:%d", id, by, limit)
+	if board, ok := cachedBoard(key); ok {
+		return board, nil
+	}
+
+	querier := sinks.querier()
+	if querier == nil {
+		return nil, ErrNoQuerier
+	}
+
+	live, err := querier.QuerySession(ctx, id, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &LeaderboardQuery{RoomId: live.RoomId, By: by, From: live.Start, To: live.End, Limit: limit}
+	ttl := endedLeaderboardTTL
+	if live.End <= 0 {
+		q.To = time.Now().Unix()
+		ttl = leaderboardTTL
+	}
+
+	entries, err := querier.QueryLeaderboard(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	board := &Leaderboard{RoomId: live.RoomId, Session: id, By: by, From: q.From, To: q.To, Entries: entries}
+	cacheBoard(key, board, ttl)
+	return board, nil
+}
@@ -9,13 +9,15 @@ import (
 	set "github.com/deckarep/golang-set/v2"
 
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	biligo "github.com/eric2788/biligo-live"
+	"github.com/eric2788/biligo-live-ws/services/alert"
 	"github.com/eric2788/biligo-live-ws/services/api"
+	"github.com/eric2788/biligo-live-ws/services/notify"
+	"github.com/eric2788/biligo-live-ws/services/stats"
 	"github.com/gorilla/websocket"
 )
 
@@ -120,11 +122,11 @@ func LaunchLiveServer(
 	var wsHost = biligo.WsDefaultHost
 
 	// 如果有强制指定 ws host, 則使用
-	if strings.HasPrefix(os.Getenv("BILI_WS_HOST_FORCE"), "wss://") {
+	if strings.HasPrefix(settings.WsHostForce, "wss://") {
 
-		wsHost = os.Getenv("BILI_WS_HOST_FORCE")
+		wsHost = settings.WsHostForce
 
-	} else if os.Getenv("BILI_WS_HOST_FORCE") == "AUTO" { // 否則从 api 获取 host list 並提取低延迟
+	} else if settings.WsHostForce == "AUTO" { // 否則从 api 获取 host list 並提取低延迟
 
 		lowHost := api.GetLowLatencyHost(realRoom, false)
 
@@ -171,6 +173,12 @@ func LaunchLiveServer(
 		enteredRooms.Add(realRoom)
 		defer enteredRooms.Remove(realRoom)
 
+		// 重新连接时恢复中止监听前的直播场次
+		queue_resume_session(liveInfo)
+
+		// 记录目前的直播状态，已在直播时不再推送开播通知
+		notify.Observe(realRoom, liveInfo.LiveTime > 0)
+
 		hbCtx, hbCancel := context.WithCancel(ctx)
 		// 在啟動監聽前先啟動一次heartbeat監聽
 		go listenHeartBeatExpire(realRoom, stop, hbCtx)
@@ -192,18 +200,26 @@ func LaunchLiveServer(
 						// 更新一次直播资讯
 						UpdateLiveInfo(liveInfo, realRoom)
 
-						if os.Getenv("BILI_WS_HOST_FORCE") != "" {
+						if settings.WsHostForce != "" {
 							// 更新一次 WebSocket 資訊
 							go api.UpdateLowLatencyHost(realRoom)
 						}
 
 					}
 
-					// 但开播指令推送多次保留
+					// 但开播指令推送多次保留，开播通知则只推送一次
+					notify.Transition(notifyRoom(liveInfo), true)
+
+				} else if _, ok := tp.Msg.(*biligo.MsgPreparing); ok {
+					room := notifyRoom(liveInfo)
+					room.LiveTime = 0
+					notify.Transition(room, false)
 				}
-				// 使用懸掛防止下一個訊息阻塞等待
-				go handle(liveInfo, tp.Msg)
-				go save_danmaku(tp.Msg.Cmd(), liveInfo, tp.Msg)
+				// 推送只会放入各连接的发送队列而不会阻塞，按顺序调用以保持房间内讯息的顺序
+				handle(liveInfo, tp.Msg)
+				queue_danmaku(liveInfo, tp.Msg)
+				stats.Record(realRoom, tp.Msg)
+				alert.Evaluate(realRoom, tp.Msg)
 
 				// 記錄上一次接收到 Heartbeat 的时間
 				if _, ok := tp.Msg.(*biligo.MsgHeartbeatReply); ok {
@@ -215,6 +231,8 @@ func LaunchLiveServer(
 			case <-ctx.Done():
 				log.Infof("房间 %v 监听中止。\n", realRoom)
 				hbCancel()
+				stats.Remove(realRoom)
+				notify.Forget(realRoom)
 				finished(nil, nil)
 				if realRoom != room {
 					listening.Remove(realRoom)
@@ -234,6 +252,19 @@ func LaunchLiveServer(
 	finished(stop, nil)
 }
 
+// notifyRoom 复制开播通知需要的直播资讯
+func notifyRoom(info *LiveInfo) *notify.Room {
+	return &notify.Room{
+		RoomId:   info.RoomId,
+		UID:      info.UID,
+		Name:     info.Name,
+		Title:    info.Title,
+		Cover:    info.Cover,
+		UserFace: info.UserFace,
+		LiveTime: info.LiveTime,
+	}
+}
+
 func listenHeartBeatExpire(realRoom int64, stop context.CancelFunc, ctx context.Context) {
 	timer := time.NewTimer(time.Minute * 3)
 	defer timer.Stop()
@@ -245,6 +276,7 @@ func listenHeartBeatExpire(realRoom int64, stop context.CancelFunc, ctx context.
 	}
 	// 三分鐘後 heartbeat 依然相同
 	log.Warnf("房間 %v 在三分鐘後依然沒有收到新的 HeartBeat, 已強制終止目前的監聽。", realRoom)
+	queue_end_session(realRoom, EndHeartbeat)
 	stop() // 調用中止監聽
 }
 
@@ -0,0 +1,461 @@
+package blive
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration 一次数据库结构变更
+type migration struct {
+	version int
+	name    string
+	// optional 为 true 时只在启用后执行
+	optional bool
+	up       func(ctx context.Context, tx *sql.Tx, d *sqlDialect) error
+}
+
+const partitionVersion = 3
+
+var migrations = []migration{
+	{version: 1, name: "create_live", up: execFile("create_live")},
+	{version: 2, name: "upgrade_room_tables", up: upgradeRoomTables},
+	{version: partitionVersion, name: "partition_danmaku", optional: true, up: partitionDanmaku},
+	{version: 4, name: "create_live_event", up: execFile("create_live_event")},
+	{version: 5, name: "live_sessions", up: execFile("live_sessions")},
+	{version: 6, name: "typed_danmaku", up: typedDanmaku},
+	{version: 7, name: "danmaku_id", up: danmakuID},
+	{version: 8, name: "search_index", up: searchIndex},
+	{version: 9, name: "viewer_daily", up: viewerDaily},
+	{version: 10, name: "trigram_search", up: trigramSearch},
+}
+
+var roomTablePattern = regexp.MustCompile(`^live_(\d+)$`)
+
+// migrate 执行所有尚未执行的数据库结构变更，并记录到 schema_migrations。
+// 可选的变更只有在 enabled 中列出时才会执行。
+func migrate(db *sql.DB, d *sqlDialect, enabled ...int) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// 防止多个实例同时执行
+	if d.lock != "" {
+		if _, err := conn.ExecContext(ctx, d.lock); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.ExecContext(ctx, d.unlock); err != nil {
+				log.Warnf("[%v] 解除数据库结构变更锁时错误: %v", d.name, err)
+			}
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations(version bigint PRIMARY KEY, name text, applied_at bigint)"); err != nil {
+		return err
+	}
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if m.optional && !containsVersion(enabled, m.version) {
+			continue
+		}
+
+		log.Infof("[%v] 正在执行数据库结构变更 %v: %v", d.name, m.version, m.name)
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := m.up(ctx, tx, d); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("执行数据库结构变更 %v 时错误: %w", m.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations(version, name, applied_at) VALUES ($1, $2, $3)", m.version, m.name, time.Now().Unix()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func containsVersion(versions []int, version int) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// isPartitioned 返回弹幕是否已迁移到分区表 danmaku
+func isPartitioned(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = $1", partitionVersion).Scan(&count)
+	return count > 0, err
+}
+
+// execFile 执行 migrations/<数据库>/<name>.sql
+func execFile(name string) func(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	return func(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+		b, err := migrationFiles.ReadFile(fmt.Sprintf("migrations/%s/%s.sql", d.name, name))
+		if err != nil {
+			return err
+		}
+		for _, stmt := range strings.Split(string(b), ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// queryer 为 *sql.DB 或 *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// roomTables 返回所有 live_<房间号> 表的房间号
+func roomTables(ctx context.Context, tx queryer, d *sqlDialect) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, d.listTables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []int64
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		match := roomTablePattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		room, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i] < rooms[j] })
+	return rooms, rows.Err()
+}
+
+// upgradeRoomTables 为现有的 live_<房间号> 表加上房间号栏位及索引
+func upgradeRoomTables(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	rooms, err := roomTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	for _, room := range rooms {
+		stmts := append([]string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN roomid bigint NOT NULL DEFAULT %d", roomTable(room), room),
+		}, roomIndexes(d, room)...)
+		for _, stmt := range stmts {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// partitionDanmaku 建立以房间号分区的 danmaku 表，并将现有的 live_<房间号> 表挂载为其分区。
+// 挂载后原有的表名依然可用，无需复制数据。
+func partitionDanmaku(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	if err := execFile("partition_danmaku")(ctx, tx, d); err != nil {
+		return err
+	}
+	rooms, err := roomTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	// 分区的栏位须与 danmaku 表相同，是否已执行 typed_danmaku 及 danmaku_id 都统一加上
+	tables := []string{"danmaku"}
+	for _, room := range rooms {
+		tables = append(tables, roomTable(room))
+	}
+	columns := typedColumns
+	if d.idColumn != "" {
+		if _, err := tx.ExecContext(ctx, "CREATE SEQUENCE IF NOT EXISTS danmaku_id_seq"); err != nil {
+			return err
+		}
+		columns = append(columns[:len(columns):len(columns)], d.idColumn)
+	}
+	for _, table := range tables {
+		for _, column := range columns {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, column)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, room := range rooms {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE danmaku ATTACH PARTITION %s FOR VALUES IN (%d)", roomTable(room), room)); err != nil {
+			return err
+		}
+	}
+	// 之后建立的分区只会继承 danmaku 表的索引
+	stmts := []string{
+		"CREATE INDEX IF NOT EXISTS danmaku_time ON danmaku(time)",
+		"CREATE INDEX IF NOT EXISTS danmaku_uid ON danmaku(uid)",
+	}
+	if d.searchIndex != "" {
+		stmts = append(stmts, searchIndexes(d, quoteIdent("danmaku_msg"), "danmaku")...)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typedColumns 弹幕记录的类型及礼物栏位
+var typedColumns = []string{
+	"type text",
+	"gift_id bigint",
+	"gift_name text",
+	"gift_count bigint",
+	"coin_type text",
+	"unit_price bigint",
+	"guard_level integer",
+}
+
+// typedDanmaku 为弹幕表加上类型及礼物栏位，并按旧版本的前缀规则回填现有记录。
+// 已执行 partition_danmaku 时分区表已有这些栏位。
+func typedDanmaku(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	tables, err := danmakuTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		var stmts []string
+		for _, column := range typedColumns {
+			stmts = append(stmts, fmt.Sprintf(d.addColumn, table, column))
+		}
+		stmts = append(stmts,
+			fmt.Sprintf(`UPDATE %s SET
+				type = CASE WHEN msg LIKE '投喂 %%' THEN 'gift' WHEN msg LIKE '赠送 %%' THEN 'guard' WHEN price > 0 THEN 'super_chat' ELSE 'danmaku' END,
+				unit_price = CAST(ROUND(price * 1000) AS bigint)`, table),
+			fmt.Sprintf("UPDATE %s SET gift_name = SUBSTR(msg, 4), gift_count = 1 WHERE type IN ('gift', 'guard')", table),
+			fmt.Sprintf("UPDATE %s SET coin_type = CASE WHEN price > 0 THEN 'gold' ELSE 'silver' END WHERE type = 'gift'", table),
+			fmt.Sprintf("UPDATE %s SET coin_type = 'gold' WHERE type = 'guard'", table),
+		)
+		for _, stmt := range stmts {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// danmakuID 为弹幕表及 live_event 加上唯一递增的 id 栏位，用于分页查询。
+// SQLite 使用内建的 rowid。
+func danmakuID(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	if d.idColumn == "" {
+		return nil
+	}
+	tables, err := danmakuTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	stmts := []string{"CREATE SEQUENCE IF NOT EXISTS danmaku_id_seq"}
+	for _, table := range tables {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, d.idColumn))
+	}
+	stmts = append(stmts, "ALTER TABLE live_event ADD COLUMN IF NOT EXISTS id bigserial")
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchIndex 为弹幕表的内容建立搜索索引，分区表的索引会套用到所有分区
+func searchIndex(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	if d.searchIndex == "" {
+		return nil
+	}
+	tables, err := danmakuTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		name := quoteIdent(strings.Trim(table, `"`) + "_msg")
+		for _, stmt := range searchIndexes(d, name, table) {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trigramSearch 将旧版本以 simple 分词的全文检索索引改为 pg_trgm 的三元组索引，
+// 未分词的中文弹幕也能以子字串搜索
+func trigramSearch(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	if d.searchIndex == "" {
+		return nil
+	}
+	// 先删除分区表的索引，其分区的索引会一同删除
+	stmts := []string{"DROP INDEX IF EXISTS danmaku_msg"}
+	rooms, err := roomTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	for _, room := range rooms {
+		stmts = append(stmts, fmt.Sprintf("DROP INDEX IF EXISTS %s", quoteIdent(fmt.Sprintf("live_%d_msg", room))))
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return searchIndex(ctx, tx, d)
+}
+
+// searchIndexes 返回建立弹幕内容搜索索引的语句
+func searchIndexes(d *sqlDialect, name, table string) []string {
+	var stmts []string
+	if d.searchSetup != "" {
+		stmts = append(stmts, d.searchSetup)
+	}
+	return append(stmts, fmt.Sprintf(d.searchIndex, name, table))
+}
+
+// viewerDaily 建立按房间、日期 (北京时间) 及用户汇总的 viewer_daily 表，并由现有的弹幕回填。
+// 之后每次写入弹幕时在同一事务内更新。
+func viewerDaily(ctx context.Context, tx *sql.Tx, d *sqlDialect) error {
+	stmts := []string{`CREATE TABLE IF NOT EXISTS viewer_daily(
+		roomid     bigint NOT NULL,
+		day        bigint NOT NULL,
+		uid        bigint NOT NULL,
+		username   text,
+		danmaku    bigint NOT NULL DEFAULT 0,
+		gift       bigint NOT NULL DEFAULT 0,
+		guard      bigint NOT NULL DEFAULT 0,
+		super_chat bigint NOT NULL DEFAULT 0,
+		PRIMARY KEY (roomid, day, uid)
+	)`}
+	tables, err := danmakuTables(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO viewer_daily(roomid,day,uid,username,danmaku,gift,guard,super_chat)
+			SELECT roomid, (time + %[2]d) / 86400, uid, MAX(username),
+				COUNT(CASE WHEN type = 'danmaku' THEN 1 END),
+				COALESCE(SUM(CASE WHEN type = 'gift' AND coin_type = 'gold' THEN unit_price * gift_count END), 0),
+				COALESCE(SUM(CASE WHEN type = 'guard' THEN unit_price * gift_count END), 0),
+				COALESCE(SUM(CASE WHEN type = 'super_chat' THEN unit_price END), 0)
+			FROM %[1]s WHERE uid IS NOT NULL AND uid <> 0 AND time IS NOT NULL
+			GROUP BY roomid, (time + %[2]d) / 86400, uid`, table, dayOffset))
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// danmakuTables 返回需要变更栏位的弹幕表，分区表的栏位变更会套用到所有分区
+func danmakuTables(ctx context.Context, tx *sql.Tx, d *sqlDialect) ([]string, error) {
+	partitioned, err := hasTable(ctx, tx, d, "danmaku")
+	if err != nil {
+		return nil, err
+	}
+	if partitioned {
+		return []string{"danmaku"}, nil
+	}
+	rooms, err := roomTables(ctx, tx, d)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, room := range rooms {
+		tables = append(tables, roomTable(room))
+	}
+	return tables, nil
+}
+
+// hasTable 返回数据库中是否有此表
+func hasTable(ctx context.Context, tx *sql.Tx, d *sqlDialect, name string) (bool, error) {
+	rows, err := tx.QueryContext(ctx, d.listTables)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return false, err
+		}
+		if table == name {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// roomIndexes 返回房间弹幕表的索引
+func roomIndexes(d *sqlDialect, room int64) []string {
+	table := roomTable(room)
+	indexes := []string{
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(time)", quoteIdent(fmt.Sprintf("live_%d_time", room)), table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(uid)", quoteIdent(fmt.Sprintf("live_%d_uid", room)), table),
+	}
+	if d.searchIndex != "" {
+		indexes = append(indexes, searchIndexes(d, quoteIdent(fmt.Sprintf("live_%d_msg", room)), table)...)
+	}
+	return indexes
+}
@@ -0,0 +1,165 @@
+package blive
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestMigrateSqlite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "danmaku.db")
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 旧版本建立的弹幕表
+	if _, err := db.Exec("CREATE TABLE live_545(time bigint,uid bigint,username text,msg text,price double precision)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO live_545(time,uid,username,msg,price) VALUES (1,2,'tester','hello',0),(2,3,'tester','投喂 辣条',0.1),(3,4,'tester','赠送 舰长',198)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重复执行不应出错
+	for i := 0; i < 2; i++ {
+		if err := migrate(db, sqliteDialect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var versions int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	required := 0
+	for _, m := range migrations {
+		if !m.optional {
+			required++
+		}
+	}
+	assert.Equal(t, versions, required)
+
+	var roomid int64
+	if err := db.QueryRow("SELECT roomid FROM live_545 WHERE uid = 2").Scan(&roomid); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, roomid, int64(545))
+
+	// 按前缀回填类型及单价
+	var typ, giftName string
+	var unitPrice int64
+	if err := db.QueryRow("SELECT type, gift_name, unit_price FROM live_545 WHERE uid = 3").Scan(&typ, &giftName, &unitPrice); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, typ, TypeGift)
+	assert.Equal(t, giftName, "辣条")
+	assert.Equal(t, unitPrice, int64(100))
+
+	if err := db.QueryRow("SELECT type, unit_price FROM live_545 WHERE uid = 4").Scan(&typ, &unitPrice); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, typ, TypeGuard)
+	assert.Equal(t, unitPrice, int64(198000))
+
+	var indexes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'live_545'").Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, indexes, 2)
+
+	// 按日汇总的用户表由现有弹幕回填
+	var danmaku, guard int64
+	if err := db.QueryRow("SELECT danmaku, guard FROM viewer_daily WHERE roomid = 545 AND uid = 4").Scan(&danmaku, &guard); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, danmaku, int64(0))
+	assert.Equal(t, guard, int64(198000))
+	if err := db.QueryRow("SELECT danmaku FROM viewer_daily WHERE roomid = 545 AND uid = 2").Scan(&danmaku); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, danmaku, int64(1))
+}
+
+// testPostgresDSN 返回以 TEST_POSTGRES_DSN (key=value 格式) 连接 PostgreSQL 的 DSN，
+// 每次调用使用独立的 schema，测试结束后删除。没有设定时略过
+func testPostgresDSN(t *testing.T) string {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN 未设定")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("biligo_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Log(err)
+		}
+		admin.Close()
+	})
+
+	return fmt.Sprintf("%s search_path=%s", dsn, schema)
+}
+
+func TestMigratePostgresPartition(t *testing.T) {
+	db, err := sql.Open("postgres", testPostgresDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 旧版本建立的弹幕表
+	if _, err := db.Exec("CREATE TABLE live_545(time bigint,uid bigint,username text,msg text,price double precision)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO live_545(time,uid,username,msg,price) VALUES (1,2,'tester','hello',0),(3,4,'tester','赠送 舰长',198)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 启用分区表时 partition_danmaku 已加上的栏位不应使之后的结构变更失败
+	for i := 0; i < 2; i++ {
+		if err := migrate(db, postgresDialect, partitionVersion); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var versions int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, versions, len(migrations))
+
+	partitioned, err := isPartitioned(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, partitioned, true)
+
+	var typ string
+	var unitPrice int64
+	if err := db.QueryRow("SELECT type, unit_price FROM danmaku WHERE roomid = 545 AND uid = 4").Scan(&typ, &unitPrice); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, typ, TypeGuard)
+	assert.Equal(t, unitPrice, int64(198000))
+
+	var guard int64
+	if err := db.QueryRow("SELECT guard FROM viewer_daily WHERE roomid = 545 AND uid = 4").Scan(&guard); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, guard, int64(198000))
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS danmaku(
+    roomid   bigint NOT NULL,
+    time     bigint,
+    uid      bigint,
+    username text,
+    msg      text,
+    price    double precision
+) PARTITION BY LIST (roomid);
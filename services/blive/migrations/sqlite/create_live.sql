@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS live(
+    roomid             bigint,
+    username           text,
+    uid                bigint,
+    title              text,
+    cover              text,
+    st                 bigint,
+    sp                 bigint,
+    total              bigint,
+    send_gift          double precision,
+    guard_buy          double precision,
+    super_chat_message double precision
+);
+
+CREATE INDEX IF NOT EXISTS live_roomid_st ON live(roomid, st);
+CREATE INDEX IF NOT EXISTS live_st ON live(st);
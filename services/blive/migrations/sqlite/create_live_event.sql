@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS live_event(
+    roomid  bigint NOT NULL,
+    time    bigint NOT NULL,
+    cmd     text   NOT NULL,
+    uid     bigint,
+    payload text
+);
+
+CREATE INDEX IF NOT EXISTS live_event_roomid_time ON live_event(roomid, time);
+CREATE INDEX IF NOT EXISTS live_event_cmd_time ON live_event(cmd, time);
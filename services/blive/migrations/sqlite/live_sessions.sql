@@ -0,0 +1,9 @@
+ALTER TABLE live ADD COLUMN id text;
+ALTER TABLE live ADD COLUMN chatters bigint;
+ALTER TABLE live ADD COLUMN peak_popularity bigint;
+ALTER TABLE live ADD COLUMN end_reason text;
+
+UPDATE live SET id = CAST(roomid AS text) || '-' || CAST(st AS text);
+UPDATE live SET end_reason = 'preparing' WHERE sp IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS live_id ON live(id);
@@ -0,0 +1,161 @@
+package blive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoQuerier 没有可以查询弹幕记录的 Sink
+	ErrNoQuerier = errors.New("没有可查询的弹幕数据库")
+	// ErrSessionNotFound 直播场次不存在
+	ErrSessionNotFound = errors.New("直播场次不存在")
+)
+
+// HistoryQuery 弹幕记录的查询条件，为零值的条件不作筛选
+type HistoryQuery struct {
+	RoomId int64
+	// From, To 时间范围 (秒)，包含两端
+	From, To int64
+	UID      int64
+	// Types 弹幕记录的类型，例如 danmaku, gift
+	Types []string
+	// Cmds 不为空时查询 live_event 中的指令
+	Cmds    []string
+	Keyword string
+	// Cursor 上一页返回的游标
+	Cursor string
+	// Limit 最多返回的数量，0 为不限
+	Limit int
+}
+
+// Record 查询返回的弹幕记录
+type Record struct {
+	ID int64 `json:"id"`
+	Event
+}
+
+// SessionQuery 直播场次的查询条件，为零值的条件不作筛选
+type SessionQuery struct {
+	RoomId int64
+	// From, To 开播时间范围 (秒)，包含两端
+	From, To      int64
+	Limit, Offset int
+}
+
+// SessionSummary 直播场次的摘要
+type SessionSummary struct {
+	*Session
+	// Duration 直播时长 (秒)，进行中的直播计算到目前为止
+	Duration int64 `json:"duration"`
+	// Revenue 总收入 (毫元)
+	Revenue     int64     `json:"revenue"`
+	TopChatters []*Viewer `json:"top_chatters,omitempty"`
+	TopGifters  []*Viewer `json:"top_gifters,omitempty"`
+}
+
+// Viewer 直播场次中的观众排行
+type Viewer struct {
+	UID   int64  `json:"uid"`
+	Uname string `json:"username"`
+	// Count 弹幕或送礼次数
+	Count int64 `json:"count"`
+	// Revenue 贡献的收入 (毫元)
+	Revenue int64 `json:"revenue"`
+}
+
+func summarize(s *Session) *SessionSummary {
+	end := s.End
+	if end <= 0 {
+		end = time.Now().Unix()
+	}
+	return &SessionSummary{
+		Session:  s,
+		Duration: end - s.Start,
+		Revenue:  s.Gift + s.Guard + s.SuperChat,
+	}
+}
+
+// Querier 由可以查询弹幕记录的 Sink 实现
+type Querier interface {
+	// QueryHistory 按时间顺序将符合条件的记录逐条交给 fn，返回下一页的游标，没有下一页时为空
+	QueryHistory(ctx context.Context, q *HistoryQuery, fn func(*Record) error) (string, error)
+	// QuerySessions 按开播时间由新到旧返回直播场次
+	QuerySessions(ctx context.Context, q *SessionQuery) ([]*Session, error)
+	// QuerySession 返回直播场次的摘要及前 top 名的弹幕用户和送礼用户，top 为 0 时不查询排行
+	QuerySession(ctx context.Context, id string, top int) (*SessionSummary, error)
+	// QueryViewer 返回用户在所有房间的活动统计
+	QueryViewer(ctx context.Context, uid int64) (*ViewerProfile, error)
+	// QueryLeaderboard 返回按 q.By 由高到低排列的用户
+	QueryLeaderboard(ctx context.Context, q *LeaderboardQuery) ([]*LeaderboardEntry, error)
+}
+
+// QueryHistory 从保存弹幕的 Sink 查询弹幕记录
+func QueryHistory(ctx context.Context, q *HistoryQuery, fn func(*Record) error) (string, error) {
+	querier := sinks.querier()
+	if querier == nil {
+		return "", ErrNoQuerier
+	}
+	return querier.QueryHistory(ctx, q, fn)
+}
+
+// QuerySessions 查询直播场次的摘要
+func QuerySessions(ctx context.Context, q *SessionQuery) ([]*SessionSummary, error) {
+	querier := sinks.querier()
+	if querier == nil {
+		return nil, ErrNoQuerier
+	}
+	lives, err := querier.QuerySessions(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]*SessionSummary, len(lives))
+	for i, live := range lives {
+		summaries[i] = summarize(live)
+	}
+	return summaries, nil
+}
+
+// QuerySession 查询直播场次的摘要及排行
+func QuerySession(ctx context.Context, id string, top int) (*SessionSummary, error) {
+	querier := sinks.querier()
+	if querier == nil {
+		return nil, ErrNoQuerier
+	}
+	return querier.QuerySession(ctx, id, top)
+}
+
+// historyCursor 游标为最后一条记录的时间及 id
+type historyCursor struct {
+	time int64
+	id   int64
+}
+
+func (c historyCursor) String() string {
+	return fmt.Sprintf("%d_%d", c.time, c.id)
+}
+
+func parseCursor(s string) (historyCursor, error) {
+	parts := strings.SplitN(s, "_", 2)
+	if len(parts) != 2 {
+		return historyCursor{}, fmt.Errorf("无效的游标: %q", s)
+	}
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return historyCursor{}, fmt.Errorf("无效的游标: %q", s)
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return historyCursor{}, fmt.Errorf("无效的游标: %q", s)
+	}
+	return historyCursor{time: t, id: id}, nil
+}
+
+// escapeLike 转义 LIKE 的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,286 @@
+package blive
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestSqliteQueryHistory(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	events := []Event{
+		{RoomId: 545, Time: 100, UID: 1, Uname: "a", Msg: "早上好", Type: TypeDanmaku},
+		{RoomId: 545, Time: 100, UID: 2, Uname: "b", Msg: "100%好", Type: TypeDanmaku},
+		{RoomId: 545, Time: 101, UID: 1, Uname: "a", Msg: "投喂 辣条", Type: TypeGift, GiftName: "辣条", GiftCount: 1, UnitPrice: 100},
+		{RoomId: 545, Time: 102, UID: 1, Uname: "a", Msg: "晚上好", Type: TypeDanmaku},
+		{RoomId: 545, Time: 103, UID: 3, Cmd: "GUARD_BUY", Payload: json.RawMessage(`{"cmd":"GUARD_BUY"}`)},
+		{RoomId: 546, Time: 100, UID: 1, Uname: "a", Msg: "别的房间", Type: TypeDanmaku},
+	}
+	for i := range events {
+		if err := sink.Write(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(q HistoryQuery) ([]*Record, string) {
+		var records []*Record
+		next, err := sink.QueryHistory(context.Background(), &q, func(r *Record) error {
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records, next
+	}
+
+	// 按游标分页读取全部记录
+	var msgs []string
+	q := HistoryQuery{RoomId: 545, Limit: 2}
+	for {
+		records, next := query(q)
+		for _, r := range records {
+			msgs = append(msgs, r.Msg)
+		}
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	assert.Equal(t, msgs, []string{"早上好", "100%好", "投喂 辣条", "晚上好"})
+
+	records, _ := query(HistoryQuery{RoomId: 545, UID: 1, Types: []string{TypeDanmaku}, From: 101})
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, records[0].Msg, "晚上好")
+
+	// 关键字中的通配符按字面匹配
+	records, _ = query(HistoryQuery{RoomId: 545, Keyword: "%"})
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, records[0].UID, int64(2))
+
+	records, _ = query(HistoryQuery{RoomId: 545, Types: []string{TypeGift}})
+	assert.Equal(t, records[0].GiftName, "辣条")
+	assert.Equal(t, records[0].UnitPrice, int64(100))
+
+	records, _ = query(HistoryQuery{RoomId: 545, Cmds: []string{"GUARD_BUY"}})
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, string(records[0].Payload), `{"cmd":"GUARD_BUY"}`)
+
+	// 没有记录的房间
+	records, next := query(HistoryQuery{RoomId: 547})
+	assert.Equal(t, len(records), 0)
+	assert.Equal(t, next, "")
+
+	_, err = sink.QueryHistory(context.Background(), &HistoryQuery{RoomId: 545, Cursor: "abc"}, func(*Record) error { return nil })
+	assert.NotEqual(t, err, nil)
+}
+
+func TestSqliteQuerySessions(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	first := newSession(&LiveInfo{RoomId: 545, Name: "tester"}, 100)
+	second := newSession(&LiveInfo{RoomId: 545, Name: "tester"}, 200)
+	other := newSession(&LiveInfo{RoomId: 546}, 150)
+	for _, live := range []*Session{first, second, other} {
+		if err := sink.StartLive(live); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := []Event{
+		{RoomId: 545, Time: 101, UID: 1, Uname: "a", Msg: "1", Type: TypeDanmaku},
+		{RoomId: 545, Time: 102, UID: 1, Uname: "a", Msg: "2", Type: TypeDanmaku},
+		{RoomId: 545, Time: 103, UID: 2, Uname: "b", Msg: "3", Type: TypeDanmaku},
+		{RoomId: 545, Time: 104, UID: 2, Uname: "b", Type: TypeGift, GiftCount: 2, CoinType: "gold", UnitPrice: 1000},
+		{RoomId: 545, Time: 105, UID: 3, Uname: "c", Type: TypeGift, GiftCount: 5, CoinType: "silver", UnitPrice: 1000},
+		{RoomId: 545, Time: 106, UID: 3, Uname: "c", Type: TypeSuperChat, UnitPrice: 30000},
+		// 下一场直播的弹幕不计入
+		{RoomId: 545, Time: 201, UID: 4, Uname: "d", Msg: "4", Type: TypeDanmaku},
+	}
+	for i := range events {
+		if err := sink.Write(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+		if events[i].Time < 200 {
+			first.addEvent(&events[i])
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	first.End = 150
+	first.EndReason = EndPreparing
+	if err := sink.UpdateLive(first); err != nil {
+		t.Fatal(err)
+	}
+
+	lives, err := sink.QuerySessions(context.Background(), &SessionQuery{RoomId: 545})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(lives), 2)
+	assert.Equal(t, lives[0].ID, "545-200")
+	assert.Equal(t, lives[1].End, int64(150))
+
+	lives, err = sink.QuerySessions(context.Background(), &SessionQuery{From: 120, To: 180})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(lives), 1)
+	assert.Equal(t, lives[0].ID, "546-150")
+
+	summary, err := sink.QuerySession(context.Background(), "545-100", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, summary.Duration, int64(50))
+	assert.Equal(t, summary.Danmaku, int64(3))
+	assert.Equal(t, summary.Revenue, int64(32000))
+	assert.Equal(t, len(summary.TopChatters), 2)
+	assert.Equal(t, summary.TopChatters[0].UID, int64(1))
+	assert.Equal(t, summary.TopChatters[0].Count, int64(2))
+	// 银瓜子礼物不计入收入
+	assert.Equal(t, len(summary.TopGifters), 2)
+	assert.Equal(t, summary.TopGifters[0].UID, int64(3))
+	assert.Equal(t, summary.TopGifters[0].Revenue, int64(30000))
+	assert.Equal(t, summary.TopGifters[1].Revenue, int64(2000))
+
+	_, err = sink.QuerySession(context.Background(), "545-1", 10)
+	assert.Equal(t, err, ErrSessionNotFound)
+}
+
+func TestSqliteQueryViewer(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	events := []Event{
+		{RoomId: 545, Time: 100, UID: 1, Uname: "旧名", Msg: "1", Type: TypeDanmaku},
+		{RoomId: 545, Time: 110, UID: 1, Uname: "旧名", Type: TypeGift, GiftCount: 2, CoinType: "gold", UnitPrice: 1000},
+		{RoomId: 545, Time: 120, UID: 1, Uname: "旧名", Type: TypeGift, GiftCount: 10, CoinType: "silver", UnitPrice: 100},
+		{RoomId: 546, Time: 200, UID: 1, Uname: "新名", Msg: "2", Type: TypeDanmaku},
+		{RoomId: 546, Time: 210, UID: 1, Uname: "新名", Type: TypeGuard, GiftCount: 1, CoinType: "gold", UnitPrice: 198000},
+		{RoomId: 546, Time: 220, UID: 1, Uname: "新名", Msg: "SC", Type: TypeSuperChat, UnitPrice: 30000},
+		{RoomId: 546, Time: 230, UID: 2, Uname: "别人", Msg: "3", Type: TypeDanmaku},
+	}
+	for i := range events {
+		if err := sink.Write(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := sink.QueryViewer(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, profile.Username, "新名")
+	assert.Equal(t, profile.FirstSeen, int64(100))
+	assert.Equal(t, profile.LastSeen, int64(220))
+	assert.Equal(t, profile.Danmaku, int64(2))
+	assert.Equal(t, profile.Revenue, int64(230000))
+
+	assert.Equal(t, len(profile.Rooms), 2)
+	assert.Equal(t, *profile.Rooms[0], ViewerRoom{RoomId: 546, Danmaku: 1, Guard: 198000, SuperChat: 30000, FirstSeen: 200, LastSeen: 220})
+	assert.Equal(t, *profile.Rooms[1], ViewerRoom{RoomId: 545, Danmaku: 1, Gift: 2000, FirstSeen: 100, LastSeen: 120})
+
+	assert.Equal(t, len(profile.Names), 2)
+	assert.Equal(t, *profile.Names[1], ViewerName{Username: "旧名", FirstSeen: 100, LastSeen: 120})
+
+	_, err = sink.QueryViewer(context.Background(), 3)
+	assert.Equal(t, err, ErrViewerNotFound)
+}
+
+func TestSqliteQueryLeaderboard(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// 86400 * 10 - 8 小时为北京时间第十天的零点
+	day := int64(86400*10 - dayOffset)
+	events := []Event{
+		{RoomId: 545, Time: day + 10, UID: 1, Uname: "一号", Msg: "1", Type: TypeDanmaku},
+		{RoomId: 545, Time: day + 20, UID: 1, Uname: "一号", Msg: "2", Type: TypeDanmaku},
+		{RoomId: 545, Time: day + 30, UID: 2, Uname: "二号", Msg: "3", Type: TypeDanmaku},
+		{RoomId: 545, Time: day + 40, UID: 2, Uname: "二号", Type: TypeGift, GiftCount: 2, CoinType: "gold", UnitPrice: 1000},
+		{RoomId: 545, Time: day + 50, UID: 2, Uname: "二号", Type: TypeGift, GiftCount: 10, CoinType: "silver", UnitPrice: 100},
+		{RoomId: 545, Time: day + 60, UID: 3, Uname: "三号", Msg: "SC", Type: TypeSuperChat, UnitPrice: 30000},
+		{RoomId: 545, Time: day - 10, UID: 3, Uname: "三号", Type: TypeGuard, GiftCount: 1, CoinType: "gold", UnitPrice: 198000},
+		{RoomId: 546, Time: day + 10, UID: 4, Uname: "别的房间", Msg: "4", Type: TypeDanmaku},
+	}
+	for i := range events {
+		if err := sink.Write(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	query := func(q LeaderboardQuery) []*LeaderboardEntry {
+		q.RoomId, q.Limit = 545, 10
+		entries, err := sink.QueryLeaderboard(ctx, &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	// 按日汇总，只包含第十天
+	entries := query(LeaderboardQuery{By: ByDanmaku, Rollup: true, From: day, To: day + 100})
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, *entries[0], LeaderboardEntry{Rank: 1, UID: 1, Uname: "一号", Danmaku: 2})
+	assert.Equal(t, entries[1].UID, int64(2))
+
+	entries = query(LeaderboardQuery{By: BySpend, Rollup: true, From: day, To: day + 100})
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, *entries[0], LeaderboardEntry{Rank: 1, UID: 3, Uname: "三号", SuperChat: 30000, Spend: 30000})
+	assert.Equal(t, *entries[1], LeaderboardEntry{Rank: 2, UID: 2, Uname: "二号", Danmaku: 1, Gift: 2000, Spend: 2000})
+
+	// 包含前一天的上舰
+	entries = query(LeaderboardQuery{By: BySpend, Rollup: true, To: day + 100})
+	assert.Equal(t, entries[0].Spend, int64(228000))
+
+	// 再次写入时累加
+	more := Event{RoomId: 545, Time: day + 70, UID: 2, Uname: "二号改名", Msg: "SC", Type: TypeSuperChat, UnitPrice: 50000}
+	if err := sink.Write(&more); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	entries = query(LeaderboardQuery{By: BySuperChat, Rollup: true, From: day, To: day + 100})
+	assert.Equal(t, *entries[0], LeaderboardEntry{Rank: 1, UID: 2, Uname: "二号改名", Danmaku: 1, Gift: 2000, SuperChat: 50000, Spend: 52000})
+
+	// 直播场次以精确时间从弹幕表查询
+	entries = query(LeaderboardQuery{By: BySpend, From: day + 35, To: day + 65})
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[0].UID, int64(3))
+	assert.Equal(t, entries[0].Spend, int64(30000))
+	assert.Equal(t, entries[1].Spend, int64(2000))
+
+	_, err = sink.QueryLeaderboard(ctx, &LeaderboardQuery{RoomId: 545, By: "unknown", Limit: 10})
+	assert.NotEqual(t, err, nil)
+}
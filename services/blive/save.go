@@ -1,225 +1,378 @@
 package blive
 
 import (
-	"database/sql"
-	"flag"
-	"fmt"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"strconv"
 	"strings"
 	"time"
 
 	biligo "github.com/eric2788/biligo-live"
-	_ "github.com/lib/pq"
+	"github.com/eric2788/biligo-live-ws/config"
 )
 
-var db *sql.DB
-var live_stmt, stop_stmt *sql.Stmt
-var ROOM_STATUS = make(map[int64]int64)
-var SUPER_CHAT = make(map[int64]int64)
-var DanmakuData []Danmaku
-var userKey = flag.String("user", "", "Set PostgreSQL connection")
-var pwdKey = flag.String("password", "", "Set PostgreSQL connection")
-var dbKey = flag.String("dbname", "", "Set PostgreSQL connection")
+// saverMetrics 弹幕保存队列的统计，可从 /debug/vars 查看
+var saverMetrics = expvar.NewMap("danmaku_saver")
+
+var (
+	saverEnqueued  = new(expvar.Int)
+	saverDropped   = new(expvar.Int)
+	saverProcessed = new(expvar.Int)
+)
 
 func init() {
-	// 终于通过延时解决了如何从 flag 中读取字符串的问题
-	go func() {
-		time.Sleep(1 * time.Second)
-		key := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", *userKey, *pwdKey, *dbKey)
-		var err error
-		db, err = sql.Open("postgres", key)
-		if err == nil {
-			log.Info("弹幕数据库连接成功。")
-			live_stmt, _ = db.Prepare("INSERT INTO live(roomid,username,uid,title,cover,st) VALUES($1,$2,$3,$4,$5,$6)")
-			stop_stmt, _ = db.Prepare("update live set sp=$1, total=$2, send_gift=$3, guard_buy=$4, super_chat_message=$5 where roomid=$6 and st=$7")
-			rows, err := db.Query("select roomid, st from live where sp is NULL")
-			if err != nil {
-				log.Error("从弹幕数据库读取房间状态失败。", err)
-				return
+	saverMetrics.Set("enqueued", saverEnqueued)
+	saverMetrics.Set("dropped", saverDropped)
+	saverMetrics.Set("processed", saverProcessed)
+	saverMetrics.Set("queue_length", expvar.Func(func() interface{} {
+		return len(saverQueue)
+	}))
+}
+
+// saveJob 等待保存的讯息，直播资讯在入队时复制以免被其他 goroutine 修改。
+// msg 为 nil 时按 end 结束直播场次，或按 resume 重新开启直播场次。
+type saveJob struct {
+	info   LiveInfo
+	msg    biligo.Msg
+	end    string
+	resume bool
+}
+
+var sinks multiSink
+
+// saverQueue 为 nil 时不保存弹幕
+var saverQueue chan saveJob
+var saverBlock bool
+
+// saverCommands 按设定写入 live_event 的指令，* 为全部
+var saverCommands = make(map[string]bool)
+var stopSaver chan struct{}
+var saverDone chan struct{}
+
+// StartSaver 按设定开启弹幕 Sink，并启动保存弹幕的 goroutine
+func StartSaver(cfg config.Sink, pg config.Postgres) {
+	opened := openSinks(cfg.Types, newSinkOptions(cfg, pg))
+	if len(opened) == 0 {
+		log.Warn("没有可用的弹幕 Sink，弹幕将不会被保存。")
+		return
+	}
+	superChats.load(superChatDbKey)
+	startSaver(opened, cfg)
+}
+
+// OpenSinks 只开启弹幕 Sink 以供查询而不启动保存，用于命令行工具。
+// 暂存文件留给运行中的服务写入，不会在此开启。
+func OpenSinks(cfg config.Sink, pg config.Postgres) error {
+	opts := newSinkOptions(cfg, pg)
+	opts.SpoolDir = ""
+	sinks = openSinks(cfg.Types, opts)
+	if len(sinks) == 0 {
+		return errors.New("没有可用的弹幕 Sink")
+	}
+	return nil
+}
+
+// CloseSinks 关闭由 OpenSinks 开启的 Sink
+func CloseSinks() error {
+	err := sinks.Close()
+	sinks = nil
+	return err
+}
+
+func newSinkOptions(cfg config.Sink, pg config.Postgres) sinkOptions {
+	return sinkOptions{
+		PostgresDSN:  pg.DSN(),
+		SqlitePath:   cfg.SqlitePath,
+		FileDir:      cfg.FileDir,
+		FileMaxSize:  cfg.FileMaxSize,
+		Partition:    cfg.Partition,
+		SpoolDir:     cfg.SpoolDir,
+		SpoolMaxSize: cfg.SpoolMaxSize,
+	}
+}
+
+func startSaver(opened multiSink, cfg config.Sink) {
+	sinks = opened
+	recoverSessions()
+
+	saverQueue = make(chan saveJob, cfg.QueueSize)
+	saverBlock = strings.EqualFold(cfg.QueuePolicy, "block")
+	saverCommands = make(map[string]bool)
+	for _, cmd := range cfg.Commands {
+		saverCommands[strings.ToUpper(cmd)] = true
+	}
+	stopSaver = make(chan struct{})
+	saverDone = make(chan struct{})
+
+	go runSaver(saverQueue, stopSaver, cfg.FlushInterval)
+}
+
+// runSaver 依序处理队列中的讯息并定时写入，停止时处理完队列中剩余的讯息
+func runSaver(queue chan saveJob, stop chan struct{}, interval time.Duration) {
+	defer close(saverDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var dropped int64
+	for {
+		select {
+		case job := <-queue:
+			handle_job(&job)
+		case <-ticker.C:
+			if total := saverDropped.Value(); total > dropped {
+				log.Warnf("弹幕保存队列已满，已丢弃 %v 条讯息。", total-dropped)
+				dropped = total
 			}
-			//延迟关闭rows
-			defer rows.Close()
-
-			if rows != nil {
-				for rows.Next() {
-					status := Status{}
-					err := rows.Scan(&status.roomid, &status.st)
-					if err != nil {
-						panic(err)
-					}
-					ROOM_STATUS[status.roomid] = status.st
+			auto_save()
+			updateSessions()
+			superChats.save()
+		case <-stop:
+			for {
+				select {
+				case job := <-queue:
+					handle_job(&job)
+				default:
+					return
 				}
 			}
+		}
+	}
+}
 
-			go func() {
-				ticker := time.NewTicker(10 * time.Second)
-				defer ticker.Stop()
+// StopSaver 停止保存弹幕的 goroutine 并关闭所有 Sink，未能写入数据库的弹幕会保留在暂存文件
+func StopSaver() {
+	if saverQueue == nil {
+		return
+	}
+	close(stopSaver)
+	<-saverDone
 
-				for range ticker.C {
-					auto_save()
-				}
-			}()
-		} else {
-			log.Error("打开弹幕数据库时错误。", err)
-			db = nil
-		}
-	}()
+	// 进行中的直播场次保留到下次启动时恢复
+	updateSessions()
+	superChats.save()
+
+	if err := sinks.Close(); err != nil {
+		log.Error("关闭弹幕 Sink 错误。", err)
+	} else {
+		log.Info("弹幕已全部写入。")
+	}
 }
 
-type Status struct {
-	roomid int64
-	st     int64
+func handle_job(job *saveJob) {
+	switch {
+	case job.end != "":
+		endSession(job.info.RoomId, job.end)
+	case job.resume:
+		resumeSession(&job.info)
+	default:
+		save_danmaku(job.msg.Cmd(), &job.info, job.msg)
+	}
+	saverProcessed.Add(1)
 }
 
-type Danmaku struct {
-	roomid int64
-	time   int64
-	mid    int64
-	uname  string
-	msg    string
-	price  float64
+// queue_end_session 通知保存弹幕的 goroutine 结束房间的直播场次
+func queue_end_session(room int64, reason string) {
+	queue_job(saveJob{info: LiveInfo{RoomId: room}, end: reason})
 }
 
-func insert_danmaku(roomid, time, mid int64, price float64, uname, msg string) {
-	DanmakuData = append(DanmakuData, Danmaku{roomid, time, mid, uname, msg, price})
+// queue_resume_session 通知保存弹幕的 goroutine 重新开启房间中止监听前的直播场次
+func queue_resume_session(live_info *LiveInfo) {
+	if live_info.LiveTime <= 0 {
+		return
+	}
+	queue_job(saveJob{info: *live_info, resume: true})
 }
 
-func auto_save() {
-	var tData []Danmaku
-	sqlList := make(map[int64]string)
-	pos := len(DanmakuData)
-	tData, DanmakuData = DanmakuData[:pos], DanmakuData[pos:]
-	if pos > 0 {
-		for _, v := range tData {
-			uname := strings.Replace(v.uname, "'", "''", -1)
-			msg := strings.Replace(v.msg, "'", "''", -1)
-			sql, ok := sqlList[v.roomid]
-			if ok {
-				sqlList[v.roomid] = sql + fmt.Sprintf(",(%v,%v,'%v','%v',%v)", v.time, v.mid, uname, msg, v.price)
-			} else {
-				sqlList[v.roomid] = fmt.Sprintf("INSERT INTO live_%v(time,uid,username,msg,price) VALUES (%v,%v,'%v','%v',%v)", v.roomid, v.time, v.mid, uname, msg, v.price)
+// queue_job 等待加入保存队列
+func queue_job(job saveJob) {
+	if saverQueue == nil {
+		return
+	}
+	select {
+	case saverQueue <- job:
+		saverEnqueued.Add(1)
+	case <-stopSaver:
+		saverDropped.Add(1)
+	}
+}
+
+// queue_danmaku 将讯息加入保存队列。
+// 队列已满时按设定丢弃或等待，开播和下播讯息总是等待。
+func queue_danmaku(live_info *LiveInfo, msg biligo.Msg) {
+	if saverQueue == nil || !(saveable(msg) || recordCommand(msg.Cmd())) {
+		return
+	}
+
+	job := saveJob{info: *live_info, msg: msg}
+
+	switch msg.(type) {
+	case *biligo.MsgLive, *biligo.MsgPreparing:
+	default:
+		if !saverBlock {
+			select {
+			case saverQueue <- job:
+				saverEnqueued.Add(1)
+			default:
+				saverDropped.Add(1)
 			}
+			return
 		}
-		var lines int64 = 0
-		for roomid, sql := range sqlList {
-			csql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS live_%v(time bigint,uid bigint,username text,msg text,price double precision)", roomid)
-			_, err := db.Exec(csql)
-			if err != nil {
-				log.Error("创建表错误。", err)
-			}
-			res, err := db.Exec(sql)
-			if err != nil {
-				log.Error("保存弹幕错误。", err, sql)
-			} else {
-				line, _ := res.RowsAffected()
-				lines += line
-			}
+	}
+
+	queue_job(job)
+}
+
+// saveable 返回讯息是否需要保存
+func saveable(msg biligo.Msg) bool {
+	switch msg.(type) {
+	case *biligo.MsgLive, *biligo.MsgPreparing, *biligo.MsgHeartbeatReply,
+		*biligo.MsgDanmaku, *biligo.MsgSendGift, *biligo.MsgUserToastMsg,
+		*biligo.MsgSuperChatMessage, *biligo.MsgSuperChatMessageJPN:
+		return true
+	}
+	return false
+}
+
+// recordCommand 返回指令是否需要写入 live_event
+func recordCommand(cmd string) bool {
+	return cmd != "" && (saverCommands["*"] || saverCommands[cmd])
+}
+
+// insert_command 将指令的原始 JSON 写入 live_event
+func insert_command(roomid int64, Cmd string, msg biligo.Msg) {
+	ev := &Event{RoomId: roomid, Time: time.Now().Unix(), Cmd: Cmd}
+
+	if hb, ok := msg.(*biligo.MsgHeartbeatReply); ok {
+		// 心跳回应不是 JSON，只记录人气值
+		ev.Payload, _ = json.Marshal(map[string]int{"popularity": hb.GetHot()})
+	} else {
+		raw := msg.Raw()
+		if !json.Valid(raw) {
+			log.Warnf("房间 %v 的指令 %v 不是有效的 JSON，已略过。", roomid, Cmd)
+			return
+		}
+		ev.Payload = raw
+
+		// 大部分指令的 data 中带有用户 uid
+		var body struct {
+			Data struct {
+				UID json.Number `json:"uid"`
+			} `json:"data"`
 		}
-		log.Info("保存弹幕成功。总条目数: ", lines)
+		if err := json.Unmarshal(raw, &body); err == nil {
+			ev.UID, _ = body.Data.UID.Int64()
+		}
+	}
+
+	if err := sinks.Write(ev); err != nil {
+		log.Error("写入指令错误。", err)
+	}
+}
+
+// insert_danmaku 写入弹幕记录，并计入进行中的直播场次
+func insert_danmaku(session *Session, ev *Event) {
+	if err := sinks.Write(ev); err != nil {
+		log.Error("写入弹幕错误。", err)
+	}
+	if session != nil {
+		session.addEvent(ev)
+	}
+}
+
+func auto_save() {
+	if err := sinks.Flush(); err != nil {
+		log.Error("保存弹幕错误。", err)
 	}
 }
 
 func save_danmaku(Cmd string, live_info *LiveInfo, msg biligo.Msg) {
-	if db == nil {
-		log.Error("连接到弹幕数据库时错误。")
+	if len(sinks) == 0 {
 		return
 	}
+	if recordCommand(Cmd) {
+		insert_command(live_info.RoomId, Cmd, msg)
+	}
+	session := sessions[live_info.RoomId]
+
 	switch msg := msg.(type) {
 	case *biligo.MsgLive:
-		now := time.Now().Unix()
-		_, ok := ROOM_STATUS[live_info.RoomId]
-		if !ok {
-			ROOM_STATUS[live_info.RoomId] = now
-			live_stmt.Exec(live_info.RoomId, live_info.Name, live_info.UID, live_info.Title, live_info.Cover, now)
+		startSession(live_info)
+
+	case *biligo.MsgHeartbeatReply:
+		if session != nil {
+			session.addPopularity(int64(msg.GetHot()))
 		}
 
 	case *biligo.MsgDanmaku:
 		dm, err := msg.Parse()
 		if err == nil {
-			insert_danmaku(live_info.RoomId, dm.Time/1000, dm.MID, 0.0, dm.Uname, dm.Content)
+			insert_danmaku(session, &Event{
+				RoomId: live_info.RoomId, Time: dm.Time / 1000, UID: dm.MID, Uname: dm.Uname, Msg: dm.Content,
+				Type: TypeDanmaku,
+			})
 		} else {
-			panic(err)
+			log.Warnf("解析房间 %v 的弹幕错误: %v", live_info.RoomId, err)
 		}
 
 	case *biligo.MsgSendGift:
 		dm, err := msg.Parse()
 		if err == nil {
-			insert_danmaku(live_info.RoomId, dm.Timestamp, dm.UID, float64(dm.Price)/1000.0, dm.Uname, "投喂 "+dm.GiftName)
+			insert_danmaku(session, &Event{
+				RoomId: live_info.RoomId, Time: dm.Timestamp, UID: dm.UID, Uname: dm.Uname,
+				Msg: "投喂 " + dm.GiftName, Price: float64(dm.Price) / 1000.0,
+				Type: TypeGift, GiftID: int64(dm.GiftID), GiftName: dm.GiftName, GiftCount: int64(dm.Num),
+				CoinType: dm.CoinType, UnitPrice: int64(dm.Price), GuardLevel: dm.GuardLevel,
+			})
 		} else {
-			panic(err)
+			log.Warnf("解析房间 %v 的礼物错误: %v", live_info.RoomId, err)
 		}
 
 	case *biligo.MsgUserToastMsg:
 		dm, err := msg.Parse()
 		if err == nil {
-			insert_danmaku(live_info.RoomId, dm.StartTime, dm.UID, float64(dm.Price)/1000.0, dm.Username, "赠送 "+dm.RoleName)
+			insert_danmaku(session, &Event{
+				RoomId: live_info.RoomId, Time: dm.StartTime, UID: dm.UID, Uname: dm.Username,
+				Msg: "赠送 " + dm.RoleName, Price: float64(dm.Price) / 1000.0,
+				Type: TypeGuard, GiftName: dm.RoleName, GiftCount: int64(dm.Num),
+				CoinType: "gold", UnitPrice: dm.Price, GuardLevel: dm.GuardLevel,
+			})
 		} else {
-			panic(err)
+			log.Warnf("解析房间 %v 的上舰错误: %v", live_info.RoomId, err)
 		}
 
 	case *biligo.MsgSuperChatMessage:
 		dm, err := msg.Parse()
 		if err == nil {
-			_, ok := SUPER_CHAT[dm.ID]
-			if ok {
+			// SC 和 SC_JPN 会重复推送同一则 SC
+			if superChats.Seen(strconv.FormatInt(dm.ID, 10)) {
 				return
-			} else {
-				SUPER_CHAT[dm.ID] = dm.ID
-				insert_danmaku(live_info.RoomId, dm.StartTime, dm.UID, float64(dm.Price), dm.UserInfo.Uname, dm.Message)
 			}
+			insert_danmaku(session, &Event{
+				RoomId: live_info.RoomId, Time: dm.StartTime, UID: dm.UID, Uname: dm.UserInfo.Uname,
+				Msg: dm.Message, Price: float64(dm.Price),
+				Type: TypeSuperChat, UnitPrice: int64(dm.Price) * 1000,
+			})
 		}
 
 	case *biligo.MsgSuperChatMessageJPN:
 		dm, err := msg.Parse()
 		if err == nil {
-			JpnID, err := strconv.ParseInt(dm.ID, 10, 64)
+			if superChats.Seen(dm.ID) {
+				return
+			}
+			JpnUID, err := strconv.ParseInt(dm.UID, 10, 64)
 			if err == nil {
-				_, ok := SUPER_CHAT[JpnID]
-				if ok {
-					return
-				} else {
-					SUPER_CHAT[JpnID] = JpnID
-					JpnUID, err := strconv.ParseInt(dm.UID, 10, 64)
-					if err == nil {
-						insert_danmaku(live_info.RoomId, dm.StartTime, JpnUID, float64(dm.Price), dm.UserInfo.Uname, dm.Message)
-					}
-				}
+				insert_danmaku(session, &Event{
+					RoomId: live_info.RoomId, Time: dm.StartTime, UID: JpnUID, Uname: dm.UserInfo.Uname,
+					Msg: dm.Message, Price: float64(dm.Price),
+					Type: TypeSuperChat, UnitPrice: int64(dm.Price) * 1000,
+				})
 			}
 		}
 
 	case *biligo.MsgPreparing:
-		now := time.Now().Unix()
-		st := ROOM_STATUS[live_info.RoomId]
-		delete(ROOM_STATUS, live_info.RoomId)
-		time.Sleep(11 * time.Second)
-		QuerySql := fmt.Sprintf("select msg,price from live_%v where time >= %v and time <= %v", live_info.RoomId, st, now)
-		rows, err := db.Query(QuerySql)
-		if err != nil {
-			log.Error("从弹幕数据库读取房间状态失败。", err)
-		} else {
-			//延迟关闭rows
-			defer rows.Close()
-			a := 0
-			b, c, d := 0.0, 0.0, 0.0
-			if rows != nil {
-				for rows.Next() {
-					dm := Danmaku{}
-					err := rows.Scan(&dm.msg, &dm.price)
-					if err != nil {
-						continue
-					}
-					if strings.HasPrefix(dm.msg, "投喂 ") {
-						b += dm.price
-					} else if strings.HasPrefix(dm.msg, "赠送 ") {
-						c += dm.price
-					} else if dm.price > 0 {
-						d += dm.price
-					} else {
-						a += 1
-					}
-				}
-			}
-			stop_stmt.Exec(now, a, b, c, d, live_info.RoomId, st)
-		}
+		endSession(live_info.RoomId, EndPreparing)
 	}
 }
@@ -0,0 +1,127 @@
+package blive
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	biligo "github.com/eric2788/biligo-live"
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/go-playground/assert/v2"
+)
+
+// memorySink 记录收到的直播场次
+type memorySink struct {
+	mu      sync.Mutex
+	started map[int64]int
+	stopped map[int64]int
+	lives   map[string]Session
+	closed  bool
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{started: make(map[int64]int), stopped: make(map[int64]int), lives: make(map[string]Session)}
+}
+
+func (m *memorySink) Write(*Event) error { return nil }
+func (m *memorySink) Flush() error       { return nil }
+
+func (m *memorySink) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+func (m *memorySink) StartLive(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started[s.RoomId]++
+	m.lives[s.ID] = *s
+	return nil
+}
+
+func (m *memorySink) UpdateLive(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.End > 0 {
+		m.stopped[s.RoomId]++
+	}
+	m.lives[s.ID] = *s
+	return nil
+}
+
+func (m *memorySink) OpenLives() ([]*Session, error) {
+	return nil, nil
+}
+
+func (m *memorySink) Chatters(*Session) ([]int64, error) {
+	return nil, nil
+}
+
+// 多个房间同时送出讯息，以 go test -race 检查保存流程
+func TestSaverConcurrent(t *testing.T) {
+	sink := newMemorySink()
+	startSaver(multiSink{sink}, config.Sink{QueueSize: 16, QueuePolicy: "block", FlushInterval: time.Millisecond})
+
+	const rooms = 20
+	const rounds = 50
+
+	wg := &sync.WaitGroup{}
+	for i := int64(1); i <= rooms; i++ {
+		wg.Add(1)
+		go func(room int64) {
+			defer wg.Done()
+			info := &LiveInfo{RoomId: room}
+			for j := 0; j < rounds; j++ {
+				queue_danmaku(info, &biligo.MsgLive{})
+				// 同一个直播多次推送开播只记录一次
+				queue_danmaku(info, &biligo.MsgLive{})
+				queue_danmaku(info, &biligo.MsgPreparing{})
+			}
+			// 不需要保存的讯息不入队
+			queue_danmaku(info, &biligo.MsgOnlineRankCount{})
+		}(i)
+	}
+	wg.Wait()
+	StopSaver()
+
+	assert.Equal(t, sink.closed, true)
+	for i := int64(1); i <= rooms; i++ {
+		assert.Equal(t, sink.started[i], rounds)
+		assert.Equal(t, sink.stopped[i], rounds)
+	}
+	assert.Equal(t, len(sessions), 0)
+}
+
+func TestSaverDropWhenFull(t *testing.T) {
+	dropped := saverDropped.Value()
+
+	// 尚未启动时不保存
+	saverQueue = nil
+	queue_danmaku(&LiveInfo{RoomId: 1}, &biligo.MsgDanmaku{})
+	assert.Equal(t, saverDropped.Value(), dropped)
+
+	saverQueue = make(chan saveJob, 1)
+	saverBlock = false
+	stopSaver = make(chan struct{})
+	defer func() { saverQueue = nil }()
+
+	for i := 0; i < 3; i++ {
+		queue_danmaku(&LiveInfo{RoomId: 1}, &biligo.MsgDanmaku{})
+	}
+	assert.Equal(t, len(saverQueue), 1)
+	assert.Equal(t, saverDropped.Value(), dropped+2)
+}
+
+func TestRecordCommand(t *testing.T) {
+	defer func() { saverCommands = make(map[string]bool) }()
+
+	saverCommands = map[string]bool{"GUARD_BUY": true}
+	assert.Equal(t, recordCommand("GUARD_BUY"), true)
+	assert.Equal(t, recordCommand("INTERACT_WORD"), false)
+
+	saverCommands = map[string]bool{"*": true}
+	assert.Equal(t, recordCommand("INTERACT_WORD"), true)
+	assert.Equal(t, recordCommand(""), false)
+}
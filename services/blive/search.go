@@ -0,0 +1,150 @@
+package blive
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrNoSearcher 没有可以搜索弹幕的 Sink
+var ErrNoSearcher = errors.New("没有可搜索的弹幕数据库")
+
+// SearchQuery 弹幕搜索条件，为零值的条件不作筛选
+type SearchQuery struct {
+	// Query 关键字，以空格分隔的关键字须全部出现，"..." 为词组，-关键字 为排除
+	Query  string
+	RoomId int64
+	// From, To 时间范围 (秒)，包含两端
+	From, To int64
+	Username string
+	UID      int64
+	// Context 每条结果前后附带的记录数量
+	Context int
+	Limit   int
+}
+
+// SearchHit 一条搜索结果及其前后的记录
+type SearchHit struct {
+	*Record
+	Before []*Record `json:"before,omitempty"`
+	After  []*Record `json:"after,omitempty"`
+}
+
+// Searcher 由可以搜索弹幕的 Sink 实现
+type Searcher interface {
+	// Search 按时间由新到旧返回符合条件的弹幕记录
+	Search(ctx context.Context, q *SearchQuery) ([]*SearchHit, error)
+}
+
+// Search 从保存弹幕的 Sink 搜索弹幕
+func Search(ctx context.Context, q *SearchQuery) ([]*SearchHit, error) {
+	searcher := sinks.searcher()
+	if searcher == nil {
+		return nil, ErrNoSearcher
+	}
+	return searcher.Search(ctx, q)
+}
+
+// searchMatcher 以子字串比对弹幕内容，数据库不支持时在程序内比对
+type searchMatcher struct {
+	include []string
+	exclude []string
+}
+
+// newSearchMatcher 解析关键字，不区分大小写
+func newSearchMatcher(query string) *searchMatcher {
+	m := &searchMatcher{}
+	for _, term := range splitTerms(query) {
+		if strings.HasPrefix(term, "-") && len(term) > 1 {
+			m.exclude = append(m.exclude, strings.ToLower(strings.Trim(term[1:], `"`)))
+			continue
+		}
+		if term = strings.ToLower(strings.Trim(term, `"`)); term != "" {
+			m.include = append(m.include, term)
+		}
+	}
+	return m
+}
+
+// splitTerms 以空格分隔关键字，引号中的空格不分隔
+func splitTerms(query string) []string {
+	var terms []string
+	quoted := false
+	start := -1
+	for i, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			if start < 0 {
+				start = i
+			}
+		case unicode.IsSpace(r) && !quoted:
+			if start >= 0 {
+				terms = append(terms, query[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		terms = append(terms, query[start:])
+	}
+	return terms
+}
+
+func (m *searchMatcher) match(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, term := range m.exclude {
+		if strings.Contains(msg, term) {
+			return false
+		}
+	}
+	for _, term := range m.include {
+		if !strings.Contains(msg, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// filter 比对关键字以外的条件
+func (q *SearchQuery) filter(ev *Event) bool {
+	if ev.Cmd != "" {
+		return false
+	}
+	if q.RoomId > 0 && ev.RoomId != q.RoomId {
+		return false
+	}
+	if q.From > 0 && ev.Time < q.From {
+		return false
+	}
+	if q.To > 0 && ev.Time > q.To {
+		return false
+	}
+	if q.Username != "" && ev.Uname != q.Username {
+		return false
+	}
+	if q.UID > 0 && ev.UID != q.UID {
+		return false
+	}
+	return true
+}
+
+// sortHits 按时间由新到旧排列并只保留 limit 条
+func sortHits(hits []*SearchHit, limit int) []*SearchHit {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Time != hits[j].Time {
+			return hits[i].Time > hits[j].Time
+		}
+		return hits[i].ID > hits[j].ID
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
@@ -0,0 +1,143 @@
+package blive
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+var searchEvents = []Event{
+	{RoomId: 545, Time: 100, UID: 1, Uname: "a", Msg: "开始了", Type: TypeDanmaku},
+	{RoomId: 545, Time: 101, UID: 2, Uname: "b", Msg: "Hello World", Type: TypeDanmaku},
+	{RoomId: 545, Time: 102, UID: 3, Uname: "c", Msg: "hello there", Type: TypeDanmaku},
+	{RoomId: 545, Time: 103, UID: 1, Uname: "a", Msg: "下次见", Type: TypeDanmaku},
+	{RoomId: 546, Time: 104, UID: 2, Uname: "b", Msg: "hello world again", Type: TypeDanmaku},
+}
+
+func TestSearchMatcher(t *testing.T) {
+	m := newSearchMatcher(`hello "big world" -bye`)
+	assert.Equal(t, m.include, []string{"hello", "big world"})
+	assert.Equal(t, m.exclude, []string{"bye"})
+
+	assert.Equal(t, m.match("Hello the Big World"), true)
+	assert.Equal(t, m.match("hello world big"), false)
+	assert.Equal(t, m.match("hello big world, bye"), false)
+}
+
+func testSearch(t *testing.T, searcher Searcher) {
+	search := func(q SearchQuery) []*SearchHit {
+		hits, err := searcher.Search(context.Background(), &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hits
+	}
+
+	// 不指定房间时搜索所有房间，由新到旧排列
+	hits := search(SearchQuery{Query: "hello"})
+	assert.Equal(t, len(hits), 3)
+	assert.Equal(t, hits[0].RoomId, int64(546))
+	assert.Equal(t, hits[2].Msg, "Hello World")
+
+	hits = search(SearchQuery{Query: "hello world", RoomId: 545, Context: 1})
+	assert.Equal(t, len(hits), 1)
+	assert.Equal(t, hits[0].Uname, "b")
+	assert.Equal(t, len(hits[0].Before), 1)
+	assert.Equal(t, hits[0].Before[0].Msg, "开始了")
+	assert.Equal(t, len(hits[0].After), 1)
+	assert.Equal(t, hits[0].After[0].Msg, "hello there")
+
+	hits = search(SearchQuery{Query: "hello", Username: "b", Limit: 1})
+	assert.Equal(t, len(hits), 1)
+	assert.Equal(t, hits[0].Msg, "hello world again")
+
+	hits = search(SearchQuery{Query: "-hello", UID: 1})
+	assert.Equal(t, len(hits), 2)
+
+	// 未分词的中文以子字串比对
+	hits = search(SearchQuery{Query: "开始"})
+	assert.Equal(t, len(hits), 1)
+	assert.Equal(t, hits[0].Msg, "开始了")
+
+	hits = search(SearchQuery{Query: "%"})
+	assert.Equal(t, len(hits), 0)
+}
+
+func TestSqliteSearch(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for i := range searchEvents {
+		if err := sink.Write(&searchEvents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	testSearch(t, sink)
+
+	hits, err := sink.Search(context.Background(), &SearchQuery{Query: "hello", To: 101})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(hits), 1)
+}
+
+func TestPostgresSearch(t *testing.T) {
+	for _, partition := range []bool{false, true} {
+		sink, err := openSqlSink(postgresDialect, testPostgresDSN(t), partition, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range searchEvents {
+			if err := sink.Write(&searchEvents[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		// 结果与程序内比对的 Sink 相同
+		testSearch(t, sink)
+
+		// 之后建立的分区同样有搜索索引
+		var indexes int
+		if err := sink.db.QueryRow("SELECT COUNT(*) FROM pg_indexes WHERE schemaname = current_schema() AND tablename = 'live_546' AND indexdef LIKE '%gin_trgm_ops%'").Scan(&indexes); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, indexes, 1)
+		_ = sink.Close()
+	}
+}
+
+func TestFileSearch(t *testing.T) {
+	sink, err := openFileSink(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for i := range searchEvents {
+		if err := sink.Write(&searchEvents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 文件按写入日期命名，时间范围以今日计算
+	now := time.Now().Unix()
+	hits, err := sink.Search(context.Background(), &SearchQuery{Query: "hello", From: now - 86400*3, To: now - 86400*2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(hits), 0)
+
+	testSearch(t, sink)
+}
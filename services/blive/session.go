@@ -0,0 +1,241 @@
+package blive
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 直播场次结束的原因
+const (
+	// EndPreparing 收到下播讯息
+	EndPreparing = "preparing"
+	// EndHeartbeat 长时间没有收到心跳，监听已中止
+	EndHeartbeat = "heartbeat"
+	// EndReplaced 未收到下播讯息便开始了新的一场直播
+	EndReplaced = "replaced"
+)
+
+// Session 一场直播及其统计
+type Session struct {
+	ID        string `json:"id"`
+	RoomId    int64  `json:"room_id"`
+	UID       int64  `json:"uid"`
+	Name      string `json:"name"`
+	Title     string `json:"title"`
+	Cover     string `json:"cover"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end,omitempty"`
+	EndReason string `json:"end_reason,omitempty"`
+
+	// Danmaku 弹幕数量
+	Danmaku int64 `json:"danmaku"`
+	// Chatters 发送过弹幕的用户数量
+	Chatters int64 `json:"chatters"`
+	// Gift, Guard, SuperChat 礼物、上舰和 SC 的收入 (毫元)
+	Gift           int64 `json:"gift"`
+	Guard          int64 `json:"guard"`
+	SuperChat      int64 `json:"super_chat"`
+	PeakPopularity int64 `json:"peak_popularity"`
+
+	chatters map[int64]struct{}
+	// dirty 统计有变更尚未写入
+	dirty bool
+}
+
+// sessionID 以房间号和开播时间作为直播场次的 id，同一场直播重连后依然相同
+func sessionID(room, start int64) string {
+	return fmt.Sprintf("%d-%d", room, start)
+}
+
+// ParseSessionID 解析直播场次 id，返回房间号和开播时间
+func ParseSessionID(id string) (room, start int64, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("无效的直播场次 id: %q", id)
+	}
+	if _, err := fmt.Sscan(parts[0], &room); err != nil {
+		return 0, 0, fmt.Errorf("无效的直播场次 id: %q", id)
+	}
+	if _, err := fmt.Sscan(parts[1], &start); err != nil {
+		return 0, 0, fmt.Errorf("无效的直播场次 id: %q", id)
+	}
+	return room, start, nil
+}
+
+func newSession(info *LiveInfo, start int64) *Session {
+	return &Session{
+		ID:       sessionID(info.RoomId, start),
+		RoomId:   info.RoomId,
+		UID:      info.UID,
+		Name:     info.Name,
+		Title:    info.Title,
+		Cover:    info.Cover,
+		Start:    start,
+		chatters: make(map[int64]struct{}),
+		dirty:    true,
+	}
+}
+
+func (s *Session) addDanmaku(uid int64) {
+	s.Danmaku++
+	if _, ok := s.chatters[uid]; !ok {
+		s.chatters[uid] = struct{}{}
+		s.Chatters++
+	}
+	s.dirty = true
+}
+
+// addEvent 统计一条弹幕记录
+func (s *Session) addEvent(ev *Event) {
+	switch ev.Type {
+	case TypeDanmaku:
+		s.addDanmaku(ev.UID)
+		return
+	case TypeGift:
+		s.Gift += ev.Revenue()
+	case TypeGuard:
+		s.Guard += ev.Revenue()
+	case TypeSuperChat:
+		s.SuperChat += ev.Revenue()
+	default:
+		return
+	}
+	s.dirty = true
+}
+
+func (s *Session) addPopularity(popularity int64) {
+	if popularity > s.PeakPopularity {
+		s.PeakPopularity = popularity
+		s.dirty = true
+	}
+}
+
+// sessions 进行中的直播场次，recent 各房间最近结束的直播场次。
+// 只由保存弹幕的 goroutine 读写。
+var sessions = make(map[int64]*Session)
+var recent = make(map[int64]*Session)
+
+// startSession 开始房间的直播场次，开播时间取自直播资讯的 live_time。
+// 因中止监听而结束的同一场直播会重新开启并保留统计。
+func startSession(info *LiveInfo) {
+	room := info.RoomId
+
+	start := info.LiveTime
+	if start <= 0 {
+		start = time.Now().Unix()
+	}
+
+	if s, ok := sessions[room]; ok {
+		// 开播讯息会重复推送，只有开播时间更晚时才是新的一场直播
+		if info.LiveTime <= s.Start {
+			return
+		}
+		endSession(room, EndReplaced)
+	}
+
+	s := recent[room]
+	if s != nil && s.ID == sessionID(room, start) && s.EndReason == EndHeartbeat {
+		s.End = 0
+		s.EndReason = ""
+		s.Title = info.Title
+		s.Cover = info.Cover
+		s.dirty = true
+		log.Infof("房间 %v 重新开启直播场次 %v", room, s.ID)
+	} else {
+		// 缓存中的开播时间可能属于已经结束的上一场直播
+		if s != nil && start <= s.Start {
+			start = time.Now().Unix()
+			if start <= s.Start {
+				start = s.Start + 1
+			}
+		}
+		s = newSession(info, start)
+		log.Infof("房间 %v 开始直播场次 %v", room, s.ID)
+	}
+
+	delete(recent, room)
+	sessions[room] = s
+	for _, recorder := range sinks.recorders() {
+		if err := recorder.StartLive(s); err != nil {
+			log.Error("记录开播错误。", err)
+		}
+	}
+}
+
+// endSession 结束房间进行中的直播场次
+func endSession(room int64, reason string) {
+	s, ok := sessions[room]
+	if !ok {
+		return
+	}
+	delete(sessions, room)
+
+	s.End = time.Now().Unix()
+	s.EndReason = reason
+	s.dirty = true
+	recent[room] = s
+
+	log.Infof("房间 %v 结束直播场次 %v (%v)", room, s.ID, reason)
+	updateSession(s)
+}
+
+// resumeSession 重新连接后，如房间仍在直播中则重新开启因中止监听而结束的直播场次
+func resumeSession(info *LiveInfo) {
+	s := recent[info.RoomId]
+	if s == nil || s.EndReason != EndHeartbeat || s.ID != sessionID(info.RoomId, info.LiveTime) {
+		return
+	}
+	startSession(info)
+}
+
+// updateSession 写入直播场次的统计
+func updateSession(s *Session) {
+	if !s.dirty {
+		return
+	}
+	for _, recorder := range sinks.recorders() {
+		if err := recorder.UpdateLive(s); err != nil {
+			log.Errorf("更新直播场次 %v 错误: %v", s.ID, err)
+			return
+		}
+	}
+	s.dirty = false
+}
+
+// updateSessions 写入所有进行中直播场次的统计
+func updateSessions() {
+	for _, s := range sessions {
+		updateSession(s)
+	}
+}
+
+// recoverSessions 恢复上次运行时尚未结束的直播场次
+func recoverSessions() {
+	for _, recorder := range sinks.recorders() {
+		lives, err := recorder.OpenLives()
+		if err != nil {
+			log.Error("从弹幕数据库读取直播场次失败。", err)
+			continue
+		}
+		for _, s := range lives {
+			chatters, err := recorder.Chatters(s)
+			if err != nil {
+				log.Warnf("恢复直播场次 %v 的弹幕用户失败: %v", s.ID, err)
+			}
+			s.chatters = make(map[int64]struct{}, len(chatters))
+			for _, uid := range chatters {
+				s.chatters[uid] = struct{}{}
+			}
+			if int64(len(s.chatters)) > s.Chatters {
+				s.Chatters = int64(len(s.chatters))
+			}
+			sessions[s.RoomId] = s
+		}
+		if len(lives) > 0 {
+			log.Infof("已恢复 %v 场进行中的直播。", len(lives))
+		}
+		// 各个 Sink 记录的直播场次相同，读取一个即可
+		return
+	}
+}
@@ -0,0 +1,87 @@
+package blive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func resetSessions(t *testing.T, sink *memorySink) {
+	sinks = multiSink{sink}
+	sessions = make(map[int64]*Session)
+	recent = make(map[int64]*Session)
+	t.Cleanup(func() {
+		sinks = nil
+		sessions = make(map[int64]*Session)
+		recent = make(map[int64]*Session)
+	})
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	sink := newMemorySink()
+	resetSessions(t, sink)
+
+	info := &LiveInfo{RoomId: 545, LiveTime: 1000}
+	startSession(info)
+	// 重复推送的开播讯息不会开始新的直播场次
+	startSession(info)
+	assert.Equal(t, sink.started[545], 1)
+	assert.Equal(t, sessions[545].ID, "545-1000")
+
+	sessions[545].addDanmaku(1)
+	sessions[545].addDanmaku(1)
+	sessions[545].addDanmaku(2)
+	sessions[545].addPopularity(10)
+	sessions[545].addPopularity(5)
+
+	// 中止监听后重连，同一场直播重新开启并保留统计
+	endSession(545, EndHeartbeat)
+	assert.Equal(t, sink.lives["545-1000"].EndReason, EndHeartbeat)
+	resumeSession(info)
+	assert.Equal(t, sessions[545].ID, "545-1000")
+	assert.Equal(t, sessions[545].Danmaku, int64(3))
+	assert.Equal(t, sessions[545].Chatters, int64(2))
+	assert.Equal(t, sessions[545].PeakPopularity, int64(10))
+
+	endSession(545, EndPreparing)
+	assert.Equal(t, len(sessions), 0)
+	assert.Equal(t, sink.lives["545-1000"].Danmaku, int64(3))
+	assert.Equal(t, sink.lives["545-1000"].EndReason, EndPreparing)
+
+	// 已下播的直播不会被重新开启，缓存中过时的开播时间不会重复使用
+	resumeSession(info)
+	assert.Equal(t, len(sessions), 0)
+	startSession(info)
+	assert.NotEqual(t, sessions[545].ID, "545-1000")
+	assert.Equal(t, sessions[545].Danmaku, int64(0))
+}
+
+func TestSessionReplaced(t *testing.T) {
+	sink := newMemorySink()
+	resetSessions(t, sink)
+
+	startSession(&LiveInfo{RoomId: 545, LiveTime: 1000})
+	// 未收到下播讯息便开始了新的一场直播
+	startSession(&LiveInfo{RoomId: 545, LiveTime: 2000})
+
+	assert.Equal(t, sink.lives["545-1000"].EndReason, EndReplaced)
+	assert.Equal(t, sessions[545].ID, "545-2000")
+
+	// 没有开播时间时以目前时间开始
+	now := time.Now().Unix()
+	startSession(&LiveInfo{RoomId: 546})
+	assert.Equal(t, sessions[546].Start >= now, true)
+}
+
+func TestParseSessionID(t *testing.T) {
+	room, start, err := ParseSessionID("545-1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, room, int64(545))
+	assert.Equal(t, start, int64(1000))
+
+	_, _, err = ParseSessionID("545")
+	assert.NotEqual(t, err, nil)
+}
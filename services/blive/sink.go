@@ -0,0 +1,194 @@
+package blive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 弹幕记录的类型
+const (
+	TypeDanmaku   = "danmaku"
+	TypeGift      = "gift"
+	TypeGuard     = "guard"
+	TypeSuperChat = "super_chat"
+)
+
+// Event 为写入 Sink 的一条直播记录。
+// Cmd 不为空时为弹幕以外的指令，Payload 为该指令的原始 JSON。
+//
+// Msg 和 Price 保留旧版本的格式，礼物和上舰的 Msg 带有 "投喂 " 和 "赠送 " 前缀；
+// 统计应使用 Type 及 UnitPrice 等栏位。
+type Event struct {
+	RoomId int64   `json:"room_id"`
+	Time   int64   `json:"time"`
+	UID    int64   `json:"uid"`
+	Uname  string  `json:"username"`
+	Msg    string  `json:"msg"`
+	Price  float64 `json:"price"`
+
+	Type      string `json:"type,omitempty"`
+	GiftID    int64  `json:"gift_id,omitempty"`
+	GiftName  string `json:"gift_name,omitempty"`
+	GiftCount int64  `json:"gift_count,omitempty"`
+	// CoinType 礼物为 gold 或 silver
+	CoinType string `json:"coin_type,omitempty"`
+	// UnitPrice 单价 (毫元)，银瓜子礼物为银瓜子数
+	UnitPrice  int64 `json:"unit_price,omitempty"`
+	GuardLevel int   `json:"guard_level,omitempty"`
+
+	Cmd     string          `json:"cmd,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Revenue 返回此记录的收入 (毫元)，银瓜子礼物不计入
+func (ev *Event) Revenue() int64 {
+	switch ev.Type {
+	case TypeGift:
+		if ev.CoinType != "gold" {
+			return 0
+		}
+		return ev.UnitPrice * ev.GiftCount
+	case TypeGuard:
+		return ev.UnitPrice * ev.GiftCount
+	case TypeSuperChat:
+		return ev.UnitPrice
+	}
+	return 0
+}
+
+// Sink 弹幕持久化后端
+type Sink interface {
+	// Write 将事件加入缓冲，不保证立即写入
+	Write(ev *Event) error
+	// Flush 将缓冲中的事件写入后端
+	Flush() error
+	// Close 写入剩余的事件并关闭后端
+	Close() error
+}
+
+// LiveRecorder 由可以记录直播场次的 Sink 实现
+type LiveRecorder interface {
+	// StartLive 记录直播场次开始，已有同一场直播的记录时重新开启
+	StartLive(s *Session) error
+	// UpdateLive 写入直播场次的统计，下播后一并写入下播时间
+	UpdateLive(s *Session) error
+	// OpenLives 返回尚未下播的直播场次
+	OpenLives() ([]*Session, error)
+	// Chatters 返回直播场次中发送过弹幕的用户，用于恢复统计
+	Chatters(s *Session) ([]int64, error)
+}
+
+// multiSink 将事件分发到多个 Sink
+type multiSink []Sink
+
+func (m multiSink) Write(ev *Event) error {
+	var errs []string
+	for _, sink := range m {
+		if err := sink.Write(ev); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (m multiSink) Flush() error {
+	var errs []string
+	for _, sink := range m {
+		if err := sink.Flush(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (m multiSink) Close() error {
+	var errs []string
+	for _, sink := range m {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// recorders 返回所有可以记录直播场次的 Sink
+func (m multiSink) recorders() []LiveRecorder {
+	var recorders []LiveRecorder
+	for _, sink := range m {
+		if recorder, ok := sink.(LiveRecorder); ok {
+			recorders = append(recorders, recorder)
+		}
+	}
+	return recorders
+}
+
+// querier 返回第一个可以查询弹幕记录的 Sink
+func (m multiSink) querier() Querier {
+	for _, sink := range m {
+		if querier, ok := sink.(Querier); ok {
+			return querier
+		}
+	}
+	return nil
+}
+
+// searcher 返回第一个可以搜索弹幕的 Sink
+func (m multiSink) searcher() Searcher {
+	for _, sink := range m {
+		if searcher, ok := sink.(Searcher); ok {
+			return searcher
+		}
+	}
+	return nil
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// sinkOptions 开启 Sink 所需的设定
+type sinkOptions struct {
+	PostgresDSN string
+	SqlitePath  string
+	FileDir     string
+	FileMaxSize int64
+	// Partition 是否将 PostgreSQL 的弹幕表迁移到分区表
+	Partition bool
+	// SpoolDir 数据库不可用时暂存弹幕的目录，为空则不暂存
+	SpoolDir string
+	// SpoolMaxSize 每个暂存文件尚未写入的最大字节数，0 为不限制
+	SpoolMaxSize int64
+}
+
+// openSinks 按名称开启 Sink，名称为 postgres, sqlite 或 file，开启失败的 Sink 将被略过
+func openSinks(names []string, opts sinkOptions) multiSink {
+	var sinks multiSink
+	for _, name := range names {
+		var sink Sink
+		var err error
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "postgres":
+			sink, err = openSqlSink(postgresDialect, opts.PostgresDSN, opts.Partition, opts.SpoolDir, opts.SpoolMaxSize)
+		case "sqlite":
+			sink, err = openSqlSink(sqliteDialect, opts.SqlitePath, false, opts.SpoolDir, opts.SpoolMaxSize)
+		case "file":
+			sink, err = openFileSink(opts.FileDir, opts.FileMaxSize)
+		case "":
+			continue
+		default:
+			err = errors.New("未知的 Sink 类型")
+		}
+		if err != nil {
+			log.Errorf("开启弹幕 Sink %v 时错误: %v", name, err)
+			continue
+		}
+		log.Infof("弹幕 Sink %v 已开启。", name)
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
@@ -0,0 +1,244 @@
+package blive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fileSink 以 NDJSON 格式将弹幕写入文件，按日期和文件大小轮替
+type fileSink struct {
+	dir     string
+	maxSize int64
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	day    string
+	size   int64
+}
+
+func openFileSink(dir string, maxSize int64) (*fileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &fileSink{dir: dir, maxSize: maxSize}
+	if err := f.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileSink) Write(ev *Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Format("20060102") != f.day || (f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize) {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.writer.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *fileSink) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writer.Flush()
+}
+
+func (f *fileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.writer.Flush(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// rotate 关闭目前的文件，并开启当日下一个未写满的文件
+func (f *fileSink) rotate(now time.Time) error {
+	if f.file != nil {
+		if err := f.writer.Flush(); err != nil {
+			return err
+		}
+		if err := f.file.Close(); err != nil {
+			log.Warnf("关闭弹幕文件时出现错误: %v", err)
+		}
+		f.file = nil
+	}
+
+	day := now.Format("20060102")
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("danmaku-%s.ndjson", day)
+		if i > 0 {
+			name = fmt.Sprintf("danmaku-%s.%d.ndjson", day, i)
+		}
+		path := filepath.Join(f.dir, name)
+
+		var size int64
+		if stat, err := os.Stat(path); err == nil {
+			size = stat.Size()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if f.maxSize > 0 && size >= f.maxSize {
+			continue
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.file = file
+		f.writer = bufio.NewWriter(file)
+		f.day = day
+		f.size = size
+		return nil
+	}
+}
+
+var dayFilePattern = regexp.MustCompile(`^danmaku-(\d{8})(?:\.(\d+))?\.ndjson$`)
+
+// dayFile 按日期和轮替序号排列的弹幕文件
+type dayFile struct {
+	path  string
+	day   string
+	index int
+}
+
+// files 返回日期在 from 至 to 之间的弹幕文件，按写入顺序排列，为空的日期不作筛选
+func (f *fileSink) files(from, to string) ([]dayFile, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []dayFile
+	for _, entry := range entries {
+		match := dayFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		day := match[1]
+		if (from != "" && day < from) || (to != "" && day > to) {
+			continue
+		}
+		index, _ := strconv.Atoi(match[2])
+		files = append(files, dayFile{path: filepath.Join(f.dir, entry.Name()), day: day, index: index})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].day != files[j].day {
+			return files[i].day < files[j].day
+		}
+		return files[i].index < files[j].index
+	})
+	return files, nil
+}
+
+// Search 逐行读取弹幕文件并在程序内比对，记录没有 id
+func (f *fileSink) Search(ctx context.Context, q *SearchQuery) ([]*SearchHit, error) {
+	if err := f.Flush(); err != nil {
+		return nil, err
+	}
+
+	var from, to string
+	if q.From > 0 {
+		from = time.Unix(q.From, 0).Format("20060102")
+	}
+	if q.To > 0 {
+		to = time.Unix(q.To, 0).Format("20060102")
+	}
+	files, err := f.files(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := newSearchMatcher(q.Query)
+	// recent 各房间最近的记录，pending 尚未读取完后文的结果
+	recent := make(map[int64][]*Record)
+	pending := make(map[int64][]*SearchHit)
+	var hits []*SearchHit
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		err := scanLines(file.path, func(line []byte) {
+			r := &Record{}
+			if err := json.Unmarshal(line, &r.Event); err != nil || r.Cmd != "" {
+				return
+			}
+			room := r.RoomId
+
+			if waiting := pending[room]; len(waiting) > 0 {
+				var remain []*SearchHit
+				for _, hit := range waiting {
+					hit.After = append(hit.After, r)
+					if len(hit.After) < q.Context {
+						remain = append(remain, hit)
+					}
+				}
+				pending[room] = remain
+			}
+
+			if q.filter(&r.Event) && matcher.match(r.Msg) {
+				hit := &SearchHit{Record: r}
+				if q.Context > 0 {
+					hit.Before = append([]*Record(nil), recent[room]...)
+					pending[room] = append(pending[room], hit)
+				}
+				hits = append(hits, hit)
+				// 只需保留最新的结果
+				if q.Limit > 0 && len(hits) > 2*q.Limit {
+					hits = append(hits[:0:0], hits[len(hits)-q.Limit:]...)
+				}
+			}
+
+			if q.Context > 0 {
+				recent[room] = append(recent[room], r)
+				if len(recent[room]) > q.Context {
+					recent[room] = recent[room][1:]
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sortHits(hits, q.Limit), nil
+}
+
+func scanLines(path string, fn func(line []byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,1118 @@
+package blive
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	set "github.com/deckarep/golang-set/v2"
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// sqlDialect 不同 SQL 数据库之间的差异
+type sqlDialect struct {
+	name   string
+	driver string
+	// lock, unlock 执行数据库结构变更前后的锁定语句
+	lock, unlock string
+	// listTables 列出所有表名的语句，tableExists 查询某个表是否存在的语句
+	listTables  string
+	tableExists string
+	// partition 是否支持分区表
+	partition bool
+	// addColumn 新增栏位的语句，栏位可能已由分区表的结构变更加上时须能略过
+	addColumn string
+	// rowID 弹幕记录的唯一递增 id 栏位，idColumn 为其定义，为空则使用数据库内建的栏位
+	rowID    string
+	idColumn string
+	// ilike 不区分大小写的子字串比对运算符，searchIndex 为其索引，searchSetup 为建立索引前须执行的语句，
+	// ilike 为空则在程序内比对
+	ilike       string
+	searchIndex string
+	searchSetup string
+}
+
+var (
+	postgresDialect = &sqlDialect{
+		name:        "postgres",
+		driver:      "postgres",
+		lock:        "SELECT pg_advisory_lock(7355608)",
+		unlock:      "SELECT pg_advisory_unlock(7355608)",
+		listTables:  "SELECT tablename FROM pg_tables WHERE schemaname = current_schema()",
+		tableExists: "SELECT COUNT(*) FROM pg_tables WHERE schemaname = current_schema() AND tablename = $1",
+		partition:   true,
+		addColumn:   "ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s",
+		rowID:       "id",
+		idColumn:    "id bigint DEFAULT nextval('danmaku_id_seq')",
+		// 三元组索引以子字串比对，中文弹幕不需分词，结果与程序内比对相同
+		ilike:       "ILIKE",
+		searchIndex: "CREATE INDEX IF NOT EXISTS %s ON %s USING gin (msg gin_trgm_ops)",
+		searchSetup: "CREATE EXTENSION IF NOT EXISTS pg_trgm",
+	}
+	sqliteDialect = &sqlDialect{
+		name:        "sqlite",
+		driver:      "sqlite",
+		listTables:  "SELECT name FROM sqlite_master WHERE type = 'table'",
+		tableExists: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1",
+		addColumn:   "ALTER TABLE %s ADD COLUMN %s",
+		rowID:       "rowid",
+	}
+)
+
+// spoolBatch 每次从暂存文件重放的弹幕数量
+const spoolBatch = 5000
+
+var errNotConnected = errors.New("数据库尚未连接")
+
+// sqlSink 以 SQL 数据库保存弹幕，每个房间一张 live_<房间号> 表。
+// 迁移到分区表后，live_<房间号> 为 danmaku 表的分区。
+type sqlSink struct {
+	dialect   *sqlDialect
+	db        *sql.DB
+	partition bool
+	// spool 写入失败时暂存弹幕，为 nil 时直接丢弃
+	spool *spool
+
+	mu     sync.Mutex
+	buffer []Event
+
+	// flushMu 防止多个 Flush 同时写入
+	flushMu sync.Mutex
+	// tables 已确认存在的弹幕表
+	tables set.Set[int64]
+
+	// ready 已完成连接和数据库结构变更
+	ready       int32
+	partitioned bool
+}
+
+// openSqlSink 开启 SQL Sink。如有暂存文件，数据库暂时无法连接时依然返回 Sink，
+// 弹幕会先写入暂存文件，直到重新连接后再按顺序写入数据库。
+func openSqlSink(dialect *sqlDialect, dsn string, partition bool, spoolDir string, spoolMaxSize int64) (*sqlSink, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sqlSink{
+		dialect:   dialect,
+		db:        db,
+		partition: partition,
+		tables:    set.NewThreadUnsafeSet[int64](),
+	}
+
+	if spoolDir != "" {
+		if s.spool, err = openSpool(spoolDir, dialect.name, spoolMaxSize); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	if err := s.connect(); err != nil {
+		if s.spool == nil {
+			_ = db.Close()
+			return nil, err
+		}
+		log.Warnf("[%v] 连接数据库失败，弹幕将暂存到 %v 直到重新连接: %v", dialect.name, s.spool.path, err)
+	}
+	return s, nil
+}
+
+// connect 连接数据库并执行数据库结构变更，成功后不再重复执行
+func (s *sqlSink) connect() error {
+	if atomic.LoadInt32(&s.ready) == 1 {
+		return nil
+	}
+
+	if err := s.db.Ping(); err != nil {
+		return err
+	}
+
+	var enabled []int
+	if s.partition {
+		if s.dialect.partition {
+			enabled = append(enabled, partitionVersion)
+		} else {
+			log.Warnf("[%v] 不支持分区表，将继续使用 live_<房间号> 表。", s.dialect.name)
+		}
+	}
+	if err := migrate(s.db, s.dialect, enabled...); err != nil {
+		return err
+	}
+
+	partitioned, err := isPartitioned(s.db)
+	if err != nil {
+		return err
+	}
+	s.partitioned = partitioned
+	atomic.StoreInt32(&s.ready, 1)
+	return nil
+}
+
+func (s *sqlSink) Write(ev *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buffer = append(s.buffer, *ev)
+	return nil
+}
+
+func (s *sqlSink) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	data := s.buffer
+	s.buffer = nil
+	s.mu.Unlock()
+
+	if err := s.connect(); err != nil {
+		return s.spoolEvents(data, fmt.Errorf("连接数据库失败: %w", err))
+	}
+
+	// 先写入暂存的弹幕以保持顺序
+	if s.spool != nil && s.spool.Depth() > 0 {
+		// 数据库暂时无法连接时不计入暂存弹幕的失败次数
+		if err := s.db.Ping(); err != nil {
+			return s.spoolEvents(data, fmt.Errorf("连接数据库失败: %w", err))
+		}
+		depth := s.spool.Depth()
+		if err := s.spool.Replay(spoolBatch, s.save); err != nil {
+			return s.spoolEvents(data, fmt.Errorf("写入暂存弹幕失败: %w", err))
+		}
+		log.Infof("[%v] 已重放 %v 条暂存弹幕。", s.dialect.name, depth)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	failed, _, err := s.save(data)
+	if len(failed) > 0 {
+		return s.spoolEvents(failed, err)
+	}
+	return err
+}
+
+func (s *sqlSink) Close() error {
+	err := s.Flush()
+	if closeErr := s.db.Close(); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// save 按房间写入弹幕，其他指令写入 live_event。
+// failed 为事务失败 (例如连接中断) 而未写入、可以重试的记录，rejected 为被数据库逐条拒绝而略过的记录
+func (s *sqlSink) save(data []Event) (failed, rejected []Event, err error) {
+	// 按房间分组，保持接收顺序
+	var order []int64
+	var commands []Event
+	rooms := make(map[int64][]Event)
+	for _, v := range data {
+		if v.Cmd != "" {
+			commands = append(commands, v)
+			continue
+		}
+		if _, ok := rooms[v.RoomId]; !ok {
+			order = append(order, v.RoomId)
+		}
+		rooms[v.RoomId] = append(rooms[v.RoomId], v)
+	}
+
+	var errs []string
+	var lines int64 = 0
+	for _, roomid := range order {
+		line, skipped, err := s.saveRoom(roomid, rooms[roomid])
+		rejected = append(rejected, skipped...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("保存房间 %v 的弹幕错误: %v", roomid, err))
+			failed = append(failed, rooms[roomid]...)
+		}
+		lines += line
+	}
+	if len(order) > 0 {
+		log.Infof("[%v] 保存弹幕成功。总条目数: %v", s.dialect.name, lines)
+	}
+
+	if len(commands) > 0 {
+		line, skipped, err := s.saveCommands(commands)
+		rejected = append(rejected, skipped...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("保存指令错误: %v", err))
+			failed = append(failed, commands...)
+		} else {
+			log.Debugf("[%v] 保存指令成功。总条目数: %v", s.dialect.name, line)
+		}
+	}
+	return failed, rejected, joinErrors(errs)
+}
+
+// spoolEvents 将写入失败的弹幕加入暂存文件
+func (s *sqlSink) spoolEvents(data []Event, cause error) error {
+	if len(data) == 0 {
+		return cause
+	}
+	if s.spool == nil {
+		return fmt.Errorf("%v, 已丢弃 %v 条弹幕", cause, len(data))
+	}
+	if err := s.spool.Append(data); err != nil {
+		return fmt.Errorf("%v, 暂存弹幕失败: %v", cause, err)
+	}
+	return fmt.Errorf("%v, 已暂存 %v 条弹幕", cause, len(data))
+}
+
+// saveRoom 写入单个房间的弹幕
+func (s *sqlSink) saveRoom(roomid int64, data []Event) (int64, []Event, error) {
+	if err := s.ensureRoomTable(roomid); err != nil {
+		return 0, nil, fmt.Errorf("创建表错误: %w", err)
+	}
+	query := fmt.Sprintf("INSERT INTO %s(roomid,time,uid,username,msg,price,type,gift_id,gift_name,gift_count,coin_type,unit_price,guard_level) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)", roomTable(roomid))
+	return s.insertBatch(query, data, func(v *Event) []interface{} {
+		return []interface{}{v.RoomId, v.Time, v.UID, v.Uname, v.Msg, v.Price,
+			nullString(v.Type), nullInt(v.GiftID), nullString(v.GiftName), nullInt(v.GiftCount), nullString(v.CoinType), nullInt(v.UnitPrice), nullInt(int64(v.GuardLevel))}
+	}, rollupViewers)
+}
+
+// rollupKey viewer_daily 表的主键
+type rollupKey struct {
+	roomid, day, uid int64
+}
+
+// rollupViewers 将成功写入的弹幕按日期及用户汇总到 viewer_daily 表
+func rollupViewers(tx *sql.Tx, data []Event) error {
+	var order []rollupKey
+	rows := make(map[rollupKey]*LeaderboardEntry)
+	for i := range data {
+		v := &data[i]
+		if v.UID == 0 {
+			continue
+		}
+		key := rollupKey{roomid: v.RoomId, day: rollupDay(v.Time), uid: v.UID}
+		row, ok := rows[key]
+		if !ok {
+			row = &LeaderboardEntry{}
+			rows[key] = row
+			order = append(order, key)
+		}
+		if v.Uname != "" {
+			row.Uname = v.Uname
+		}
+		switch v.Type {
+		case TypeDanmaku:
+			row.Danmaku++
+		case TypeGift:
+			row.Gift += v.Revenue()
+		case TypeGuard:
+			row.Guard += v.Revenue()
+		case TypeSuperChat:
+			row.SuperChat += v.Revenue()
+		}
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO viewer_daily(roomid,day,uid,username,danmaku,gift,guard,super_chat) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		ON CONFLICT (roomid,day,uid) DO UPDATE SET
+			username = COALESCE(excluded.username, viewer_daily.username),
+			danmaku = viewer_daily.danmaku + excluded.danmaku,
+			gift = viewer_daily.gift + excluded.gift,
+			guard = viewer_daily.guard + excluded.guard,
+			super_chat = viewer_daily.super_chat + excluded.super_chat`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, key := range order {
+		row := rows[key]
+		if _, err := stmt.Exec(key.roomid, key.day, key.uid, nullString(row.Uname), row.Danmaku, row.Gift, row.Guard, row.SuperChat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveCommands 将其他指令写入 live_event 表
+func (s *sqlSink) saveCommands(data []Event) (int64, []Event, error) {
+	return s.insertBatch("INSERT INTO live_event(roomid,time,cmd,uid,payload) VALUES ($1,$2,$3,$4,$5)", data, func(v *Event) []interface{} {
+		return []interface{}{v.RoomId, v.Time, v.Cmd, v.UID, string(v.Payload)}
+	}, nil)
+}
+
+// insertBatch 在一个事务内使用预编译语句批量写入。
+// 先以整批写入，失败时回滚并逐条重试，令单条错误不会影响同批的其他记录。
+// after 不为 nil 时在提交前以同一事务处理成功写入的记录。
+// 返回写入的数量及逐条重试时被拒绝的记录，连接中断等事务错误时整批都未写入。
+func (s *sqlSink) insertBatch(query string, data []Event, args func(v *Event) []interface{}, after func(tx *sql.Tx, inserted []Event) error) (int64, []Event, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, nil, err
+	}
+	defer stmt.Close()
+
+	// 整批写入
+	if _, err := tx.Exec("SAVEPOINT batch"); err != nil {
+		_ = tx.Rollback()
+		return 0, nil, err
+	}
+
+	failed := false
+	for i := range data {
+		if _, err := stmt.Exec(args(&data[i])...); err != nil {
+			failed = true
+			break
+		}
+	}
+
+	if !failed {
+		if after != nil {
+			if err := after(tx, data); err != nil {
+				_ = tx.Rollback()
+				return 0, nil, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, nil, err
+		}
+		return int64(len(data)), nil, nil
+	}
+
+	if _, err := tx.Exec("ROLLBACK TO SAVEPOINT batch"); err != nil {
+		_ = tx.Rollback()
+		return 0, nil, err
+	}
+
+	// 逐条写入，出错的记录只回滚自身
+	var inserted, rejected []Event
+	for i := range data {
+		v := &data[i]
+		if _, err := tx.Exec("SAVEPOINT row"); err != nil {
+			_ = tx.Rollback()
+			return 0, nil, err
+		}
+		if _, err := stmt.Exec(args(v)...); err != nil {
+			// 连接中断时不是这条记录的问题，整批留待重试
+			if errors.Is(err, driver.ErrBadConn) {
+				_ = tx.Rollback()
+				return 0, nil, err
+			}
+			if v.Cmd != "" {
+				log.Warnf("保存指令错误，已略过: %v (%v: %s)", err, v.Cmd, v.Payload)
+			} else {
+				log.Warnf("保存弹幕错误，已略过: %v (%v: %q)", err, v.Uname, v.Msg)
+			}
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT row"); err != nil {
+				_ = tx.Rollback()
+				return 0, nil, err
+			}
+			rejected = append(rejected, *v)
+			continue
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT row"); err != nil {
+			_ = tx.Rollback()
+			return 0, nil, err
+		}
+		inserted = append(inserted, *v)
+	}
+
+	if after != nil && len(inserted) > 0 {
+		if err := after(tx, inserted); err != nil {
+			_ = tx.Rollback()
+			return 0, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return int64(len(inserted)), rejected, nil
+}
+
+func (s *sqlSink) StartLive(live *Session) error {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return errNotConnected
+	}
+	res, err := s.db.Exec("UPDATE live SET sp=NULL, end_reason=NULL, title=$2, cover=$3 WHERE id=$1", live.ID, live.Title, live.Cover)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	_, err = s.db.Exec("INSERT INTO live(id,roomid,username,uid,title,cover,st,total,chatters,send_gift,guard_buy,super_chat_message,peak_popularity) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)",
+		live.ID, live.RoomId, live.Name, live.UID, live.Title, live.Cover, live.Start,
+		live.Danmaku, live.Chatters, yuan(live.Gift), yuan(live.Guard), yuan(live.SuperChat), live.PeakPopularity)
+	return err
+}
+
+func (s *sqlSink) UpdateLive(live *Session) error {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return errNotConnected
+	}
+	sp := sql.NullInt64{Int64: live.End, Valid: live.End > 0}
+	reason := nullString(live.EndReason)
+	_, err := s.db.Exec("UPDATE live SET sp=$2, end_reason=$3, total=$4, chatters=$5, send_gift=$6, guard_buy=$7, super_chat_message=$8, peak_popularity=$9 WHERE id=$1",
+		live.ID, sp, reason, live.Danmaku, live.Chatters, yuan(live.Gift), yuan(live.Guard), yuan(live.SuperChat), live.PeakPopularity)
+	return err
+}
+
+func (s *sqlSink) OpenLives() ([]*Session, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+	rows, err := s.db.Query("SELECT " + liveColumns + " FROM live WHERE sp IS NULL ORDER BY st")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// 同一房间只保留最后开始的一场
+	latest := make(map[int64]*Session)
+	for rows.Next() {
+		live, err := scanLive(rows)
+		if err != nil {
+			return nil, err
+		}
+		latest[live.RoomId] = live
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	lives := make([]*Session, 0, len(latest))
+	for _, live := range latest {
+		lives = append(lives, live)
+	}
+	return lives, nil
+}
+
+// liveColumns 直播场次的栏位，金额转换为毫元
+const liveColumns = `id, roomid, COALESCE(username,''), COALESCE(uid,0), COALESCE(title,''), COALESCE(cover,''), st,
+	COALESCE(sp,0), COALESCE(end_reason,''), COALESCE(total,0), COALESCE(chatters,0),
+	CAST(ROUND(COALESCE(send_gift,0)*1000) AS bigint), CAST(ROUND(COALESCE(guard_buy,0)*1000) AS bigint),
+	CAST(ROUND(COALESCE(super_chat_message,0)*1000) AS bigint), COALESCE(peak_popularity,0)`
+
+func scanLive(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	live := &Session{}
+	err := row.Scan(&live.ID, &live.RoomId, &live.Name, &live.UID, &live.Title, &live.Cover, &live.Start, &live.End, &live.EndReason,
+		&live.Danmaku, &live.Chatters, &live.Gift, &live.Guard, &live.SuperChat, &live.PeakPopularity)
+	return live, err
+}
+
+func (s *sqlSink) Chatters(live *Session) ([]int64, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+	if err := s.ensureRoomTable(live.RoomId); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT DISTINCT uid FROM "+roomTable(live.RoomId)+" WHERE time >= $1 AND type = $2", live.Start, TypeDanmaku)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []int64
+	for rows.Next() {
+		var uid int64
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+func (s *sqlSink) QueryHistory(ctx context.Context, q *HistoryQuery, fn func(*Record) error) (string, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return "", errNotConnected
+	}
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	in := func(column string, values []string) string {
+		params := make([]string, len(values))
+		for i, v := range values {
+			params[i] = arg(v)
+		}
+		return fmt.Sprintf("%s IN (%s)", column, strings.Join(params, ","))
+	}
+
+	events := len(q.Cmds) > 0
+	var table, columns string
+	if events {
+		table = "live_event"
+		columns = "roomid, time, COALESCE(uid,0), cmd, payload"
+		where = append(where, "roomid = "+arg(q.RoomId), in("cmd", q.Cmds))
+		if q.Keyword != "" {
+			where = append(where, "CAST(payload AS text) LIKE "+arg("%"+escapeLike(q.Keyword)+"%")+` ESCAPE '\'`)
+		}
+	} else {
+		if exists, err := s.hasRoomTable(ctx, q.RoomId); err != nil || !exists {
+			return "", err
+		}
+		table = roomTable(q.RoomId)
+		columns = danmakuColumns
+		if len(q.Types) > 0 {
+			where = append(where, in("type", q.Types))
+		}
+		if q.Keyword != "" {
+			where = append(where, "msg LIKE "+arg("%"+escapeLike(q.Keyword)+"%")+` ESCAPE '\'`)
+		}
+	}
+
+	id := s.dialect.rowID
+	if q.From > 0 {
+		where = append(where, "time >= "+arg(q.From))
+	}
+	if q.To > 0 {
+		where = append(where, "time <= "+arg(q.To))
+	}
+	if q.UID > 0 {
+		where = append(where, "uid = "+arg(q.UID))
+	}
+	if q.Cursor != "" {
+		cursor, err := parseCursor(q.Cursor)
+		if err != nil {
+			return "", err
+		}
+		t := arg(cursor.time)
+		where = append(where, fmt.Sprintf("(time > %s OR (time = %s AND %s > %s))", t, t, id, arg(cursor.id)))
+	}
+
+	query := fmt.Sprintf("SELECT %s, %s FROM %s", id, columns, table)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY time, %s", id)
+	if q.Limit > 0 {
+		// 多取一条以判断是否有下一页
+		query += " LIMIT " + arg(q.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var last historyCursor
+	count := 0
+	for rows.Next() {
+		if q.Limit > 0 && count == q.Limit {
+			return last.String(), nil
+		}
+
+		r := &Record{}
+		if events {
+			var payload sql.NullString
+			if err := rows.Scan(&r.ID, &r.RoomId, &r.Time, &r.UID, &r.Cmd, &payload); err != nil {
+				return "", err
+			}
+			if payload.Valid {
+				r.Payload = json.RawMessage(payload.String)
+			}
+		} else {
+			if err := scanDanmaku(rows, r); err != nil {
+				return "", err
+			}
+		}
+
+		if err := fn(r); err != nil {
+			return "", err
+		}
+		last = historyCursor{time: r.Time, id: r.ID}
+		count++
+	}
+	return "", rows.Err()
+}
+
+// danmakuColumns 弹幕记录的栏位，需先选取 id 栏位
+const danmakuColumns = `roomid, time, COALESCE(uid,0), COALESCE(username,''), COALESCE(msg,''), COALESCE(price,0), COALESCE(type,''),
+	COALESCE(gift_id,0), COALESCE(gift_name,''), COALESCE(gift_count,0), COALESCE(coin_type,''), COALESCE(unit_price,0), COALESCE(guard_level,0)`
+
+func scanDanmaku(row interface{ Scan(...interface{}) error }, r *Record) error {
+	return row.Scan(&r.ID, &r.RoomId, &r.Time, &r.UID, &r.Uname, &r.Msg, &r.Price, &r.Type,
+		&r.GiftID, &r.GiftName, &r.GiftCount, &r.CoinType, &r.UnitPrice, &r.GuardLevel)
+}
+
+func (s *sqlSink) QuerySessions(ctx context.Context, q *SessionQuery) ([]*Session, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q.RoomId > 0 {
+		where = append(where, "roomid = "+arg(q.RoomId))
+	}
+	if q.From > 0 {
+		where = append(where, "st >= "+arg(q.From))
+	}
+	if q.To > 0 {
+		where = append(where, "st <= "+arg(q.To))
+	}
+
+	query := "SELECT " + liveColumns + " FROM live"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY st DESC, roomid"
+	if q.Limit > 0 {
+		query += " LIMIT " + arg(q.Limit) + " OFFSET " + arg(q.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lives := make([]*Session, 0)
+	for rows.Next() {
+		live, err := scanLive(rows)
+		if err != nil {
+			return nil, err
+		}
+		lives = append(lives, live)
+	}
+	return lives, rows.Err()
+}
+
+func (s *sqlSink) QuerySession(ctx context.Context, id string, top int) (*SessionSummary, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+
+	live, err := scanLive(s.db.QueryRowContext(ctx, "SELECT "+liveColumns+" FROM live WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	summary := summarize(live)
+	if top <= 0 {
+		return summary, nil
+	}
+	if exists, err := s.hasRoomTable(ctx, live.RoomId); err != nil || !exists {
+		return summary, err
+	}
+
+	// 只统计直播期间的弹幕记录
+	args := []interface{}{live.Start, top}
+	during := "time >= $1"
+	if live.End > 0 {
+		args = append(args, live.End)
+		during += " AND time <= $3"
+	}
+	table := roomTable(live.RoomId)
+
+	summary.TopChatters, err = s.queryViewers(ctx, fmt.Sprintf(`SELECT uid, MAX(username), COUNT(*), 0 FROM %s
+		WHERE %s AND type = 'danmaku' GROUP BY uid ORDER BY COUNT(*) DESC, uid LIMIT $2`, table, during), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	summary.TopGifters, err = s.queryViewers(ctx, fmt.Sprintf(`SELECT uid, MAX(username), COUNT(*), SUM(%s) AS revenue FROM %s
+		WHERE %s AND type IN ('gift', 'guard', 'super_chat') GROUP BY uid HAVING SUM(%s) > 0 ORDER BY revenue DESC, uid LIMIT $2`,
+		revenueColumn, table, during, revenueColumn), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// revenueColumn 以 SQL 计算一条弹幕记录的收入 (毫元)，与 Event.Revenue 相同
+const revenueColumn = `CASE
+		WHEN type = 'super_chat' THEN COALESCE(unit_price,0)
+		WHEN type = 'guard' OR coin_type = 'gold' THEN COALESCE(unit_price,0) * COALESCE(gift_count,0)
+		ELSE 0 END`
+
+func (s *sqlSink) queryViewers(ctx context.Context, query string, args ...interface{}) ([]*Viewer, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	viewers := make([]*Viewer, 0)
+	for rows.Next() {
+		v := &Viewer{}
+		var uname sql.NullString
+		if err := rows.Scan(&v.UID, &uname, &v.Count, &v.Revenue); err != nil {
+			return nil, err
+		}
+		v.Uname = uname.String
+		viewers = append(viewers, v)
+	}
+	return viewers, rows.Err()
+}
+
+func (s *sqlSink) Search(ctx context.Context, q *SearchQuery) ([]*SearchHit, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+
+	tables, err := s.queryTables(ctx, q.RoomId)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []*SearchHit
+	for _, table := range tables {
+		found, err := s.searchTable(ctx, table, q)
+		if err != nil {
+			return nil, err
+		}
+		hits = sortHits(append(hits, found...), q.Limit)
+	}
+
+	if q.Context > 0 {
+		for _, hit := range hits {
+			if err := s.searchContext(ctx, hit, q.Context); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hits, nil
+}
+
+// searchTable 搜索一张弹幕表，数据库不支持时逐条读取并在程序内比对
+func (s *sqlSink) searchTable(ctx context.Context, table string, q *SearchQuery) ([]*SearchHit, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.RoomId > 0 {
+		where = append(where, "roomid = "+arg(q.RoomId))
+	}
+	if q.From > 0 {
+		where = append(where, "time >= "+arg(q.From))
+	}
+	if q.To > 0 {
+		where = append(where, "time <= "+arg(q.To))
+	}
+	if q.Username != "" {
+		where = append(where, "username = "+arg(q.Username))
+	}
+	if q.UID > 0 {
+		where = append(where, "uid = "+arg(q.UID))
+	}
+
+	matcher := newSearchMatcher(q.Query)
+	where = append(where, "msg IS NOT NULL")
+	if like := s.dialect.ilike; like != "" {
+		for _, term := range matcher.include {
+			where = append(where, fmt.Sprintf("msg %s %s", like, arg(likePattern(term))))
+		}
+		for _, term := range matcher.exclude {
+			where = append(where, fmt.Sprintf("msg NOT %s %s", like, arg(likePattern(term))))
+		}
+		matcher = nil
+	}
+
+	id := s.dialect.rowID
+	query := fmt.Sprintf("SELECT %s, %s FROM %s", id, danmakuColumns, table)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY time DESC, %s DESC", id)
+	if matcher == nil && q.Limit > 0 {
+		query += " LIMIT " + arg(q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []*SearchHit
+	for rows.Next() {
+		r := &Record{}
+		if err := scanDanmaku(rows, r); err != nil {
+			return nil, err
+		}
+		if matcher != nil && !matcher.match(r.Msg) {
+			continue
+		}
+		hits = append(hits, &SearchHit{Record: r})
+		if q.Limit > 0 && len(hits) >= q.Limit {
+			break
+		}
+	}
+	return hits, rows.Err()
+}
+
+// searchContext 读取搜索结果在同一房间中前后各 n 条记录
+func (s *sqlSink) searchContext(ctx context.Context, hit *SearchHit, n int) error {
+	id := s.dialect.rowID
+	query := func(cond, order string) ([]*Record, error) {
+		rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s ORDER BY time %s, %s %s LIMIT $3",
+			id, danmakuColumns, roomTable(hit.RoomId), fmt.Sprintf(cond, id), order, id, order), hit.Time, hit.ID, n)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var records []*Record
+		for rows.Next() {
+			r := &Record{}
+			if err := scanDanmaku(rows, r); err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+		return records, rows.Err()
+	}
+
+	before, err := query("(time < $1 OR (time = $1 AND %s < $2))", "DESC")
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+	hit.Before = before
+
+	hit.After, err = query("(time > $1 OR (time = $1 AND %s > $2))", "ASC")
+	return err
+}
+
+func (s *sqlSink) QueryViewer(ctx context.Context, uid int64) (*ViewerProfile, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+
+	tables, err := s.queryTables(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &ViewerProfile{UID: uid, Rooms: make([]*ViewerRoom, 0), Names: make([]*ViewerName, 0)}
+	names := make(map[string]*ViewerName)
+
+	for _, table := range tables {
+		rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT roomid,
+			COUNT(CASE WHEN type = 'danmaku' THEN 1 END),
+			COALESCE(SUM(CASE WHEN type = 'gift' AND coin_type = 'gold' THEN unit_price * gift_count END), 0),
+			COALESCE(SUM(CASE WHEN type = 'guard' THEN unit_price * gift_count END), 0),
+			COALESCE(SUM(CASE WHEN type = 'super_chat' THEN unit_price END), 0),
+			MIN(time), MAX(time)
+			FROM %s WHERE uid = $1 GROUP BY roomid`, table), uid)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			room := &ViewerRoom{}
+			if err := rows.Scan(&room.RoomId, &room.Danmaku, &room.Gift, &room.Guard, &room.SuperChat, &room.FirstSeen, &room.LastSeen); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			profile.Rooms = append(profile.Rooms, room)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		rows, err = s.db.QueryContext(ctx, fmt.Sprintf("SELECT username, MIN(time), MAX(time) FROM %s WHERE uid = $1 AND username IS NOT NULL GROUP BY username", table), uid)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			name := &ViewerName{}
+			if err := rows.Scan(&name.Username, &name.FirstSeen, &name.LastSeen); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if exist, ok := names[name.Username]; ok {
+				exist.merge(name)
+				continue
+			}
+			names[name.Username] = name
+			profile.Names = append(profile.Names, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(profile.Rooms) == 0 {
+		return nil, ErrViewerNotFound
+	}
+	profile.summarize()
+	return profile, nil
+}
+
+// leaderboardOrder 排行榜的排序栏位
+var leaderboardOrder = map[string]string{
+	BySpend:     "gift + guard + super_chat",
+	BySuperChat: "super_chat",
+	ByDanmaku:   "danmaku",
+}
+
+func (s *sqlSink) QueryLeaderboard(ctx context.Context, q *LeaderboardQuery) ([]*LeaderboardEntry, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return nil, errNotConnected
+	}
+	order, ok := leaderboardOrder[q.By]
+	if !ok {
+		return nil, fmt.Errorf("无效的排序方式: %q", q.By)
+	}
+
+	var inner string
+	args := []interface{}{q.RoomId}
+	if q.Rollup {
+		inner = `SELECT uid, MAX(username) AS username, SUM(danmaku) AS danmaku, SUM(gift) AS gift, SUM(guard) AS guard, SUM(super_chat) AS super_chat
+			FROM viewer_daily WHERE roomid = $1 AND day >= $2 AND day <= $3 GROUP BY uid`
+		args = append(args, rollupDay(q.From), rollupDay(q.To))
+	} else {
+		if exists, err := s.hasRoomTable(ctx, q.RoomId); err != nil || !exists {
+			return make([]*LeaderboardEntry, 0), err
+		}
+		inner = fmt.Sprintf(`SELECT uid, MAX(username) AS username,
+			COUNT(CASE WHEN type = 'danmaku' THEN 1 END) AS danmaku,
+			COALESCE(SUM(CASE WHEN type = 'gift' AND coin_type = 'gold' THEN unit_price * gift_count END), 0) AS gift,
+			COALESCE(SUM(CASE WHEN type = 'guard' THEN unit_price * gift_count END), 0) AS guard,
+			COALESCE(SUM(CASE WHEN type = 'super_chat' THEN unit_price END), 0) AS super_chat
+			FROM %s WHERE roomid = $1 AND time >= $2 AND time <= $3 AND uid IS NOT NULL GROUP BY uid`, roomTable(q.RoomId))
+		args = append(args, q.From, q.To)
+	}
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT uid, COALESCE(username,''), danmaku, gift, guard, super_chat FROM (%s) board
+		WHERE %s > 0 ORDER BY %s DESC, uid LIMIT $4`, inner, order, order), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*LeaderboardEntry, 0)
+	for rows.Next() {
+		e := &LeaderboardEntry{Rank: len(entries) + 1}
+		if err := rows.Scan(&e.UID, &e.Uname, &e.Danmaku, &e.Gift, &e.Guard, &e.SuperChat); err != nil {
+			return nil, err
+		}
+		e.Spend = e.Gift + e.Guard + e.SuperChat
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// queryTables 返回查询时需要读取的弹幕表，roomid 为 0 时为所有房间
+func (s *sqlSink) queryTables(ctx context.Context, roomid int64) ([]string, error) {
+	if roomid > 0 {
+		if exists, err := s.hasRoomTable(ctx, roomid); err != nil || !exists {
+			return nil, err
+		}
+		return []string{roomTable(roomid)}, nil
+	}
+	if s.partitioned {
+		return []string{"danmaku"}, nil
+	}
+	rooms, err := roomTables(ctx, s.db, s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, len(rooms))
+	for i, room := range rooms {
+		tables[i] = roomTable(room)
+	}
+	return tables, nil
+}
+
+// hasRoomTable 检查房间的弹幕表是否存在，查询时不为没有记录的房间建表
+func (s *sqlSink) hasRoomTable(ctx context.Context, roomid int64) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, s.dialect.tableExists, fmt.Sprintf("live_%d", roomid)).Scan(&count)
+	return count > 0, err
+}
+
+// ensureRoomTable 建立房间的弹幕表及其索引
+func (s *sqlSink) ensureRoomTable(roomid int64) error {
+	if s.tables.Contains(roomid) {
+		return nil
+	}
+
+	table := roomTable(roomid)
+	var stmts []string
+	if s.partitioned {
+		stmts = []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF danmaku FOR VALUES IN (%d)", table, roomid)}
+	} else {
+		stmts = append([]string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s(%s)", table, roomColumns(s.dialect, roomid))}, roomIndexes(s.dialect, roomid)...)
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	s.tables.Add(roomid)
+	return nil
+}
+
+// roomColumns 返回房间弹幕表的栏位定义
+func roomColumns(d *sqlDialect, roomid int64) string {
+	columns := append([]string{
+		fmt.Sprintf("roomid bigint NOT NULL DEFAULT %d,time bigint,uid bigint,username text,msg text,price double precision", roomid),
+	}, typedColumns...)
+	if d.idColumn != "" {
+		columns = append(columns, d.idColumn)
+	}
+	return strings.Join(columns, ",")
+}
+
+// yuan 将毫元转换为 live 表使用的元
+func yuan(milli int64) float64 {
+	return float64(milli) / 1000
+}
+
+func nullString(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+func nullInt(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
+}
+
+// likePattern 返回以 LIKE 比对子字串的模式，转义其中的 %, _ 及 \
+func likePattern(term string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+}
+
+// roomTable 返回房间的弹幕表名
+func roomTable(roomid int64) string {
+	return quoteIdent(fmt.Sprintf("live_%d", roomid))
+}
+
+func quoteIdent(name string) string {
+	return pq.QuoteIdentifier(name)
+}
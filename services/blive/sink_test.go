@@ -0,0 +1,199 @@
+package blive
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestSqliteSink(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	live := newSession(&LiveInfo{RoomId: 545, UID: 1, Name: "tester", Title: "title"}, 100)
+	if err := sink.StartLive(live); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []Event{
+		{RoomId: 545, Time: 101, UID: 2, Uname: "a'b\\c", Msg: "it's 弹幕", Type: TypeDanmaku},
+		{RoomId: 545, Time: 102, UID: 3, Uname: "b", Msg: "投喂 辣条", Price: 0.1,
+			Type: TypeGift, GiftID: 1, GiftName: "辣条", GiftCount: 2, CoinType: "gold", UnitPrice: 100},
+		{RoomId: 545, Time: 103, UID: 4, Uname: "c", Msg: "赠送 舰长", Price: 198,
+			Type: TypeGuard, GiftName: "舰长", GiftCount: 1, CoinType: "gold", UnitPrice: 198000, GuardLevel: 3},
+		{RoomId: 545, Time: 104, UID: 5, Uname: "d", Msg: "SC", Price: 30, Type: TypeSuperChat, UnitPrice: 30000},
+	}
+	for i := range events {
+		if err := sink.Write(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var uname string
+	if err := sink.db.QueryRow("SELECT username FROM live_545 WHERE uid = $1", 2).Scan(&uname); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uname, "a'b\\c")
+
+	var giftName, coinType string
+	var giftCount, unitPrice int64
+	if err := sink.db.QueryRow("SELECT gift_name, gift_count, coin_type, unit_price FROM live_545 WHERE type = $1", TypeGift).Scan(&giftName, &giftCount, &coinType, &unitPrice); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, giftName, "辣条")
+	assert.Equal(t, giftCount, int64(2))
+	assert.Equal(t, coinType, "gold")
+	assert.Equal(t, unitPrice, int64(100))
+
+	for i := range events {
+		live.addEvent(&events[i])
+	}
+	live.addPopularity(1000)
+	if err := sink.UpdateLive(live); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后恢复进行中的直播场次
+	lives, err := sink.OpenLives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(lives), 1)
+	assert.Equal(t, lives[0].ID, "545-100")
+	assert.Equal(t, lives[0].Danmaku, int64(1))
+	assert.Equal(t, lives[0].PeakPopularity, int64(1000))
+	assert.Equal(t, lives[0].Gift, int64(200))
+	assert.Equal(t, lives[0].Guard, int64(198000))
+	assert.Equal(t, lives[0].SuperChat, int64(30000))
+
+	chatters, err := sink.Chatters(lives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, chatters, []int64{2})
+
+	live.End, live.EndReason = 200, EndPreparing
+	if err := sink.UpdateLive(live); err != nil {
+		t.Fatal(err)
+	}
+
+	var total, chatterCount, sp int64
+	var gift, guard, sc float64
+	var reason string
+	if err := sink.db.QueryRow("SELECT total, chatters, sp, end_reason, send_gift, guard_buy, super_chat_message FROM live WHERE id = '545-100'").Scan(&total, &chatterCount, &sp, &reason, &gift, &guard, &sc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, total, int64(1))
+	assert.Equal(t, chatterCount, int64(1))
+	assert.Equal(t, sp, int64(200))
+	assert.Equal(t, reason, EndPreparing)
+	assert.Equal(t, gift, 0.2)
+	assert.Equal(t, guard, 198.0)
+	assert.Equal(t, sc, 30.0)
+
+	lives, err = sink.OpenLives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(lives), 0)
+
+	// 同一场直播重新开启时不会新增记录
+	if err := sink.StartLive(live); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := sink.db.QueryRow("SELECT COUNT(*) FROM live").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, count, 1)
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := openFileSink(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := sink.Write(&Event{RoomId: 545, Time: int64(i), UID: 1, Uname: "tester", Msg: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "danmaku-*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected rotated files, got %v", files)
+	}
+
+	count := 0
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var ev Event
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ev.RoomId, int64(545))
+			count++
+		}
+		_ = file.Close()
+	}
+	assert.Equal(t, count, 5)
+}
+
+func TestSqliteSinkCommands(t *testing.T) {
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(t.TempDir(), "danmaku.db"), false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	events := []Event{
+		{RoomId: 545, Time: 101, UID: 2, Msg: "hello"},
+		{RoomId: 545, Time: 102, UID: 3, Cmd: "GUARD_BUY", Payload: json.RawMessage(`{"cmd":"GUARD_BUY","data":{"uid":3}}`)},
+	}
+	for i := range events {
+		if err := sink.Write(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var danmaku int
+	if err := sink.db.QueryRow("SELECT COUNT(*) FROM live_545").Scan(&danmaku); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, danmaku, 1)
+
+	var cmd, payload string
+	var uid int64
+	if err := sink.db.QueryRow("SELECT cmd, uid, payload FROM live_event WHERE roomid = 545").Scan(&cmd, &uid, &payload); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cmd, "GUARD_BUY")
+	assert.Equal(t, uid, int64(3))
+	assert.Equal(t, payload, `{"cmd":"GUARD_BUY","data":{"uid":3}}`)
+}
@@ -0,0 +1,376 @@
+package blive
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolMetrics 暂存文件的状态，可从 /debug/vars 查看
+var spoolMetrics = expvar.NewMap("danmaku_spool")
+
+const (
+	// spoolRetryDelay 暂存弹幕写入失败后首次重试前的等待时间，之后每次失败加倍
+	spoolRetryDelay = 5 * time.Second
+	// spoolMaxRetryDelay 暂存弹幕重试的最长等待时间
+	spoolMaxRetryDelay = 5 * time.Minute
+)
+
+// spool 数据库不可用时暂存弹幕的追加写入文件。
+// 重放进度记录在 .offset 文件，全部重放后删除暂存文件。
+// 写入失败的弹幕保留在暂存文件中等待重试，只有被数据库逐条拒绝的弹幕会移到
+// .failed.ndjson 隔离文件，以免阻塞之后的弹幕。
+type spool struct {
+	path   string
+	offset string
+	failed string
+	// maxSize 尚未重放的最大字节数，超过后丢弃新的弹幕，0 为不限制
+	maxSize int64
+
+	mu sync.Mutex
+	// attempts 暂存弹幕连续写入失败的次数
+	attempts int
+	// retryAt 写入失败后下次重放的时间
+	retryAt     time.Time
+	depth       *expvar.Int
+	bytes       *expvar.Int
+	dropped     *expvar.Int
+	quarantined *expvar.Int
+}
+
+func openSpool(dir, name string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		path:        filepath.Join(dir, name+".ndjson"),
+		offset:      filepath.Join(dir, name+".offset"),
+		failed:      filepath.Join(dir, name+".failed.ndjson"),
+		maxSize:     maxSize,
+		depth:       new(expvar.Int),
+		bytes:       new(expvar.Int),
+		dropped:     new(expvar.Int),
+		quarantined: new(expvar.Int),
+	}
+	spoolMetrics.Set(name+"_depth", s.depth)
+	spoolMetrics.Set(name+"_bytes", s.bytes)
+	spoolMetrics.Set(name+"_dropped", s.dropped)
+	spoolMetrics.Set(name+"_quarantined", s.quarantined)
+
+	// 统计上次运行时遗留的弹幕
+	offset, err := s.readOffset()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			s.depth.Add(1)
+			s.bytes.Add(int64(len(line)))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if depth := s.depth.Value(); depth > 0 {
+		log.Infof("暂存文件 %v 尚有 %v 条弹幕等待写入。", s.path, depth)
+	}
+	return s, nil
+}
+
+// Depth 返回尚未重放的弹幕数量
+func (s *spool) Depth() int64 {
+	return s.depth.Value()
+}
+
+// Append 将弹幕追加到暂存文件，超过大小上限的弹幕会被丢弃并返回错误
+func (s *spool) Append(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines := make([][]byte, 0, len(events))
+	var size int64
+	for i := range events {
+		b, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		if s.maxSize > 0 && s.bytes.Value()+size+int64(len(b))+1 > s.maxSize {
+			break
+		}
+		lines = append(lines, append(b, '\n'))
+		size += int64(len(b)) + 1
+	}
+
+	if err := appendLines(s.path, lines); err != nil {
+		return err
+	}
+	s.depth.Add(int64(len(lines)))
+	s.bytes.Add(size)
+
+	if dropped := len(events) - len(lines); dropped > 0 {
+		s.dropped.Add(int64(dropped))
+		return fmt.Errorf("暂存文件已达上限 %v 字节，已丢弃 %v 条弹幕", s.maxSize, dropped)
+	}
+	return nil
+}
+
+// quarantine 将无法写入的弹幕移到隔离文件
+func (s *spool) quarantine(events []Event) error {
+	lines := make([][]byte, 0, len(events))
+	for i := range events {
+		b, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		lines = append(lines, append(b, '\n'))
+	}
+	if err := appendLines(s.failed, lines); err != nil {
+		return err
+	}
+	s.quarantined.Add(int64(len(events)))
+	return nil
+}
+
+// appendLines 将每行追加到文件并写入磁盘
+func appendLines(path string, lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		if _, err := writer.Write(line); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Replay 按写入顺序每次读取最多 batch 条弹幕交给 save。
+// save 返回写入失败的弹幕 (例如房间的事务失败) 及被数据库逐条拒绝的弹幕：
+// 被拒绝的弹幕移到隔离文件；写入失败的弹幕保留在暂存文件中，进度停在它们之前，
+// 等待一段时间 (每次失败加倍) 后再重试，同一批已写入的弹幕不会再重放。
+func (s *spool) Replay(batch int, save func([]Event) (failed, rejected []Event, err error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.depth.Value() == 0 {
+		return nil
+	}
+	if wait := time.Until(s.retryAt); wait > 0 {
+		return fmt.Errorf("暂存弹幕上次写入失败，将于 %v 后重试", wait.Round(time.Second))
+	}
+
+	offset, err := s.readOffset()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		s.reset()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		events := make([]Event, 0, batch)
+		var read, lines int64
+		var eof bool
+		for lines < int64(batch) {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				// 不完整的最后一行为写入中断的残留，略过
+				eof = true
+				break
+			} else if err != nil {
+				return err
+			}
+			read += int64(len(line))
+			lines++
+			var ev Event
+			if err := json.Unmarshal(line, &ev); err != nil {
+				log.Warnf("暂存文件 %v 中有无法解析的弹幕，已略过: %v", s.path, err)
+				continue
+			}
+			events = append(events, ev)
+		}
+
+		if len(events) > 0 {
+			failed, rejected, err := save(events)
+			if len(rejected) > 0 {
+				if err := s.quarantine(rejected); err != nil {
+					return err
+				}
+				log.Warnf("暂存文件 %v 中有 %v 条弹幕被数据库拒绝，已移到 %v", s.path, len(rejected), s.failed)
+			}
+			if len(failed) > 0 {
+				s.attempts++
+				delay := spoolRetryDelay << (s.attempts - 1)
+				if delay <= 0 || delay > spoolMaxRetryDelay {
+					delay = spoolMaxRetryDelay
+				}
+				s.retryAt = time.Now().Add(delay)
+				log.Warnf("暂存文件 %v 中的 %v 条弹幕写入失败，%v 后重试: %v", s.path, len(failed), delay, err)
+
+				// 整批失败时进度不变，否则只保留失败的弹幕，已写入的弹幕不再重放
+				if len(failed) < len(events) || len(rejected) > 0 {
+					_ = file.Close()
+					if err := s.requeue(failed, offset+read); err != nil {
+						return err
+					}
+					s.bytes.Add(-read)
+					s.depth.Add(-lines)
+				}
+				if err == nil {
+					err = fmt.Errorf("%v 条暂存弹幕写入失败", len(failed))
+				}
+				return err
+			}
+			s.attempts = 0
+		}
+
+		offset += read
+		s.bytes.Add(-read)
+		s.depth.Add(-lines)
+
+		if eof {
+			break
+		}
+		if err := s.writeOffset(offset); err != nil {
+			return err
+		}
+	}
+
+	// 已全部重放
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.offset); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.reset()
+	return nil
+}
+
+// requeue 以写入失败的弹幕加上 rest 位置之后尚未重放的内容重写暂存文件，并从头开始重放。
+// 进度在替换文件前先归零，中途中断时最多重复写入已写入的弹幕，不会遗失弹幕。
+func (s *spool) requeue(failed []Event, rest int64) error {
+	lines := make([][]byte, 0, len(failed))
+	var size int64
+	for i := range failed {
+		b, err := json.Marshal(&failed[i])
+		if err != nil {
+			return err
+		}
+		lines = append(lines, append(b, '\n'))
+		size += int64(len(b)) + 1
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := appendLines(tmp, lines); err != nil {
+		return err
+	}
+	if err := copyFrom(tmp, s.path, rest); err != nil {
+		return err
+	}
+	if err := s.writeOffset(0); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.depth.Add(int64(len(failed)))
+	s.bytes.Add(size)
+	return nil
+}
+
+// copyFrom 将 src 文件 offset 位置之后的内容追加到 dst 文件并写入磁盘
+func copyFrom(dst, src string, offset int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func (s *spool) reset() {
+	s.depth.Set(0)
+	s.bytes.Set(0)
+}
+
+func (s *spool) readOffset() (int64, error) {
+	b, err := os.ReadFile(s.offset)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (s *spool) writeOffset(offset int64) error {
+	tmp := s.offset + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.offset)
+}
@@ -0,0 +1,256 @@
+package blive
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	for i := 0; i < 5; i++ {
+		events = append(events, Event{RoomId: 545, Time: int64(i), Msg: "hello"})
+	}
+	if err := sp.Append(events); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sp.Depth(), int64(5))
+
+	// 第二批失败，进度停在第一批之后
+	var saved []Event
+	calls := 0
+	err = sp.Replay(2, func(batch []Event) ([]Event, []Event, error) {
+		calls++
+		if calls == 2 {
+			return batch, nil, errors.New("database down")
+		}
+		saved = append(saved, batch...)
+		return nil, nil, nil
+	})
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, len(saved), 2)
+	assert.Equal(t, sp.Depth(), int64(3))
+
+	// 重新开启后从上次进度继续
+	sp, err = openSpool(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sp.Depth(), int64(3))
+
+	if err := sp.Replay(2, func(batch []Event) ([]Event, []Event, error) {
+		saved = append(saved, batch...)
+		return nil, nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sp.Depth(), int64(0))
+	assert.Equal(t, len(saved), 5)
+	for i, ev := range saved {
+		assert.Equal(t, ev.Time, int64(i))
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test.ndjson")); !os.IsNotExist(err) {
+		t.Fatalf("spool file should be removed after replay: %v", err)
+	}
+}
+
+func TestSpoolPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sp.Append([]Event{
+		{RoomId: 545, Time: 1}, {RoomId: 114514, Time: 2}, {RoomId: 545, Time: 3}, {RoomId: 114514, Time: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 房间 114514 的事务失败一次，房间 545 已写入
+	saved := make(map[int64][]int64)
+	calls := 0
+	save := func(batch []Event) ([]Event, []Event, error) {
+		calls++
+		var failed []Event
+		for _, ev := range batch {
+			if ev.RoomId == 114514 && calls == 1 {
+				failed = append(failed, ev)
+			} else {
+				saved[ev.RoomId] = append(saved[ev.RoomId], ev.Time)
+			}
+		}
+		if len(failed) > 0 {
+			return failed, nil, errors.New("保存房间 114514 的弹幕错误")
+		}
+		return nil, nil, nil
+	}
+	assert.NotEqual(t, sp.Replay(3, save), nil)
+	assert.Equal(t, saved[545], []int64{1, 3})
+	// 失败的弹幕及尚未读取的弹幕保留在暂存文件中
+	assert.Equal(t, sp.Depth(), int64(2))
+
+	// 等待重试期间不会重放
+	assert.NotEqual(t, sp.Replay(3, save), nil)
+	assert.Equal(t, calls, 1)
+
+	// 重新开启后从保留的弹幕继续，已写入的弹幕不会再重放
+	sp, err = openSpool(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sp.Depth(), int64(2))
+	if err := sp.Replay(3, save); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, saved[545], []int64{1, 3})
+	assert.Equal(t, saved[114514], []int64{2, 4})
+	assert.Equal(t, sp.Depth(), int64(0))
+	assert.Equal(t, sp.quarantined.Value(), int64(0))
+
+	if _, err := os.Stat(filepath.Join(dir, "test.failed.ndjson")); !os.IsNotExist(err) {
+		t.Fatalf("failed events should not be quarantined: %v", err)
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	sp, err := openSpool(t.TempDir(), "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sp.Append([]Event{{RoomId: 545, Time: 1}, {RoomId: 114514, Time: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 整批持续失败时不会移到隔离文件，每次重试的等待时间加倍
+	save := func(batch []Event) ([]Event, []Event, error) {
+		return batch, nil, errors.New("database down")
+	}
+	for i := 0; i < 10; i++ {
+		sp.retryAt = time.Time{}
+		assert.NotEqual(t, sp.Replay(1, save), nil)
+		assert.Equal(t, sp.Depth(), int64(2))
+	}
+	assert.Equal(t, sp.quarantined.Value(), int64(0))
+	assert.Equal(t, time.Until(sp.retryAt) > spoolMaxRetryDelay-time.Second, true)
+
+	var saved []Event
+	sp.retryAt = time.Time{}
+	if err := sp.Replay(1, func(batch []Event) ([]Event, []Event, error) {
+		saved = append(saved, batch...)
+		return nil, nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(saved), 2)
+	assert.Equal(t, sp.attempts, 0)
+}
+
+func TestSpoolRejected(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sp.Append([]Event{
+		{RoomId: 545, Time: 1}, {RoomId: 545, Time: 2}, {RoomId: 545, Time: 3},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 被数据库逐条拒绝的弹幕移到隔离文件，不阻塞之后的弹幕
+	var saved []int64
+	if err := sp.Replay(10, func(batch []Event) ([]Event, []Event, error) {
+		var rejected []Event
+		for _, ev := range batch {
+			if ev.Time == 2 {
+				rejected = append(rejected, ev)
+			} else {
+				saved = append(saved, ev.Time)
+			}
+		}
+		return nil, rejected, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, saved, []int64{1, 3})
+	assert.Equal(t, sp.Depth(), int64(0))
+	assert.Equal(t, sp.quarantined.Value(), int64(1))
+
+	b, err := os.ReadFile(filepath.Join(dir, "test.failed.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, strings.Count(string(b), "\n"), 1)
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	sp, err := openSpool(t.TempDir(), "test", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	for i := 0; i < 10; i++ {
+		events = append(events, Event{RoomId: 545, Time: int64(i), Msg: "hello"})
+	}
+
+	// 超过上限的弹幕被丢弃
+	assert.NotEqual(t, sp.Append(events), nil)
+	assert.Equal(t, sp.bytes.Value() <= 200, true)
+	assert.Equal(t, sp.Depth()+sp.dropped.Value(), int64(10))
+	assert.Equal(t, sp.Depth() > 0, true)
+}
+
+func TestSqlSinkReplaySpool(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := openSqlSink(sqliteDialect, filepath.Join(dir, "danmaku.db"), false, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// 模拟上次数据库不可用时暂存的弹幕
+	if err := sink.spool.Append([]Event{
+		{RoomId: 545, Time: 1, UID: 1, Msg: "spooled"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(&Event{RoomId: 545, Time: 2, UID: 2, Msg: "live"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := sink.db.Query("SELECT msg FROM live_545 ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var msgs []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, msgs, []string{"spooled", "live"})
+	assert.Equal(t, sink.spool.Depth(), int64(0))
+}
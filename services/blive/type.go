@@ -8,6 +8,8 @@ type LiveInfo struct {
 	Cover           string `json:"cover"`
 	UserFace        string `json:"user_face"`
 	UserDescription string `json:"user_description"`
+	// LiveTime 本场直播的开播时间，未开播为 0
+	LiveTime int64 `json:"-"`
 }
 
 type ListeningInfo struct {
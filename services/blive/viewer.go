@@ -0,0 +1,81 @@
+package blive
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// ErrViewerNotFound 没有此用户的弹幕记录
+var ErrViewerNotFound = errors.New("没有此用户的记录")
+
+// ViewerProfile 用户在所有房间的活动统计，金额单位为毫元
+type ViewerProfile struct {
+	UID int64 `json:"uid"`
+	// Username 最近使用的名称
+	Username  string `json:"username"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Danmaku   int64  `json:"danmaku"`
+	Revenue   int64  `json:"revenue"`
+	// Rooms 按最后出现时间由新到旧排列
+	Rooms []*ViewerRoom `json:"rooms"`
+	// Names 曾使用的名称，按最后使用时间由新到旧排列
+	Names []*ViewerName `json:"names"`
+}
+
+// ViewerRoom 用户在一个房间的活动统计
+type ViewerRoom struct {
+	RoomId    int64 `json:"room_id"`
+	Danmaku   int64 `json:"danmaku"`
+	Gift      int64 `json:"gift"`
+	Guard     int64 `json:"guard"`
+	SuperChat int64 `json:"super_chat"`
+	FirstSeen int64 `json:"first_seen"`
+	LastSeen  int64 `json:"last_seen"`
+}
+
+// ViewerName 用户曾使用的名称及使用期间
+type ViewerName struct {
+	Username  string `json:"username"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
+// QueryViewer 查询用户的活动统计
+func QueryViewer(ctx context.Context, uid int64) (*ViewerProfile, error) {
+	querier := sinks.querier()
+	if querier == nil {
+		return nil, ErrNoQuerier
+	}
+	return querier.QueryViewer(ctx, uid)
+}
+
+// merge 合并不同弹幕表中同一名称的使用期间
+func (n *ViewerName) merge(other *ViewerName) {
+	if other.FirstSeen < n.FirstSeen {
+		n.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen > n.LastSeen {
+		n.LastSeen = other.LastSeen
+	}
+}
+
+// summarize 由各房间的统计计算总计并排序
+func (p *ViewerProfile) summarize() {
+	for i, room := range p.Rooms {
+		p.Danmaku += room.Danmaku
+		p.Revenue += room.Gift + room.Guard + room.SuperChat
+		if i == 0 || room.FirstSeen < p.FirstSeen {
+			p.FirstSeen = room.FirstSeen
+		}
+		if room.LastSeen > p.LastSeen {
+			p.LastSeen = room.LastSeen
+		}
+	}
+	sort.Slice(p.Rooms, func(i, j int) bool { return p.Rooms[i].LastSeen > p.Rooms[j].LastSeen })
+	sort.Slice(p.Names, func(i, j int) bool { return p.Names[i].LastSeen > p.Names[j].LastSeen })
+	if len(p.Names) > 0 {
+		p.Username = p.Names[0].Username
+	}
+}
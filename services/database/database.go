@@ -2,9 +2,9 @@ package database
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
+	"github.com/eric2788/biligo-live-ws/config"
 	"github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
 )
@@ -14,8 +14,8 @@ const (
 )
 
 var (
-	log      = logrus.WithField("service", "database")
-	strategy DbStrategy
+	log                 = logrus.WithField("service", "database")
+	strategy DbStrategy = &Singleton{}
 )
 
 type (
@@ -32,9 +32,9 @@ type (
 	}
 )
 
-func init() {
-	t := os.Getenv("DB_STRATEGY")
-	switch strings.ToLower(t) {
+// Setup 按设定选择数据库策略，须在 StartDB 前调用
+func Setup(cfg config.Database) {
+	switch strings.ToLower(cfg.Strategy) {
 	case "dynamic":
 		strategy = &Dynamic{}
 	case "mix":
@@ -0,0 +1,173 @@
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("service", "export")
+
+// Encoder 将弹幕记录逐条写入导出文件
+type Encoder interface {
+	Encode(r *blive.Record) error
+	// Close 写入文件结尾，不会关闭底层的 io.Writer
+	Close() error
+}
+
+// Format 导出格式
+type Format struct {
+	Name        string
+	Ext         string
+	ContentType string
+	// Types 未指定时导出的记录类型，为空则导出全部
+	Types []string
+	// New 建立 Encoder，start 为开播时间，记录的时间以此为零点
+	New func(w io.Writer, start int64) Encoder
+}
+
+// Formats 支持的导出格式
+var Formats = map[string]*Format{
+	"csv": {
+		Name:        "csv",
+		Ext:         "csv",
+		ContentType: "text/csv; charset=utf-8",
+		New:         newCsvEncoder,
+	},
+	"ndjson": {
+		Name:        "ndjson",
+		Ext:         "ndjson",
+		ContentType: "application/x-ndjson",
+		New:         newJsonEncoder,
+	},
+	"xml": {
+		Name:        "xml",
+		Ext:         "xml",
+		ContentType: "application/xml; charset=utf-8",
+		Types:       []string{blive.TypeDanmaku, blive.TypeSuperChat},
+		New:         newXmlEncoder,
+	},
+	"ass": {
+		Name:        "ass",
+		Ext:         "ass",
+		ContentType: "text/x-ssa; charset=utf-8",
+		Types:       []string{blive.TypeDanmaku, blive.TypeSuperChat},
+		New:         newAssEncoder,
+	},
+}
+
+// Lookup 按名称查找导出格式
+func Lookup(name string) (*Format, error) {
+	format, ok := Formats[name]
+	if !ok {
+		return nil, fmt.Errorf("不支持的导出格式: %q", name)
+	}
+	return format, nil
+}
+
+// Filename 返回直播场次导出文件的名称
+func (f *Format) Filename(live *blive.Session) string {
+	return fmt.Sprintf("%s.%s", live.ID, f.Ext)
+}
+
+// Session 将直播场次期间保存的弹幕记录以指定格式写入 w，types 为空时使用格式的预设类型
+func Session(ctx context.Context, w io.Writer, format *Format, live *blive.Session, types []string) error {
+	if len(types) == 0 {
+		types = format.Types
+	}
+
+	q := &blive.HistoryQuery{
+		RoomId: live.RoomId,
+		From:   live.Start,
+		To:     live.End,
+		Types:  types,
+	}
+
+	encoder := format.New(w, live.Start)
+	count := 0
+	if _, err := blive.QueryHistory(ctx, q, func(r *blive.Record) error {
+		count++
+		return encoder.Encode(r)
+	}); err != nil {
+		return err
+	}
+
+	log.Infof("已导出直播场次 %v 的 %v 条记录 (%v)", live.ID, count, format.Name)
+	return encoder.Close()
+}
+
+// csvEncoder 每条记录一行，offset 为相对开播时间的秒数
+type csvEncoder struct {
+	w      *csv.Writer
+	start  int64
+	header bool
+}
+
+var csvHeader = []string{"id", "time", "offset", "uid", "username", "type", "msg", "price", "gift_name", "gift_count", "unit_price", "guard_level"}
+
+func newCsvEncoder(w io.Writer, start int64) Encoder {
+	return &csvEncoder{w: csv.NewWriter(w), start: start}
+}
+
+func (e *csvEncoder) Encode(r *blive.Record) error {
+	if !e.header {
+		e.header = true
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	return e.w.Write([]string{
+		strconv.FormatInt(r.ID, 10),
+		strconv.FormatInt(r.Time, 10),
+		strconv.FormatInt(r.Time-e.start, 10),
+		strconv.FormatInt(r.UID, 10),
+		r.Uname,
+		r.Type,
+		r.Msg,
+		strconv.FormatFloat(r.Price, 'f', -1, 64),
+		r.GiftName,
+		strconv.FormatInt(r.GiftCount, 10),
+		strconv.FormatInt(r.UnitPrice, 10),
+		strconv.Itoa(r.GuardLevel),
+	})
+}
+
+func (e *csvEncoder) Close() error {
+	if !e.header {
+		e.header = true
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonEncoder 每行一条 JSON 记录，另加上相对开播时间的 offset
+type jsonEncoder struct {
+	enc   *json.Encoder
+	start int64
+}
+
+type offsetRecord struct {
+	*blive.Record
+	Offset int64 `json:"offset"`
+}
+
+func newJsonEncoder(w io.Writer, start int64) Encoder {
+	return &jsonEncoder{enc: json.NewEncoder(w), start: start}
+}
+
+func (e *jsonEncoder) Encode(r *blive.Record) error {
+	return e.enc.Encode(offsetRecord{Record: r, Offset: r.Time - e.start})
+}
+
+func (e *jsonEncoder) Close() error {
+	return nil
+}
@@ -0,0 +1,103 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+	"github.com/go-playground/assert/v2"
+)
+
+var records = []*blive.Record{
+	{ID: 1, Event: blive.Event{RoomId: 545, Time: 1010, UID: 1, Uname: "a", Msg: "早上好", Type: blive.TypeDanmaku}},
+	{ID: 2, Event: blive.Event{RoomId: 545, Time: 1010, UID: 2, Uname: "b", Msg: `<"a,b">{\pos(0,0)}`, Type: blive.TypeDanmaku}},
+	{ID: 3, Event: blive.Event{RoomId: 545, Time: 3725, UID: 3, Uname: "c", Msg: "SC", Price: 30, Type: blive.TypeSuperChat, UnitPrice: 30000}},
+}
+
+func encode(t *testing.T, name string) string {
+	format, err := Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	encoder := format.New(buf, 1000)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCsv(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(encode(t, "csv")), "\n")
+	assert.Equal(t, len(lines), 4)
+	assert.Equal(t, lines[0], strings.Join(csvHeader, ","))
+	assert.Equal(t, lines[2], `2,1010,10,2,b,danmaku,"<""a,b"">{\pos(0,0)}",0,,0,0,0`)
+	assert.Equal(t, lines[3], "3,3725,2725,3,c,super_chat,SC,30,,0,30000,0")
+}
+
+func TestNdjson(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(encode(t, "ndjson")), "\n")
+	assert.Equal(t, len(lines), 3)
+
+	var r struct {
+		ID     int64  `json:"id"`
+		Msg    string `json:"msg"`
+		Offset int64  `json:"offset"`
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &r); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, r.ID, int64(3))
+	assert.Equal(t, r.Msg, "SC")
+	assert.Equal(t, r.Offset, int64(2725))
+}
+
+func TestXml(t *testing.T) {
+	var doc struct {
+		D []struct {
+			P    string `xml:"p,attr"`
+			Text string `xml:",chardata"`
+		} `xml:"d"`
+	}
+	if err := xml.Unmarshal([]byte(encode(t, "xml")), &doc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(doc.D), 3)
+	assert.Equal(t, doc.D[1].Text, `<"a,b">{\pos(0,0)}`)
+	assert.Equal(t, strings.HasPrefix(doc.D[0].P, "10.00000,1,25,16777215,1010,0,"), true)
+	assert.Equal(t, strings.HasPrefix(doc.D[2].P, "2725.00000,5,25,16766720,3725,0,"), true)
+}
+
+func TestAss(t *testing.T) {
+	out := encode(t, "ass")
+	assert.Equal(t, strings.HasPrefix(out, "[Script Info]"), true)
+
+	var dialogues []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Dialogue:") {
+			dialogues = append(dialogues, line)
+		}
+	}
+	assert.Equal(t, len(dialogues), 3)
+
+	// 同一秒的弹幕错开出现并分配到不同轨道
+	assert.Equal(t, strings.HasPrefix(dialogues[0], "Dialogue: 0,0:00:10.00,0:00:20.00,Danmaku,,0,0,0,,{\\move(1920,0,-150,0)}早上好"), true)
+	assert.Equal(t, strings.HasPrefix(dialogues[1], "Dialogue: 0,0:00:10.10,0:00:20.10,Danmaku,,0,0,0,,{\\move(1920,54,"), true)
+	// 文字中的特效标签被转义
+	assert.Equal(t, strings.HasSuffix(dialogues[1], `<"a,b">｛＼pos(0,0)｝`), true)
+	assert.Equal(t, strings.Contains(dialogues[2], "0:45:25.00"), true)
+	assert.Equal(t, strings.Contains(dialogues[2], `\c&H00D7FF&`), true)
+}
+
+func TestLookup(t *testing.T) {
+	_, err := Lookup("srt")
+	assert.NotEqual(t, err, nil)
+}
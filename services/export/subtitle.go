@@ -0,0 +1,229 @@
+package export
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eric2788/biligo-live-ws/services/blive"
+)
+
+const (
+	colorWhite = 0xFFFFFF
+	// colorGold SC 的颜色
+	colorGold = 0xFFD700
+)
+
+// xmlEncoder B站弹幕 XML 格式，可供 B站播放器及弹幕转换工具使用
+type xmlEncoder struct {
+	w      io.Writer
+	start  int64
+	header bool
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<i>
+<chatserver>chat.bilibili.com</chatserver>
+<chatid>0</chatid>
+<mission>0</mission>
+<maxlimit>0</maxlimit>
+<state>0</state>
+<real_name>0</real_name>
+<source>k-v</source>
+`
+
+func newXmlEncoder(w io.Writer, start int64) Encoder {
+	return &xmlEncoder{w: w, start: start}
+}
+
+func (e *xmlEncoder) writeHeader() error {
+	if e.header {
+		return nil
+	}
+	e.header = true
+	_, err := io.WriteString(e.w, xmlHeader)
+	return err
+}
+
+func (e *xmlEncoder) Encode(r *blive.Record) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	// p 属性: 出现时间,模式,字号,颜色,发送时间,弹幕池,用户ID的 CRC32,弹幕ID
+	mode, color := 1, colorWhite
+	if r.Type == blive.TypeSuperChat {
+		mode, color = 5, colorGold
+	}
+	uidHash := crc32.ChecksumIEEE([]byte(strconv.FormatInt(r.UID, 10)))
+	if _, err := fmt.Fprintf(e.w, `<d p="%d.00000,%d,25,%d,%d,0,%x,%d">`, r.Time-e.start, mode, color, r.Time, uidHash, r.ID); err != nil {
+		return err
+	}
+	if err := xml.EscapeText(e.w, []byte(r.Msg)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(e.w, "</d>\n")
+	return err
+}
+
+func (e *xmlEncoder) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(e.w, "</i>\n")
+	return err
+}
+
+// ASS 字幕的画面及弹幕设定
+const (
+	assWidth    = 1920
+	assHeight   = 1080
+	assFontSize = 50
+	assLine     = assFontSize + 4
+	// assDuration 弹幕滚动经过画面的秒数
+	assDuration = 10
+)
+
+const assHeader = `[Script Info]
+ScriptType: v4.00+
+PlayResX: 1920
+PlayResY: 1080
+WrapStyle: 2
+ScaledBorderAndShadow: yes
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Danmaku,Microsoft YaHei,50,&H33FFFFFF,&H33FFFFFF,&H33000000,&H33000000,0,0,0,0,100,100,0,0,1,2,0,7,0,0,0,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+// assLane 一行弹幕轨道上最后一条弹幕的出现时间及速度
+type assLane struct {
+	start float64
+	width float64
+	speed float64
+	used  bool
+}
+
+// assEncoder ASS 字幕，弹幕由右至左滚动并分配到不重叠的轨道
+type assEncoder struct {
+	w      io.Writer
+	start  int64
+	header bool
+	lanes  []assLane
+	// second 同一秒内的弹幕依序错开出现
+	second int64
+	index  int
+}
+
+func newAssEncoder(w io.Writer, start int64) Encoder {
+	return &assEncoder{w: w, start: start, lanes: make([]assLane, assHeight/assLine)}
+}
+
+func (e *assEncoder) writeHeader() error {
+	if e.header {
+		return nil
+	}
+	e.header = true
+	_, err := io.WriteString(e.w, assHeader)
+	return err
+}
+
+func (e *assEncoder) Encode(r *blive.Record) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	text := assEscape(r.Msg)
+	if text == "" {
+		return nil
+	}
+
+	// 记录只精确到秒，同一秒内的弹幕以 0.1 秒错开
+	offset := r.Time - e.start
+	if offset != e.second {
+		e.second, e.index = offset, 0
+	}
+	start := float64(offset) + float64(e.index%10)/10
+	e.index++
+
+	width := textWidth(r.Msg)
+	speed := (assWidth + width) / assDuration
+	lane := e.allocLane(start, width, speed)
+	y := lane * assLine
+
+	override := fmt.Sprintf(`\move(%d,%d,%d,%d)`, assWidth, y, -int(width), y)
+	if r.Type == blive.TypeSuperChat {
+		override += fmt.Sprintf(`\c&H%06X&`, bgr(colorGold))
+	}
+
+	_, err := fmt.Fprintf(e.w, "Dialogue: 0,%s,%s,Danmaku,,0,0,0,,{%s}%s\n",
+		assTime(start), assTime(start+assDuration), override, text)
+	return err
+}
+
+// allocLane 选择不会与前一条弹幕重叠的轨道，都被占用时选择最早空出的轨道
+func (e *assEncoder) allocLane(start, width, speed float64) int {
+	best, bestFree := 0, 0.0
+	for i := range e.lanes {
+		lane := &e.lanes[i]
+		if !lane.used {
+			best = i
+			break
+		}
+		// 前一条弹幕完全进入画面，且在离开画面前不会被追上
+		free := lane.start + lane.width/lane.speed
+		if catchUp := lane.start + assDuration - assWidth/speed; catchUp > free {
+			free = catchUp
+		}
+		if free <= start {
+			best = i
+			break
+		}
+		if i == 0 || free < bestFree {
+			best, bestFree = i, free
+		}
+	}
+	e.lanes[best] = assLane{start: start, width: width, speed: speed, used: true}
+	return best
+}
+
+func (e *assEncoder) Close() error {
+	return e.writeHeader()
+}
+
+// textWidth 估算文字的宽度，全角字符为一个字号，半角字符为半个字号
+func textWidth(s string) float64 {
+	width := 0.0
+	for _, r := range s {
+		if utf8.RuneLen(r) > 1 {
+			width += assFontSize
+		} else {
+			width += assFontSize / 2
+		}
+	}
+	return width
+}
+
+var assReplacer = strings.NewReplacer(`\`, `＼`, `{`, `｛`, `}`, `｝`, "\r", "", "\n", " ")
+
+func assEscape(s string) string {
+	return strings.TrimSpace(assReplacer.Replace(s))
+}
+
+// assTime 格式化为 h:mm:ss.cc
+func assTime(seconds float64) string {
+	cs := int64(seconds*100 + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// bgr ASS 的颜色为 BGR 顺序
+func bgr(rgb int) int {
+	return (rgb&0xFF)<<16 | rgb&0xFF00 | rgb>>16&0xFF
+}
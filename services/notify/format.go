@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+)
+
+// 推送内容的格式
+const (
+	FormatGeneric = "generic"
+	FormatDiscord = "discord"
+	FormatSlack   = "slack"
+)
+
+// bilibiliPink Discord embed 的颜色
+const bilibiliPink = 0xFB7299
+
+var formats = map[string]func(event string, room *Room, now time.Time) interface{}{
+	FormatGeneric: genericPayload,
+	FormatDiscord: discordPayload,
+	FormatSlack:   slackPayload,
+}
+
+// Payload 通用格式的推送内容
+type Payload struct {
+	Event    string `json:"event"`
+	RoomId   int64  `json:"room_id"`
+	UID      int64  `json:"uid"`
+	Name     string `json:"name"`
+	Title    string `json:"title"`
+	Cover    string `json:"cover"`
+	UserFace string `json:"user_face"`
+	URL      string `json:"url"`
+	// LiveTime 开播时间，下播时为 0
+	LiveTime int64 `json:"live_time"`
+	Time     int64 `json:"time"`
+}
+
+func roomURL(room int64) string {
+	return fmt.Sprintf("https://live.bilibili.com/%d", room)
+}
+
+func summary(event string, room *Room) string {
+	if event == EventLive {
+		return fmt.Sprintf("%v 开播了: %v", room.Name, room.Title)
+	}
+	return fmt.Sprintf("%v 下播了", room.Name)
+}
+
+func genericPayload(event string, room *Room, now time.Time) interface{} {
+	return &Payload{
+		Event:    event,
+		RoomId:   room.RoomId,
+		UID:      room.UID,
+		Name:     room.Name,
+		Title:    room.Title,
+		Cover:    room.Cover,
+		UserFace: room.UserFace,
+		URL:      roomURL(room.RoomId),
+		LiveTime: room.LiveTime,
+		Time:     now.Unix(),
+	}
+}
+
+// discordPayload 返回 Discord webhook 的格式，开播时附带封面
+func discordPayload(event string, room *Room, now time.Time) interface{} {
+	embed := map[string]interface{}{
+		"title":       room.Title,
+		"url":         roomURL(room.RoomId),
+		"description": summary(event, room),
+		"color":       bilibiliPink,
+		"timestamp":   now.UTC().Format(time.RFC3339),
+		"author": map[string]string{
+			"name":     room.Name,
+			"icon_url": room.UserFace,
+		},
+	}
+	if event == EventLive && room.Cover != "" {
+		embed["image"] = map[string]string{"url": room.Cover}
+	}
+	return map[string]interface{}{
+		"content": summary(event, room),
+		"embeds":  []interface{}{embed},
+	}
+}
+
+// slackPayload 返回 Slack incoming webhook 的格式，开播时附带封面
+func slackPayload(event string, room *Room, now time.Time) interface{} {
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{
+				"type": "mrkdwn",
+				"text": fmt.Sprintf("*<%v|%v>*\n%v", roomURL(room.RoomId), room.Title, summary(event, room)),
+			},
+		},
+	}
+	if event == EventLive && room.Cover != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":      "image",
+			"image_url": room.Cover,
+			"alt_text":  room.Title,
+		})
+	}
+	return map[string]interface{}{
+		"text":   summary(event, room),
+		"blocks": blocks,
+	}
+}
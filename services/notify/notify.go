@@ -0,0 +1,289 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/services/database"
+	"github.com/eric2788/biligo-live-ws/services/webhook"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// 推送的事件
+const (
+	EventLive    = "live"
+	EventOffline = "offline"
+)
+
+// dbPrefix 通知在缓存数据库中的键前缀
+const dbPrefix = "notify:"
+
+var (
+	log = logrus.WithField("service", "notify")
+
+	ErrNotFound = errors.New("通知不存在")
+
+	mu    sync.RWMutex
+	hooks = make(map[string]*Hook)
+
+	// states 房间目前是否在直播，用于过滤重复推送的开播讯息
+	states = struct {
+		sync.Mutex
+		live map[int64]bool
+	}{live: make(map[int64]bool)}
+)
+
+// Hook 开播及下播通知
+type Hook struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Rooms 只通知这些房间，为空则通知所有监听中的房间
+	Rooms []int64 `json:"rooms,omitempty"`
+	// Events 为 live 或 offline，为空则两者都通知
+	Events []string `json:"events,omitempty"`
+	// Format 为 generic, discord 或 slack
+	Format  string         `json:"format"`
+	Webhook webhook.Target `json:"webhook"`
+
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// ValidationError 通知的内容无效
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// Room 开播或下播时的房间资讯
+type Room struct {
+	RoomId   int64
+	UID      int64
+	Name     string
+	Title    string
+	Cover    string
+	UserFace string
+	// LiveTime 开播时间，下播时为 0
+	LiveTime int64
+}
+
+// Validate 检查通知是否有效
+func (h *Hook) Validate() error {
+	if _, ok := formats[h.Format]; !ok {
+		return &ValidationError{fmt.Sprintf("format 无效: %q", h.Format)}
+	}
+	for _, e := range h.Events {
+		if e != EventLive && e != EventOffline {
+			return &ValidationError{fmt.Sprintf("events 无效: %q", e)}
+		}
+	}
+	if err := webhook.CheckURL(h.Webhook.URL); err != nil {
+		return &ValidationError{err.Error()}
+	}
+	return nil
+}
+
+// wants 检查是否需要通知此房间的事件
+func (h *Hook) wants(room int64, event string) bool {
+	if !h.Enabled {
+		return false
+	}
+	if len(h.Rooms) > 0 {
+		found := false
+		for _, r := range h.Rooms {
+			if r == room {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe 开始监听房间时记录目前的直播状态，不会推送通知
+func Observe(room int64, live bool) {
+	states.Lock()
+	defer states.Unlock()
+	states.live[room] = live
+}
+
+// Forget 停止监听房间时清除直播状态
+func Forget(room int64) {
+	states.Lock()
+	defer states.Unlock()
+	delete(states.live, room)
+}
+
+// Transition 房间开播或下播时调用，状态有变化时才推送通知，返回是否有变化。
+// 未曾记录状态的房间视为未开播。
+func Transition(room *Room, live bool) bool {
+	states.Lock()
+	changed := states.live[room.RoomId] != live
+	states.live[room.RoomId] = live
+	states.Unlock()
+
+	if !changed {
+		return false
+	}
+
+	event := EventOffline
+	if live {
+		event = EventLive
+	}
+
+	mu.RLock()
+	var matched []*Hook
+	for _, h := range hooks {
+		if h.wants(room.RoomId, event) {
+			matched = append(matched, h)
+		}
+	}
+	mu.RUnlock()
+
+	now := time.Now()
+	for _, h := range matched {
+		payload := formats[h.Format](event, room, now)
+		if _, err := webhook.Send(h.Webhook, event, payload); err != nil {
+			log.Warnf("推送房间 %v 的%v通知 (%v) 时出现错误: %v", room.RoomId, eventName(event), h.ID, err)
+		}
+	}
+	if len(matched) > 0 {
+		log.Infof("已推送房间 %v 的%v通知到 %v 个 webhook。", room.RoomId, eventName(event), len(matched))
+	}
+	return true
+}
+
+func eventName(event string) string {
+	if event == EventLive {
+		return "开播"
+	}
+	return "下播"
+}
+
+// Load 从缓存数据库读取所有通知，须在数据库启动后调用
+func Load() error {
+	loaded := make(map[string]*Hook)
+	err := database.UpdateDB(func(db *leveldb.Transaction) error {
+		iter := db.NewIterator(util.BytesPrefix([]byte(dbPrefix)), nil)
+		defer iter.Release()
+		for iter.Next() {
+			h := &Hook{}
+			if err := json.Unmarshal(iter.Value(), h); err != nil {
+				log.Errorf("尝试 decode %v 的数据时错误: %v, 已略过", string(iter.Key()), err)
+				continue
+			}
+			if err := h.Validate(); err != nil {
+				log.Errorf("通知 %v 无效: %v, 已略过", h.ID, err)
+				continue
+			}
+			loaded[h.ID] = h
+		}
+		return iter.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	hooks = loaded
+	mu.Unlock()
+
+	log.Infof("已载入 %v 个开播通知。", len(loaded))
+	return nil
+}
+
+// List 返回所有通知，按建立时间排列
+func List() []*Hook {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]*Hook, 0, len(hooks))
+	for _, h := range hooks {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt < list[j].CreatedAt
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Get 返回通知
+func Get(id string) (*Hook, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	h, ok := hooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return h, nil
+}
+
+// Put 新增或更新通知并保存，h.ID 为空时新增
+func Put(h *Hook) error {
+	if h.Format == "" {
+		h.Format = FormatGeneric
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now().Unix()
+	if h.ID == "" {
+		h.ID = fmt.Sprintf("%x", time.Now().UnixNano())
+		h.CreatedAt = now
+	} else if old, ok := hooks[h.ID]; ok {
+		h.CreatedAt = old.CreatedAt
+	} else {
+		return ErrNotFound
+	}
+	h.UpdatedAt = now
+
+	if err := database.PutToDB(dbPrefix+h.ID, h); err != nil {
+		return err
+	}
+	hooks[h.ID] = h
+	return nil
+}
+
+// Delete 删除通知
+func Delete(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := hooks[id]; !ok {
+		return ErrNotFound
+	}
+	err := database.UpdateDB(func(db *leveldb.Transaction) error {
+		return db.Delete([]byte(dbPrefix+id), nil)
+	})
+	if err != nil {
+		return err
+	}
+	delete(hooks, id)
+	return nil
+}
@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/eric2788/biligo-live-ws/services/webhook"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestTransition(t *testing.T) {
+	// 测试服务器在本机
+	cfg := config.Default().Webhook
+	cfg.AllowPrivate = true
+	webhook.Setup(cfg)
+
+	received := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payload := make(map[string]interface{})
+		_ = json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	mu.Lock()
+	hooks = map[string]*Hook{
+		"generic": {ID: "generic", Enabled: true, Format: FormatGeneric, Webhook: webhook.Target{URL: server.URL}},
+		"other":   {ID: "other", Enabled: true, Format: FormatGeneric, Rooms: []int64{546}, Webhook: webhook.Target{URL: server.URL}},
+	}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		hooks = make(map[string]*Hook)
+		mu.Unlock()
+	}()
+
+	room := &Room{RoomId: 545, Name: "主播", Title: "标题", LiveTime: 1660000000}
+	Observe(545, false)
+	defer Forget(545)
+
+	// 重复推送的开播讯息只通知一次
+	assert.Equal(t, Transition(room, true), true)
+	assert.Equal(t, Transition(room, true), false)
+
+	payload := <-received
+	assert.Equal(t, payload["event"], EventLive)
+	assert.Equal(t, payload["room_id"], float64(545))
+	assert.Equal(t, payload["title"], "标题")
+	assert.Equal(t, payload["url"], "https://live.bilibili.com/545")
+
+	assert.Equal(t, Transition(&Room{RoomId: 545}, false), true)
+	payload = <-received
+	assert.Equal(t, payload["event"], EventOffline)
+
+	select {
+	case payload = <-received:
+		t.Fatalf("不应再次推送: %v", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 开始监听时已在直播
+	Observe(545, true)
+	assert.Equal(t, Transition(room, true), false)
+}
+
+func TestFormats(t *testing.T) {
+	room := &Room{RoomId: 545, Name: "主播", Title: "标题", Cover: "https://example.com/cover.jpg"}
+	now := time.Unix(1660000000, 0)
+
+	discord := discordPayload(EventLive, room, now).(map[string]interface{})
+	assert.Equal(t, discord["content"], "主播 开播了: 标题")
+	embed := discord["embeds"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, embed["image"], map[string]string{"url": room.Cover})
+	assert.Equal(t, embed["timestamp"], "2022-08-08T23:06:40Z")
+
+	slack := slackPayload(EventOffline, room, now).(map[string]interface{})
+	assert.Equal(t, slack["text"], "主播 下播了")
+	assert.Equal(t, len(slack["blocks"].([]interface{})), 1)
+
+	_, ok := (&Hook{Format: "teams", Webhook: webhook.Target{URL: "https://example.com"}}).Validate().(*ValidationError)
+	assert.Equal(t, ok, true)
+	_, ok = (&Hook{Format: FormatSlack, Events: []string{"start"}, Webhook: webhook.Target{URL: "https://example.com"}}).Validate().(*ValidationError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, (&Hook{Format: FormatDiscord, Webhook: webhook.Target{URL: "https://example.com"}}).Validate(), nil)
+}
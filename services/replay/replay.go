@@ -0,0 +1,241 @@
+package replay
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eric2788/biligo-live-ws/services/database"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// dbPrefix 持久化的缓冲在缓存数据库中的键前缀
+const dbPrefix = "replay:"
+
+var (
+	log = logrus.WithField("service", "replay")
+
+	// size 每个房间保留的讯息数量，0 为停用
+	size = 100
+
+	mu    sync.RWMutex
+	rooms = make(map[int64]*ring)
+)
+
+// Event 已编号的讯息
+type Event struct {
+	Seq uint64 `json:"seq"`
+	// Command 讯息的指令，补发时按此过滤而无需解析内容
+	Command string          `json:"command"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// ring 房间最近的讯息，第 seq 条位于 events[seq%len(events)]
+type ring struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []Event
+}
+
+// snapshot 持久化时保存的内容
+type snapshot struct {
+	Seq    uint64  `json:"seq"`
+	Events []Event `json:"events"`
+}
+
+// Setup 设定每个房间保留的讯息数量，须在 Append 前调用
+func Setup(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	size = n
+}
+
+// Enabled 返回是否有保留讯息
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return size > 0
+}
+
+func get(room int64, create bool) *ring {
+	mu.RLock()
+	r, ok := rooms[room]
+	mu.RUnlock()
+	if ok || !create {
+		return r
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if r, ok = rooms[room]; !ok {
+		r = &ring{events: make([]Event, size)}
+		rooms[room] = r
+	}
+	return r
+}
+
+// Append 为房间指令为 command 的下一条讯息编号，以 encode 按编号生成内容后保存，返回编号及内容。
+// 停用时编号为 0。
+func Append(room int64, command string, encode func(seq uint64) ([]byte, error)) (uint64, []byte, error) {
+	if !Enabled() {
+		data, err := encode(0)
+		return 0, data, err
+	}
+
+	r := get(room, true)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := encode(r.seq + 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	r.seq++
+	r.events[r.seq%uint64(len(r.events))] = Event{Seq: r.seq, Command: command, Data: data}
+	return r.seq, data, nil
+}
+
+// Since 返回房间编号大于 seq 且仍在缓冲中的讯息，以及最早一条缺失的编号 (0 为没有缺失)。
+// seq 大于目前的编号时视为编号已重置 (例如程序重启)，返回全部缓冲。
+func Since(room int64, seq uint64) ([]Event, uint64) {
+	r := get(room, false)
+	if r == nil {
+		return nil, 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := uint64(len(r.events))
+	if seq > r.seq {
+		seq = 0
+	}
+
+	var missing uint64
+	oldest := uint64(1)
+	if r.seq > n {
+		oldest = r.seq - n + 1
+	}
+	if seq+1 < oldest {
+		missing = seq + 1
+		seq = oldest - 1
+	}
+
+	events := make([]Event, 0, r.seq-seq)
+	for i := seq + 1; i <= r.seq; i++ {
+		// 恢复的缓冲可能不连续
+		if ev := r.events[i%n]; ev.Seq == i {
+			events = append(events, ev)
+		}
+	}
+	return events, missing
+}
+
+// Last 返回房间最后一条讯息的编号
+func Last(room int64) uint64 {
+	r := get(room, false)
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seq
+}
+
+// ParseVector 解析 房间号:编号 以逗号分隔的列表，例如 545:120,114514:33
+func ParseVector(s string) (map[int64]uint64, error) {
+	vector := make(map[int64]uint64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		room, seq, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, &strconv.NumError{Func: "ParseVector", Num: part, Err: strconv.ErrSyntax}
+		}
+		r, err := strconv.ParseInt(room, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		vector[r] = n
+	}
+	return vector, nil
+}
+
+// Load 从缓存数据库恢复上次保存的缓冲，须在数据库启动后及 Append 前调用
+func Load() error {
+	if !Enabled() {
+		return nil
+	}
+	loaded := 0
+	err := database.UpdateDB(func(db *leveldb.Transaction) error {
+		iter := db.NewIterator(util.BytesPrefix([]byte(dbPrefix)), nil)
+		defer iter.Release()
+		for iter.Next() {
+			room, err := strconv.ParseInt(strings.TrimPrefix(string(iter.Key()), dbPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			var snap snapshot
+			if err := json.Unmarshal(iter.Value(), &snap); err != nil {
+				log.Errorf("尝试 decode %v 的数据时错误: %v, 已略过", string(iter.Key()), err)
+				continue
+			}
+			r := get(room, true)
+			r.mu.Lock()
+			r.seq = snap.Seq
+			for _, ev := range snap.Events {
+				// 旧版本保存的讯息没有指令，从内容读取
+				if ev.Command == "" {
+					var data struct {
+						Command string `json:"command"`
+					}
+					_ = json.Unmarshal(ev.Data, &data)
+					ev.Command = data.Command
+				}
+				r.events[ev.Seq%uint64(len(r.events))] = ev
+			}
+			r.mu.Unlock()
+			loaded++
+		}
+		return iter.Error()
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("已恢复 %v 个房间的讯息缓冲。", loaded)
+	return nil
+}
+
+// Save 将所有房间的缓冲保存到缓存数据库，下次启动时以 Load 恢复
+func Save() error {
+	mu.RLock()
+	defer mu.RUnlock()
+	for room, r := range rooms {
+		r.mu.Lock()
+		snap := snapshot{Seq: r.seq}
+		for _, ev := range r.events {
+			if ev.Seq > 0 {
+				snap.Events = append(snap.Events, ev)
+			}
+		}
+		r.mu.Unlock()
+		// 按编号排列，缓冲数量改小时恢复后只保留最新的讯息
+		sort.Slice(snap.Events, func(i, j int) bool { return snap.Events[i].Seq < snap.Events[j].Seq })
+		if err := database.PutToDB(dbPrefix+strconv.FormatInt(room, 10), &snap); err != nil {
+			return err
+		}
+	}
+	log.Infof("已保存 %v 个房间的讯息缓冲。", len(rooms))
+	return nil
+}
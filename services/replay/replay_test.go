@@ -0,0 +1,79 @@
+package replay
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestSince(t *testing.T) {
+	Setup(3)
+	defer Setup(100)
+	defer func() {
+		mu.Lock()
+		delete(rooms, 545)
+		mu.Unlock()
+	}()
+
+	for i := 0; i < 5; i++ {
+		seq, data, err := Append(545, "DANMU_MSG", func(seq uint64) ([]byte, error) {
+			return []byte(strconv.FormatUint(seq, 10)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, seq, uint64(i+1))
+		assert.Equal(t, string(data), strconv.Itoa(i+1))
+	}
+	assert.Equal(t, Last(545), uint64(5))
+
+	events, missing := Since(545, 3)
+	assert.Equal(t, missing, uint64(0))
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Seq, uint64(4))
+	assert.Equal(t, events[0].Command, "DANMU_MSG")
+	assert.Equal(t, string(events[1].Data), "5")
+
+	// 第 2 条已被覆盖
+	events, missing = Since(545, 1)
+	assert.Equal(t, missing, uint64(2))
+	assert.Equal(t, len(events), 3)
+	assert.Equal(t, events[0].Seq, uint64(3))
+
+	// 编号大于目前的编号时视为已重置
+	events, missing = Since(545, 100)
+	assert.Equal(t, missing, uint64(1))
+	assert.Equal(t, len(events), 3)
+
+	events, _ = Since(545, 5)
+	assert.Equal(t, len(events), 0)
+
+	events, missing = Since(546, 1)
+	assert.Equal(t, len(events), 0)
+	assert.Equal(t, missing, uint64(0))
+}
+
+func TestDisabled(t *testing.T) {
+	Setup(0)
+	defer Setup(100)
+
+	seq, data, err := Append(545, "DANMU_MSG", func(seq uint64) ([]byte, error) {
+		return []byte("data"), nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, seq, uint64(0))
+	assert.Equal(t, string(data), "data")
+	assert.Equal(t, Last(545), uint64(0))
+}
+
+func TestParseVector(t *testing.T) {
+	vector, err := ParseVector("545:120, 114514:33,")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, vector, map[int64]uint64{545: 120, 114514: 33})
+
+	_, err = ParseVector("545")
+	assert.NotEqual(t, err, nil)
+	_, err = ParseVector("545:-1")
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,211 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	live "github.com/eric2788/biligo-live"
+	"github.com/sirupsen/logrus"
+)
+
+// Window 滑动窗口的长度，以秒为单位分桶
+const Window = 60
+
+var (
+	log = logrus.WithField("service", "stats")
+
+	mu    sync.RWMutex
+	rooms = make(map[int64]*roomStats)
+
+	// now 测试时可替换
+	now = time.Now
+)
+
+// Stats 房间最近一分钟的统计
+type Stats struct {
+	RoomId int64 `json:"room_id"`
+	// Danmaku 最近一分钟的弹幕数量
+	Danmaku int64 `json:"danmaku_per_minute"`
+	// Chatters 最近一分钟发送过弹幕的用户数量
+	Chatters int `json:"chatters"`
+	// Revenue 最近一分钟礼物、上舰和 SC 的收入 (毫元)，银瓜子礼物不计入
+	Revenue int64 `json:"revenue_per_minute"`
+	// Popularity 最近一次心跳回应的人气值
+	Popularity int64 `json:"popularity"`
+	// UpdatedAt 最后收到讯息的时间
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type bucket struct {
+	sec     int64
+	danmaku int64
+	revenue int64
+}
+
+type roomStats struct {
+	mu      sync.Mutex
+	buckets [Window]bucket
+	// chatters 用户最后发送弹幕的时间，每经过一个窗口清除一次过期的用户
+	chatters map[int64]int64
+	// pruned 上次清除过期用户的时间
+	pruned     int64
+	popularity int64
+	updated    int64
+}
+
+// Record 统计房间收到的讯息
+func Record(room int64, msg live.Msg) {
+	switch msg := msg.(type) {
+	case *live.MsgDanmaku:
+		dm, err := msg.Parse()
+		if err != nil {
+			return
+		}
+		update(room, func(r *roomStats, b *bucket, sec int64) {
+			b.danmaku++
+			r.chatters[dm.MID] = sec
+		})
+
+	case *live.MsgSendGift:
+		dm, err := msg.Parse()
+		if err != nil || dm.CoinType != "gold" {
+			return
+		}
+		addRevenue(room, int64(dm.Price)*int64(dm.Num))
+
+	case *live.MsgUserToastMsg:
+		dm, err := msg.Parse()
+		if err != nil {
+			return
+		}
+		addRevenue(room, dm.Price*int64(dm.Num))
+
+	// SC_JPN 与 SC 重复推送，只统计 SC
+	case *live.MsgSuperChatMessage:
+		dm, err := msg.Parse()
+		if err != nil {
+			return
+		}
+		addRevenue(room, int64(dm.Price)*1000)
+
+	case *live.MsgHeartbeatReply:
+		popularity := int64(msg.GetHot())
+		update(room, func(r *roomStats, b *bucket, sec int64) {
+			r.popularity = popularity
+		})
+	}
+}
+
+func addRevenue(room int64, milli int64) {
+	update(room, func(r *roomStats, b *bucket, sec int64) {
+		b.revenue += milli
+	})
+}
+
+// update 取得房间目前这一秒的分桶并更新
+func update(room int64, fn func(r *roomStats, b *bucket, sec int64)) {
+	mu.RLock()
+	r, ok := rooms[room]
+	mu.RUnlock()
+
+	if !ok {
+		mu.Lock()
+		if r, ok = rooms[room]; !ok {
+			r = &roomStats{chatters: make(map[int64]int64)}
+			rooms[room] = r
+		}
+		mu.Unlock()
+	}
+
+	sec := now().Unix()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := &r.buckets[sec%Window]
+	if b.sec != sec {
+		*b = bucket{sec: sec}
+		// 分桶轮替时检查，最多保留两个窗口内的用户
+		if sec-r.pruned >= Window {
+			r.prune(sec)
+		}
+	}
+	fn(r, b, sec)
+	r.updated = sec
+}
+
+// Get 返回房间最近一分钟的统计
+func Get(room int64) (*Stats, bool) {
+	mu.RLock()
+	r, ok := rooms[room]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	return r.snapshot(room, now().Unix()), true
+}
+
+func (r *roomStats) snapshot(room, sec int64) *Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &Stats{RoomId: room, Popularity: r.popularity, UpdatedAt: r.updated}
+	for _, b := range r.buckets {
+		if b.sec > sec-Window && b.sec <= sec {
+			s.Danmaku += b.danmaku
+			s.Revenue += b.revenue
+		}
+	}
+	for _, last := range r.chatters {
+		if last > sec-Window {
+			s.Chatters++
+		}
+	}
+	return s
+}
+
+// prune 清除窗口外的用户
+func (r *roomStats) prune(sec int64) {
+	for uid, last := range r.chatters {
+		if last <= sec-Window {
+			delete(r.chatters, uid)
+		}
+	}
+	r.pruned = sec
+}
+
+// Rooms 返回有统计的房间
+func Rooms() []int64 {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	list := make([]int64, 0, len(rooms))
+	for room := range rooms {
+		list = append(list, room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// Remove 停止监听房间时清除统计
+func Remove(room int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(rooms, room)
+}
+
+// Publish 每隔 interval 将所有房间的统计交给 fn
+func Publish(interval time.Duration, fn func(*Stats)) {
+	log.Infof("已启动直播统计推送，间隔 %v。", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, room := range Rooms() {
+			if s, ok := Get(room); ok {
+				fn(s)
+			}
+		}
+	}
+}
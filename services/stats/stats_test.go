@@ -0,0 +1,87 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+	defer Remove(545)
+
+	danmaku := func(uid int64) {
+		update(545, func(r *roomStats, b *bucket, sec int64) {
+			b.danmaku++
+			r.chatters[uid] = sec
+		})
+	}
+
+	danmaku(1)
+	danmaku(2)
+	addRevenue(545, 1000)
+
+	clock = clock.Add(30 * time.Second)
+	danmaku(1)
+	addRevenue(545, 30000)
+
+	s, ok := Get(545)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, s.Danmaku, int64(3))
+	assert.Equal(t, s.Chatters, 2)
+	assert.Equal(t, s.Revenue, int64(31000))
+	assert.Equal(t, s.UpdatedAt, int64(1030))
+
+	// 一分钟前的分桶和用户移出窗口
+	clock = clock.Add(30 * time.Second)
+	s, _ = Get(545)
+	assert.Equal(t, s.Danmaku, int64(1))
+	assert.Equal(t, s.Chatters, 1)
+	assert.Equal(t, s.Revenue, int64(30000))
+
+	// 分桶重复使用时重置
+	danmaku(3)
+	s, _ = Get(545)
+	assert.Equal(t, s.Danmaku, int64(2))
+	assert.Equal(t, s.Chatters, 2)
+
+	assert.Equal(t, Rooms(), []int64{545})
+	Remove(545)
+	_, ok = Get(545)
+	assert.Equal(t, ok, false)
+}
+
+func TestPruneChatters(t *testing.T) {
+	clock := time.Unix(2000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+	defer Remove(114514)
+
+	danmaku := func(uid int64) {
+		update(114514, func(r *roomStats, b *bucket, sec int64) {
+			b.danmaku++
+			r.chatters[uid] = sec
+		})
+	}
+
+	for uid := int64(1); uid <= 100; uid++ {
+		danmaku(uid)
+	}
+
+	// 没有调用 Get 时同样清除过期的用户
+	clock = clock.Add(Window * time.Second)
+	danmaku(1000)
+
+	mu.RLock()
+	r := rooms[114514]
+	mu.RUnlock()
+	r.mu.Lock()
+	assert.Equal(t, len(r.chatters), 1)
+	r.mu.Unlock()
+
+	s, _ := Get(114514)
+	assert.Equal(t, s.Chatters, 1)
+}
@@ -2,27 +2,43 @@ package subscriber
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
 	set "github.com/deckarep/golang-set/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	queue        = set.NewSet[string]()
+	// mu 防止同时修改同一订阅时互相覆盖
+	mu           sync.Mutex
 	subscribeMap = sync.Map{}
 	expireMap    = sync.Map{}
 	log          = logrus.WithField("service", "subscriber")
+
+	expireHooks []func(identifier string)
 )
 
-// Update 操作太慢，尝试使用 go 懸掛
+// OnExpire 注册订阅过期时的回调，须在启动时调用
+func OnExpire(hook func(identifier string)) {
+	expireHooks = append(expireHooks, hook)
+}
+
+// Update 设置订阅列表，返回时已完成更新
 func Update(identifier string, rooms []int64) {
-	log.Infof("%v 的订阅更新已加入队列...", identifier)
-	queue.Add(identifier)
-	go func() {
-		subscribeMap.Store(identifier, rooms)
-		log.Infof("%v 的订阅更新已完成。", identifier)
-		queue.Remove(identifier)
-	}()
+	mu.Lock()
+	defer mu.Unlock()
+	subscribeMap.Store(identifier, rooms)
+	log.Infof("%v 的订阅更新已完成。", identifier)
+}
+
+// InitIfAbsent 尚未有订阅时以空列表建立，返回先前是否已有订阅
+func InitIfAbsent(identifier string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, loaded := subscribeMap.LoadOrStore(identifier, []int64{})
+	return loaded
 }
 
 func ExpireAfter(identifier string, timer *time.Timer) {
@@ -36,11 +52,6 @@ func ExpireAfterWithCheck(identifier string, timer *time.Timer, checkExist bool)
 		return
 	}
 
-	// 队列內有，防止过期
-	if checkExist && queue.Contains(identifier) {
-		return
-	}
-
 	connected := make(chan struct{})
 
 	go func() {
@@ -54,6 +65,9 @@ func ExpireAfterWithCheck(identifier string, timer *time.Timer, checkExist bool)
 				}
 				log.Infof("%v 的订阅已过期。\n", identifier)
 				subscribeMap.Delete(identifier)
+				for _, hook := range expireHooks {
+					hook(identifier)
+				}
 				return
 			case <-connected:
 				log.Infof("已终止用户 %v 的订阅过期。", identifier)
@@ -127,6 +141,9 @@ func GetAllSubscribers(room int64) []string {
 
 func Add(identifier string, rooms []int64) []int64 {
 
+	mu.Lock()
+	defer mu.Unlock()
+
 	res, ok := Get(identifier)
 
 	if !ok {
@@ -137,7 +154,7 @@ func Add(identifier string, rooms []int64) []int64 {
 		s.Add(i)
 	})
 
-	Update(identifier, newRooms)
+	subscribeMap.Store(identifier, newRooms)
 	return newRooms
 }
 
@@ -160,6 +177,9 @@ func UpdateRange[T comparable](res []T, rooms []T, updater func(set.Set[T], T))
 
 func Remove(identifier string, rooms []int64) ([]int64, bool) {
 
+	mu.Lock()
+	defer mu.Unlock()
+
 	res, ok := Get(identifier)
 
 	if !ok {
@@ -170,11 +190,13 @@ func Remove(identifier string, rooms []int64) ([]int64, bool) {
 		s.Remove(i)
 	})
 
-	Update(identifier, newRooms)
+	subscribeMap.Store(identifier, newRooms)
 	return newRooms, true
 }
 
 func Delete(identifier string) {
+	mu.Lock()
+	defer mu.Unlock()
 	subscribeMap.Delete(identifier)
 }
 
@@ -1,8 +1,12 @@
 package subscriber
 
 import (
+	"sort"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/go-playground/assert/v2"
 )
 
 func BenchmarkAdd(b *testing.B) {
@@ -25,3 +29,30 @@ func BenchmarkAdd(b *testing.B) {
 	b.Logf("took %s", elapsed)
 
 }
+
+func TestConcurrentAdd(t *testing.T) {
+	defer Delete("concurrent")
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(room int64) {
+			defer wg.Done()
+			Add("concurrent", []int64{room})
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// 同时新增的订阅不会互相覆盖，返回时已可读取
+	rooms, ok := Get("concurrent")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, len(rooms), 100)
+
+	rooms, _ = Remove("concurrent", []int64{0, 1})
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i] < rooms[j] })
+	assert.Equal(t, rooms[0], int64(2))
+
+	assert.Equal(t, InitIfAbsent("concurrent"), true)
+	current, _ := Get("concurrent")
+	assert.Equal(t, len(current), 98)
+}
@@ -0,0 +1,294 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/sirupsen/logrus"
+)
+
+// 推送请求的标头
+const (
+	HeaderEvent     = "X-Biligo-Event"
+	HeaderDelivery  = "X-Biligo-Delivery"
+	HeaderTimestamp = "X-Biligo-Timestamp"
+	// HeaderSignature 为 sha256=HEX(HMAC-SHA256(密钥, 时间戳 + "." + 内容))
+	HeaderSignature = "X-Biligo-Signature"
+)
+
+// logSize 保留的推送记录数量
+const logSize = 200
+
+var (
+	log = logrus.WithField("service", "webhook")
+
+	settings = config.Default().Webhook
+	client   = newClient(settings)
+
+	queue chan *job
+	start sync.Once
+
+	// backoff 第 n 次重试前的等待时间，测试时可替换
+	backoff = func(n int) time.Duration {
+		return time.Second << (n - 1)
+	}
+
+	deliveries = struct {
+		sync.Mutex
+		list []*Delivery
+		next int
+	}{list: make([]*Delivery, 0, logSize)}
+)
+
+// Target 推送的目标
+type Target struct {
+	URL string `json:"url"`
+	// Secret 签名密钥，为空则使用设定中的预设密钥
+	Secret string `json:"secret,omitempty"`
+}
+
+// Delivery 一次推送的记录
+type Delivery struct {
+	ID       string `json:"id"`
+	Event    string `json:"event"`
+	URL      string `json:"url"`
+	Attempts int    `json:"attempts"`
+	// Status 最后一次请求的 HTTP 状态码，请求失败时为 0
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Success   bool   `json:"success"`
+	CreatedAt int64  `json:"created_at"`
+	// Duration 包含重试等待的总耗时 (毫秒)
+	Duration int64 `json:"duration"`
+}
+
+type job struct {
+	target   Target
+	event    string
+	body     []byte
+	delivery *Delivery
+	started  time.Time
+}
+
+// cgnat 运营商级 NAT 的共享地址 (100.64.0.0/10)
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Setup 按设定更新推送方式，须在 Send 前调用
+func Setup(cfg config.Webhook) {
+	settings = cfg
+	client = newClient(cfg)
+}
+
+// newClient 返回推送用的 HTTP 客户端，未允许内网地址时在连接前检查解析后的 IP，
+// 包括重定向后的地址
+func newClient(cfg config.Webhook) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || private(ip) {
+				return fmt.Errorf("不允许推送到内网地址 %v", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// private 检查是否为本机、内网或保留地址
+func private(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		cgnat.Contains(ip)
+}
+
+// CheckURL 检查推送地址是否有效，未允许内网地址时拒绝 localhost 及内网 IP。
+// 域名解析后的地址会在推送时再次检查
+func CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook.url 无效: %q", raw)
+	}
+	if settings.AllowPrivate {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("webhook.url 不可为内网地址: %q", raw)
+	}
+	if ip := net.ParseIP(host); ip != nil && private(ip) {
+		return fmt.Errorf("webhook.url 不可为内网地址: %q", raw)
+	}
+	return nil
+}
+
+func startWorkers() {
+	jobs := make(chan *job, settings.QueueSize)
+	queue = jobs
+	for i := 0; i < settings.Workers; i++ {
+		go func() {
+			for j := range jobs {
+				deliver(j)
+			}
+		}()
+	}
+}
+
+// Send 将 payload 以 JSON 编码后加入推送队列，返回推送记录的 ID。队列已满时丢弃。
+func Send(target Target, event string, payload interface{}) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	start.Do(startWorkers)
+
+	d := &Delivery{ID: newID(), Event: event, URL: target.URL, CreatedAt: time.Now().Unix()}
+	select {
+	case queue <- &job{target: target, event: event, body: body, delivery: d, started: time.Now()}:
+		return d.ID, nil
+	default:
+		d.Error = "推送队列已满"
+		record(d)
+		log.Warnf("推送队列已满，已丢弃 %v 事件 (%v)", event, target.URL)
+		return d.ID, fmt.Errorf("推送队列已满")
+	}
+}
+
+// deliver 发送一次请求，失败时按 backoff 重新排入队列，完成后写入推送记录。
+// 等待重试期间不占用 worker
+func deliver(j *job) {
+	d := j.delivery
+	d.Attempts++
+	retry, err := post(j)
+	if err == nil {
+		d.Success, d.Error = true, ""
+	} else {
+		d.Error = err.Error()
+		if retry && d.Attempts <= settings.MaxRetries {
+			log.Debugf("推送 %v 事件到 %v 失败，将重试: %v", j.event, j.target.URL, err)
+			time.AfterFunc(backoff(d.Attempts), func() { requeue(j) })
+			return
+		}
+		log.Warnf("推送 %v 事件到 %v 失败 (已尝试 %v 次): %v", j.event, j.target.URL, d.Attempts, err)
+	}
+
+	d.Duration = time.Since(j.started).Milliseconds()
+	record(d)
+}
+
+// requeue 将等待重试的推送重新排入队列，队列已满时不等待，直接记录为失败
+func requeue(j *job) {
+	select {
+	case queue <- j:
+	default:
+		d := j.delivery
+		d.Error = fmt.Sprintf("推送队列已满，放弃重试: %v", d.Error)
+		d.Duration = time.Since(j.started).Milliseconds()
+		record(d)
+		log.Warnf("推送队列已满，已放弃重试 %v 事件 (%v)", j.event, j.target.URL)
+	}
+}
+
+// post 发送一次请求，返回失败后是否可以重试
+func post(j *job) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, j.target.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "biligo-live-ws")
+	req.Header.Set(HeaderEvent, j.event)
+	req.Header.Set(HeaderDelivery, j.delivery.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+
+	secret := j.target.Secret
+	if secret == "" {
+		secret = settings.Secret
+	}
+	if secret != "" {
+		req.Header.Set(HeaderSignature, Sign(secret, timestamp, j.body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	j.delivery.Status = res.StatusCode
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	// 只重试服务端错误及请求过于频繁
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("HTTP %v", res.StatusCode)
+}
+
+// Sign 返回推送内容的签名，接收端可用相同方式验证
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func record(d *Delivery) {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	if len(deliveries.list) < logSize {
+		deliveries.list = append(deliveries.list, d)
+		return
+	}
+	deliveries.list[deliveries.next] = d
+	deliveries.next = (deliveries.next + 1) % logSize
+}
+
+// Deliveries 返回最近已完成的推送记录，由新到旧
+func Deliveries() []*Delivery {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	n := len(deliveries.list)
+	list := make([]*Delivery, n)
+	for i := 0; i < n; i++ {
+		d := *deliveries.list[(deliveries.next+n-1-i)%n]
+		list[i] = &d
+	}
+	return list
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eric2788/biligo-live-ws/config"
+	"github.com/go-playground/assert/v2"
+)
+
+func init() {
+	// 测试服务器在本机
+	settings.AllowPrivate = true
+	client = newClient(settings)
+}
+
+func TestDeliver(t *testing.T) {
+	backoff = func(int) time.Duration { return time.Millisecond }
+	settings.MaxRetries = 2
+
+	var calls int32
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// 第一次返回 500 以测试重试
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	id, err := Send(Target{URL: server.URL, Secret: "secret"}, "test", map[string]int{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, body := <-received, <-bodies
+	assert.Equal(t, string(body), `{"a":1}`)
+	assert.Equal(t, r.Header.Get(HeaderEvent), "test")
+	assert.Equal(t, r.Header.Get(HeaderDelivery), id)
+	assert.Equal(t, r.Header.Get(HeaderSignature), Sign("secret", r.Header.Get(HeaderTimestamp), body))
+
+	d := waitDelivery(t, id)
+	assert.Equal(t, d.Success, true)
+	assert.Equal(t, d.Attempts, 2)
+	assert.Equal(t, d.Status, 200)
+}
+
+func TestDeliverRetryReleasesWorker(t *testing.T) {
+	backoff = func(int) time.Duration { return 300 * time.Millisecond }
+	defer func() { backoff = func(int) time.Duration { return time.Millisecond } }()
+	settings.MaxRetries = 1
+	start.Do(startWorkers)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	d := &Delivery{ID: newID()}
+	started := time.Now()
+	deliver(&job{target: Target{URL: server.URL}, event: "test", delivery: d, started: started})
+	// 重试由计时器重新排入队列，不在 worker 中等待
+	if time.Since(started) >= 300*time.Millisecond {
+		t.Fatal("deliver 不应等待重试")
+	}
+
+	d = waitDelivery(t, d.ID)
+	assert.Equal(t, d.Success, true)
+	assert.Equal(t, d.Attempts, 2)
+	assert.Equal(t, d.Duration >= 300, true)
+}
+
+func TestDeliverRetryQueueFull(t *testing.T) {
+	backoff = func(int) time.Duration { return time.Millisecond }
+	settings.MaxRetries = 1
+	start.Do(startWorkers)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	// 以已满的队列代替，重试时不应阻塞计时器
+	workers := queue
+	queue = make(chan *job, 1)
+	queue <- &job{}
+	defer func() { queue = workers }()
+
+	d := &Delivery{ID: newID()}
+	deliver(&job{target: Target{URL: server.URL}, event: "test", delivery: d, started: time.Now()})
+
+	d = waitDelivery(t, d.ID)
+	assert.Equal(t, d.Success, false)
+	assert.Equal(t, d.Attempts, 1)
+	assert.Equal(t, strings.HasPrefix(d.Error, "推送队列已满"), true)
+	assert.Equal(t, len(queue), 1)
+}
+
+func TestDeliverClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HeaderSignature) != "" {
+			t.Error("未设定密钥时不应签名")
+		}
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	id, err := Send(Target{URL: server.URL}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端错误不重试
+	d := waitDelivery(t, id)
+	assert.Equal(t, d.Success, false)
+	assert.Equal(t, d.Attempts, 1)
+	assert.Equal(t, d.Status, 404)
+}
+
+func TestCheckURL(t *testing.T) {
+	settings.AllowPrivate = false
+	defer func() { settings.AllowPrivate = true }()
+
+	assert.Equal(t, CheckURL("https://example.com/hook"), nil)
+	assert.Equal(t, CheckURL("http://93.184.216.34:8080/hook"), nil)
+	for _, u := range []string{
+		"ftp://example.com",
+		"https://",
+		"http://localhost:8080",
+		"http://api.localhost",
+		"http://127.0.0.1",
+		"http://10.0.0.1",
+		"http://192.168.1.1",
+		"http://169.254.169.254/latest/meta-data",
+		"http://100.64.0.1",
+		"http://[::1]:8080",
+		"http://[fd00::1]",
+		"http://0.0.0.0",
+	} {
+		if CheckURL(u) == nil {
+			t.Errorf("应拒绝 %v", u)
+		}
+	}
+
+	settings.AllowPrivate = true
+	assert.Equal(t, CheckURL("http://127.0.0.1:8080"), nil)
+}
+
+func TestClientRejectsPrivate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("不应连接到本机地址")
+	}))
+	defer server.Close()
+
+	// 域名解析或重定向到内网地址时同样在连接前拒绝
+	c := newClient(config.Webhook{Timeout: time.Second})
+	if _, err := c.Get(server.URL); err == nil {
+		t.Fatal("应拒绝连接到本机地址")
+	}
+}
+
+func waitDelivery(t *testing.T, id string) *Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, d := range Deliveries() {
+			if d.ID == id {
+				return d
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("推送 %v 未完成", id)
+	return nil
+}
+
+func TestDeliveriesOrder(t *testing.T) {
+	deliveries.Lock()
+	deliveries.list, deliveries.next = deliveries.list[:0], 0
+	deliveries.Unlock()
+
+	for i := 0; i < logSize+5; i++ {
+		record(&Delivery{CreatedAt: int64(i)})
+	}
+	list := Deliveries()
+	assert.Equal(t, len(list), logSize)
+	assert.Equal(t, list[0].CreatedAt, int64(logSize+4))
+	assert.Equal(t, list[logSize-1].CreatedAt, int64(5))
+}